@@ -5,12 +5,31 @@ import (
 	"Distribute/log"
 	"Distribute/registry"
 	"Distribute/service"
+	"Distribute/trace"
 	"context"
+	"flag"
 	"fmt"
 	stlog "log"
 )
 
+var (
+	traceFile = flag.String("trace-file", "", "also append finished spans to this file as JSON lines")
+	adminAddr = flag.String("admin", "", "address of the diagnostics listener, e.g. localhost:6001; disabled when empty")
+	storeKind = flag.String("store", grades.DefaultConfig.Store, "grades storage backend: memory, or file for a write-ahead log with snapshots in -data-dir")
+	dataDir   = flag.String("data-dir", grades.DefaultConfig.DataDir, "directory of the file store")
+	seed      = flag.Bool("seed", grades.DefaultConfig.Seed, "load the sample students into a new store; a file store is seeded only when -data-dir has no data yet")
+)
+
 func main() {
+	flag.Parse()
+	err := grades.Open(grades.Config{
+		Store:   *storeKind,
+		DataDir: *dataDir,
+		Seed:    *seed,
+	})
+	if err != nil {
+		stlog.Fatalln(err)
+	}
 	host, port := "localhost", "6000"
 	serviceAddress := fmt.Sprintf("http://%s:%s", host, port)
 	r := registry.Registration{
@@ -21,7 +40,10 @@ func main() {
 		},
 		ServiceUpdateURL: serviceAddress + "/services",
 		HeartbeatURL:     serviceAddress + "/heartbeat",
+		ReadinessURL:     serviceAddress + "/readyz",
 	}
+	service.AddReadinessCheck("storage", grades.CheckStorage)
+	service.EnableAdmin(*adminAddr)
 	ctx, err := service.Start(
 		context.Background(),
 		host,
@@ -33,8 +55,28 @@ func main() {
 	}
 	if logProvider, err := registry.GetProvider(registry.LogService); err == nil {
 		fmt.Printf("Logging Service found at : %s\n", logProvider)
-		log.SetClientLogger(logProvider, r.ServiceName)
 	}
+	// 没有可用的日志服务时先在本地输出，日志服务注册后自动切换
+	log.SetClientLogger(r)
+	setTraceExporter()
 	<-ctx.Done()
+	// 退出前发送缓存中的日志
+	log.Close()
+	if err := grades.Close(); err != nil {
+		stlog.Println(err)
+	}
 	fmt.Println("Shutting down Grading service")
 }
+
+// span 发送到日志服务的收集器，可以在日志服务的 /traces 页面查看
+// 每次导出时查找日志服务，日志服务晚于本服务注册时同样可以收到 span
+func setTraceExporter() {
+	exporters := []trace.Exporter{trace.LookupExporter(func() (string, error) {
+		logProvider, err := registry.GetProvider(registry.LogService)
+		return logProvider + "/traces", err
+	})}
+	if *traceFile != "" {
+		exporters = append(exporters, trace.FileExporter(*traceFile))
+	}
+	trace.SetExporter(exporters...)
+}
@@ -4,32 +4,149 @@ import (
 	"Distribute/log"
 	"Distribute/registry"
 	"Distribute/service"
+	"Distribute/trace"
 	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"flag"
 	"fmt"
 	stlog "log"
+	"os"
+	"strings"
 )
 
+var (
+	traceFile = flag.String("trace-file", "", "also append finished spans to this file as JSON lines")
+	port      = flag.String("port", "4000", "port to listen on; run several log services on different ports to partition logs between them")
+	adminAddr = flag.String("admin", "", "address of the diagnostics listener, e.g. localhost:4001; disabled when empty")
+
+	logDir         = flag.String("log-dir", log.DefaultConfig.Dir, "directory holding log segments and their manifest")
+	segmentBytes   = flag.Int64("segment-bytes", log.DefaultConfig.MaxSegmentBytes, "rotate the active segment once it would exceed this many bytes")
+	segmentAge     = flag.Duration("segment-age", log.DefaultConfig.MaxSegmentAge, "rotate the active segment after this long; 0 disables time-based rotation")
+	retentionAge   = flag.Duration("retention-age", log.DefaultConfig.RetentionAge, "delete sealed segments older than this; 0 keeps them forever")
+	retentionBytes = flag.Int64("retention-bytes", log.DefaultConfig.RetentionBytes, "delete the oldest segments while the total exceeds this many bytes; 0 disables")
+	compress       = flag.Bool("compress", log.DefaultConfig.Compress, "gzip sealed segments")
+	alertRules     = flag.String("alert-rules", "", "JSON file with alert rules; reloaded when it changes, alerting is disabled when empty")
+	alertWebhook   = flag.String("alert-webhook", "", "URL that receives alert notifications as JSON POSTs")
+	alertFile      = flag.String("alert-file", "", "file that alert notifications are appended to as JSON lines")
+	legacyLog      = flag.String("legacy-log", log.DefaultConfig.Legacy, "single-file log from older releases, imported when the log directory is empty")
+	audit          = flag.Bool("audit", false, "hash-chain stored records and write signed checkpoints; enable it on an empty -log-dir, retention is disabled in this mode")
+	auditKey       = flag.String("audit-key", "./audit.key", "ed25519 key signing audit checkpoints, created with a matching .pub file when missing")
+	verify         = flag.Bool("verify", false, "verify the audit log in -log-dir against the public key -audit-key.pub, print a report and exit")
+)
+
+// 可以重复指定的 -sink 参数
+type sinkList []string
+
+func (l *sinkList) String() string { return strings.Join(*l, " ") }
+
+func (l *sinkList) Set(spec string) error {
+	*l = append(*l, spec)
+	return nil
+}
+
+var sinks sinkList
+
+func init() {
+	flag.Var(&sinks, "sink", "additional output for stored records, repeatable: stdout, file:PATH, syslog:udp://HOST:PORT, syslog:tcp://HOST:PORT or forward:http://HOST:PORT, optionally followed by ?level=warn&service=A,B")
+}
+
 func main() {
-	log.Run("./distribute.log")
-	host, port := "localhost", "4000"
-	serviceAddress := fmt.Sprintf("http://%s:%s", host, port)
+	flag.Parse()
+	if *verify {
+		os.Exit(verifyAudit())
+	}
+	host := "localhost"
+	serviceAddress := fmt.Sprintf("http://%s:%s", host, *port)
+	var key ed25519.PrivateKey
+	if *audit {
+		var err error
+		if key, err = log.LoadAuditKey(*auditKey, true); err != nil {
+			stlog.Fatalln(err)
+		}
+	}
+	err := log.Run(log.Config{
+		Dir:             *logDir,
+		MaxSegmentBytes: *segmentBytes,
+		MaxSegmentAge:   *segmentAge,
+		RetentionAge:    *retentionAge,
+		RetentionBytes:  *retentionBytes,
+		Compress:        *compress,
+		Legacy:          *legacyLog,
+		URL:             serviceAddress,
+		AuditKey:        key,
+	})
+	if err != nil {
+		stlog.Fatalln(err)
+	}
+	for _, spec := range sinks {
+		sink, filter, err := log.ParseSink(spec)
+		if err != nil {
+			stlog.Fatalln(err)
+		}
+		log.AddSink(spec, sink, filter)
+	}
+	if *alertRules != "" {
+		err := log.StartAlerts(log.AlertConfig{
+			RulesFile: *alertRules,
+			Webhook:   *alertWebhook,
+			File:      *alertFile,
+		})
+		if err != nil {
+			stlog.Fatalln(err)
+		}
+	}
+	// 日志服务同时作为调用链收集器，其他服务将 span 发送到 /traces
+	exporters := []trace.Exporter{trace.DefaultCollector}
+	if *traceFile != "" {
+		exporters = append(exporters, trace.FileExporter(*traceFile))
+	}
+	trace.SetExporter(exporters...)
 	r := registry.Registration{
-		ServiceName:      registry.LogService,
-		ServiceURL:       serviceAddress,
-		RequiredServices: make([]registry.ServiceName, 0),
+		ServiceName: registry.LogService,
+		ServiceURL:  serviceAddress,
+		// 其他日志服务实例，用于合并查询
+		RequiredServices: []registry.ServiceName{registry.LogService},
 		ServiceUpdateURL: serviceAddress + "/services",
 		HeartbeatURL:     serviceAddress + "/heartbeat",
+		ReadinessURL:     serviceAddress + "/readyz",
 	}
+	service.AddReadinessCheck("storage", log.CheckStorage)
+	service.EnableAdmin(*adminAddr)
 	ctx, err := service.Start(
 		context.Background(),
 		host,
-		port,
+		*port,
 		r,
-		log.RegisterHandlers)
+		func() {
+			log.RegisterHandlers()
+			trace.RegisterHandlers()
+		})
 	if err != nil {
 		// 本身的日志服务启动出错，使用标准库写入日志
 		stlog.Fatalln(err)
 	}
 	<-ctx.Done()
+	log.CloseSinks()
 	fmt.Println("Shutting down log service")
 }
+
+// 离线校验审计日志，校验失败时返回非 0 的退出码
+func verifyAudit() int {
+	pub, err := log.LoadAuditPublicKey(*auditKey + ".pub")
+	if err != nil {
+		stlog.Println(err)
+		return 2
+	}
+	report, err := log.Verify(*logDir, pub)
+	if err != nil {
+		stlog.Println(err)
+		return 2
+	}
+	data, _ := json.MarshalIndent(report, "", "  ")
+	fmt.Println(string(data))
+	if !report.OK {
+		return 1
+	}
+	return 0
+}
@@ -5,13 +5,22 @@ import (
 	"Distribute/portal"
 	"Distribute/registry"
 	"Distribute/service"
+	"Distribute/trace"
 	"context"
+	"flag"
 	"fmt"
 	stlog "log"
 )
 
+var (
+	traceFile    = flag.String("trace-file", "", "also append finished spans to this file as JSON lines")
+	templatesDir = flag.String("templates", "E:\\Go_Code\\Distribute\\portal", "directory containing the portal templates")
+	adminAddr    = flag.String("admin", "", "address of the diagnostics listener, e.g. localhost:10001; disabled when empty")
+)
+
 func main() {
-	err := portal.ImportTemplates()
+	flag.Parse()
+	err := portal.ImportTemplates(*templatesDir)
 	if err != nil {
 		stlog.Fatalln(err)
 	}
@@ -26,7 +35,12 @@ func main() {
 		},
 		ServiceUpdateURL: serviceAddress + "/services",
 		HeartbeatURL:     serviceAddress + "/heartbeat",
+		ReadinessURL:     serviceAddress + "/readyz",
 	}
+	// 没有可用的成绩服务或模板未加载时，门户不参与路由
+	service.AddReadinessCheck("grading-service", service.ProviderCheck(registry.GradingService))
+	service.AddReadinessCheck("templates", portal.CheckTemplates)
+	service.EnableAdmin(*adminAddr)
 	ctx, err := service.Start(
 		context.Background(),
 		host,
@@ -38,8 +52,25 @@ func main() {
 	}
 	if logProvider, err := registry.GetProvider(registry.LogService); err == nil {
 		fmt.Printf("Log Service found at : %s\n", logProvider)
-		log.SetClientLogger(logProvider, r.ServiceName)
 	}
+	// 没有可用的日志服务时先在本地输出，日志服务注册后自动切换
+	log.SetClientLogger(r)
+	setTraceExporter()
 	<-ctx.Done()
+	// 退出前发送缓存中的日志
+	log.Close()
 	fmt.Println("Shutting down Portal service")
 }
+
+// span 发送到日志服务的收集器，可以在日志服务的 /traces 页面查看
+// 每次导出时查找日志服务，日志服务晚于本服务注册时同样可以收到 span
+func setTraceExporter() {
+	exporters := []trace.Exporter{trace.LookupExporter(func() (string, error) {
+		logProvider, err := registry.GetProvider(registry.LogService)
+		return logProvider + "/traces", err
+	})}
+	if *traceFile != "" {
+		exporters = append(exporters, trace.FileExporter(*traceFile))
+	}
+	trace.SetExporter(exporters...)
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"Distribute/metrics"
 	"Distribute/registry"
 	"context"
 	"fmt"
@@ -12,10 +13,12 @@ func main() {
 	// 心跳检测
 	registry.SetHeartbeatService()
 	http.Handle("/services", registry.RegistryService{})
+	http.Handle("/metrics", metrics.Handler())
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 	var srv http.Server
 	srv.Addr = registry.ServerPort
+	srv.Handler = metrics.InstrumentHandler(http.DefaultServeMux)
 
 	go func() {
 		log.Println(srv.ListenAndServe())
@@ -0,0 +1,467 @@
+package grades
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Term 学期
+type Term struct {
+	ID    int
+	Name  string
+	Start time.Time
+	End   time.Time
+}
+
+// Course 课程
+type Course struct {
+	ID    int
+	Code  string
+	Title string
+	// 计分规则，为空时使用默认规则
+	Policy *Policy `json:",omitempty"`
+}
+
+// Section 某个学期开设的课程的一个教学班
+type Section struct {
+	ID       int
+	CourseID int
+	TermID   int
+	Name     string
+}
+
+// Enrollment 学生选修教学班的记录，成绩通过 Grade.EnrollmentID 关联到选课记录
+type Enrollment struct {
+	ID        int
+	StudentID int
+	SectionID int
+	// 选课时间，由存储设置
+	Enrolled time.Time
+}
+
+// Catalog 课程目录：学期、课程、教学班与选课记录
+type Catalog struct {
+	Terms       []Term
+	Courses     []Course
+	Sections    []Section
+	Enrollments []Enrollment
+}
+
+var (
+	// ErrConflict 操作与已有的数据冲突，例如删除仍有教学班的课程
+	ErrConflict = errors.New("conflict")
+	// ErrInvalidReference 引用的学生、课程、学期、教学班或选课记录不存在
+	ErrInvalidReference = errors.New("invalid reference")
+)
+
+func (t Term) Validate() []FieldError {
+	var errs []FieldError
+	if e := checkName("Name", t.Name); e != nil {
+		errs = append(errs, *e)
+	}
+	if !t.Start.IsZero() && !t.End.IsZero() && t.End.Before(t.Start) {
+		errs = append(errs, FieldError{Field: "End", Message: "must not be before Start"})
+	}
+	return errs
+}
+
+// 课程代码的最大长度
+const maxCodeLen = 20
+
+func (c Course) Validate() []FieldError {
+	var errs []FieldError
+	switch {
+	case strings.TrimSpace(c.Code) == "":
+		errs = append(errs, FieldError{Field: "Code", Message: "must not be empty"})
+	case utf8.RuneCountInString(c.Code) > maxCodeLen:
+		errs = append(errs, FieldError{Field: "Code", Message: fmt.Sprintf("must be at most %d characters", maxCodeLen)})
+	}
+	if e := checkName("Title", c.Title); e != nil {
+		errs = append(errs, *e)
+	}
+	if c.Policy != nil {
+		errs = append(errs, c.Policy.Validate("Policy.")...)
+	}
+	return errs
+}
+
+func (s Section) Validate() []FieldError {
+	var errs []FieldError
+	if s.CourseID <= 0 {
+		errs = append(errs, FieldError{Field: "CourseID", Message: "is required"})
+	}
+	if s.TermID <= 0 {
+		errs = append(errs, FieldError{Field: "TermID", Message: "is required"})
+	}
+	if e := checkName("Name", s.Name); e != nil {
+		errs = append(errs, *e)
+	}
+	return errs
+}
+
+func (e Enrollment) Validate() []FieldError {
+	var errs []FieldError
+	if e.StudentID <= 0 {
+		errs = append(errs, FieldError{Field: "StudentID", Message: "is required"})
+	}
+	if e.SectionID <= 0 {
+		errs = append(errs, FieldError{Field: "SectionID", Message: "is required"})
+	}
+	return errs
+}
+
+// 名称不能为空且不能超过 maxNameLen 个字符
+func checkName(field, value string) *FieldError {
+	switch {
+	case strings.TrimSpace(value) == "":
+		return &FieldError{Field: field, Message: "must not be empty"}
+	case utf8.RuneCountInString(value) > maxNameLen:
+		return &FieldError{Field: field, Message: fmt.Sprintf("must be at most %d characters", maxNameLen)}
+	}
+	return nil
+}
+
+func (c *Catalog) TermById(id int) (*Term, error) {
+	for i := range c.Terms {
+		if c.Terms[i].ID == id {
+			return &c.Terms[i], nil
+		}
+	}
+	return nil, fmt.Errorf("Term with Id %d %w", id, ErrNotFound)
+}
+
+func (c *Catalog) CourseById(id int) (*Course, error) {
+	for i := range c.Courses {
+		if c.Courses[i].ID == id {
+			return &c.Courses[i], nil
+		}
+	}
+	return nil, fmt.Errorf("Course with Id %d %w", id, ErrNotFound)
+}
+
+func (c *Catalog) SectionById(id int) (*Section, error) {
+	for i := range c.Sections {
+		if c.Sections[i].ID == id {
+			return &c.Sections[i], nil
+		}
+	}
+	return nil, fmt.Errorf("Section with Id %d %w", id, ErrNotFound)
+}
+
+func (c *Catalog) EnrollmentById(id int) (*Enrollment, error) {
+	for i := range c.Enrollments {
+		if c.Enrollments[i].ID == id {
+			return &c.Enrollments[i], nil
+		}
+	}
+	return nil, fmt.Errorf("Enrollment with Id %d %w", id, ErrNotFound)
+}
+
+func (c Catalog) clone() Catalog {
+	return Catalog{
+		Terms:       append([]Term(nil), c.Terms...),
+		Courses:     append([]Course(nil), c.Courses...),
+		Sections:    append([]Section(nil), c.Sections...),
+		Enrollments: append([]Enrollment(nil), c.Enrollments...),
+	}
+}
+
+// CourseAverage 学生在一个教学班中的成绩
+type CourseAverage struct {
+	EnrollmentID int
+	Course       Course
+	Section      Section
+	Term         Term
+	// 成绩数，为 0 时 Average 也为 0
+	Grades  int
+	Average float32
+}
+
+// CourseAverages 按选课记录分组计算学生在每门课程中的平均分，没有关联选课记录的成绩不计入
+func (c *Catalog) CourseAverages(stu Student) []CourseAverage {
+	result := make([]CourseAverage, 0)
+	for _, e := range c.Enrollments {
+		if e.StudentID != stu.ID {
+			continue
+		}
+		avg := CourseAverage{EnrollmentID: e.ID}
+		if section, err := c.SectionById(e.SectionID); err == nil {
+			avg.Section = *section
+			if course, err := c.CourseById(section.CourseID); err == nil {
+				avg.Course = *course
+			}
+			if term, err := c.TermById(section.TermID); err == nil {
+				avg.Term = *term
+			}
+		}
+		var total float32
+		for _, g := range stu.Grades {
+			if g.EnrollmentID == e.ID {
+				total += g.Score
+				avg.Grades++
+			}
+		}
+		if avg.Grades > 0 {
+			avg.Average = total / float32(avg.Grades)
+		}
+		result = append(result, avg)
+	}
+	return result
+}
+
+// 课程目录对象的 ID 计数器，删除的 ID 不会被重新分配
+type catalogIDs struct {
+	Term       int `json:",omitempty"`
+	Course     int `json:",omitempty"`
+	Section    int `json:",omitempty"`
+	Enrollment int `json:",omitempty"`
+}
+
+// 分配新的 ID：不小于计数器，也不小于已有的最大 ID 加 1，并更新计数器
+func allocate(counter *int, max int) int {
+	if max >= *counter {
+		*counter = max + 1
+	}
+	if *counter < 1 {
+		*counter = 1
+	}
+	id := *counter
+	*counter++
+	return id
+}
+
+// 检查课程目录的操作，并分配 ID，不修改状态
+func (st *state) prepareCatalog(op Op, now time.Time) error {
+	c := &st.catalog
+	// 计数器只在 mutate 中更新
+	ids := st.catalogIDs
+	switch op.Kind {
+	case OpPutTerm:
+		if op.Term == nil {
+			return fmt.Errorf("Operation %s requires a term", op.Kind)
+		}
+		if op.MustExist {
+			if _, err := c.TermById(op.Term.ID); err != nil {
+				return err
+			}
+		}
+		if op.Term.ID == 0 {
+			max := 0
+			for _, t := range c.Terms {
+				if t.ID > max {
+					max = t.ID
+				}
+			}
+			op.Term.ID = allocate(&ids.Term, max)
+		}
+	case OpDeleteTerm:
+		if _, err := c.TermById(op.ID); err != nil {
+			return err
+		}
+		for _, s := range c.Sections {
+			if s.TermID == op.ID {
+				return fmt.Errorf("%w: term %d still has section %d", ErrConflict, op.ID, s.ID)
+			}
+		}
+	case OpPutCourse:
+		if op.Course == nil {
+			return fmt.Errorf("Operation %s requires a course", op.Kind)
+		}
+		if op.MustExist {
+			if _, err := c.CourseById(op.Course.ID); err != nil {
+				return err
+			}
+		}
+		for _, other := range c.Courses {
+			if other.ID != op.Course.ID && strings.EqualFold(other.Code, op.Course.Code) {
+				return fmt.Errorf("%w: course code %s is used by course %d", ErrConflict, other.Code, other.ID)
+			}
+		}
+		if op.Course.ID == 0 {
+			max := 0
+			for _, course := range c.Courses {
+				if course.ID > max {
+					max = course.ID
+				}
+			}
+			op.Course.ID = allocate(&ids.Course, max)
+		}
+	case OpDeleteCourse:
+		if _, err := c.CourseById(op.ID); err != nil {
+			return err
+		}
+		for _, s := range c.Sections {
+			if s.CourseID == op.ID {
+				return fmt.Errorf("%w: course %d still has section %d", ErrConflict, op.ID, s.ID)
+			}
+		}
+	case OpPutSection:
+		if op.Section == nil {
+			return fmt.Errorf("Operation %s requires a section", op.Kind)
+		}
+		if op.MustExist {
+			if _, err := c.SectionById(op.Section.ID); err != nil {
+				return err
+			}
+		}
+		if _, err := c.CourseById(op.Section.CourseID); err != nil {
+			return fmt.Errorf("%w: course %d does not exist", ErrInvalidReference, op.Section.CourseID)
+		}
+		if _, err := c.TermById(op.Section.TermID); err != nil {
+			return fmt.Errorf("%w: term %d does not exist", ErrInvalidReference, op.Section.TermID)
+		}
+		if op.Section.ID == 0 {
+			max := 0
+			for _, s := range c.Sections {
+				if s.ID > max {
+					max = s.ID
+				}
+			}
+			op.Section.ID = allocate(&ids.Section, max)
+		}
+	case OpDeleteSection:
+		if _, err := c.SectionById(op.ID); err != nil {
+			return err
+		}
+		for _, e := range c.Enrollments {
+			if e.SectionID == op.ID {
+				return fmt.Errorf("%w: section %d still has enrollment %d", ErrConflict, op.ID, e.ID)
+			}
+		}
+	case OpEnroll:
+		e := op.Enrollment
+		if e == nil {
+			return fmt.Errorf("Operation %s requires an enrollment", op.Kind)
+		}
+		if _, err := st.students.GetById(e.StudentID); err != nil {
+			return fmt.Errorf("%w: student %d does not exist", ErrInvalidReference, e.StudentID)
+		}
+		if _, err := c.SectionById(e.SectionID); err != nil {
+			return fmt.Errorf("%w: section %d does not exist", ErrInvalidReference, e.SectionID)
+		}
+		for _, other := range c.Enrollments {
+			if other.StudentID == e.StudentID && other.SectionID == e.SectionID && other.ID != e.ID {
+				return fmt.Errorf("%w: student %d is already enrolled in section %d", ErrConflict, e.StudentID, e.SectionID)
+			}
+		}
+		if e.ID == 0 {
+			max := 0
+			for _, other := range c.Enrollments {
+				if other.ID > max {
+					max = other.ID
+				}
+			}
+			e.ID = allocate(&ids.Enrollment, max)
+		}
+		if e.Enrolled.IsZero() {
+			e.Enrolled = now
+		}
+	case OpUnenroll:
+		e, err := c.EnrollmentById(op.ID)
+		if err != nil {
+			return err
+		}
+		if stu, err := st.students.GetById(e.StudentID); err == nil {
+			for _, g := range stu.Grades {
+				if g.EnrollmentID == e.ID {
+					return fmt.Errorf("%w: enrollment %d still has grade %d", ErrConflict, e.ID, g.ID)
+				}
+			}
+		}
+	default:
+		return fmt.Errorf("Unknown operation %q", op.Kind)
+	}
+	return nil
+}
+
+// 执行已经通过 prepareCatalog 的操作
+func (st *state) mutateCatalog(op Op) {
+	c := &st.catalog
+	switch op.Kind {
+	case OpPutTerm:
+		bump(&st.catalogIDs.Term, op.Term.ID)
+		if t, err := c.TermById(op.Term.ID); err == nil {
+			*t = *op.Term
+			return
+		}
+		c.Terms = append(c.Terms, *op.Term)
+	case OpDeleteTerm:
+		for i := range c.Terms {
+			if c.Terms[i].ID == op.ID {
+				c.Terms = append(c.Terms[:i:i], c.Terms[i+1:]...)
+				break
+			}
+		}
+	case OpPutCourse:
+		bump(&st.catalogIDs.Course, op.Course.ID)
+		if course, err := c.CourseById(op.Course.ID); err == nil {
+			*course = *op.Course
+			return
+		}
+		c.Courses = append(c.Courses, *op.Course)
+	case OpDeleteCourse:
+		for i := range c.Courses {
+			if c.Courses[i].ID == op.ID {
+				c.Courses = append(c.Courses[:i:i], c.Courses[i+1:]...)
+				break
+			}
+		}
+	case OpPutSection:
+		bump(&st.catalogIDs.Section, op.Section.ID)
+		if s, err := c.SectionById(op.Section.ID); err == nil {
+			*s = *op.Section
+			return
+		}
+		c.Sections = append(c.Sections, *op.Section)
+	case OpDeleteSection:
+		for i := range c.Sections {
+			if c.Sections[i].ID == op.ID {
+				c.Sections = append(c.Sections[:i:i], c.Sections[i+1:]...)
+				break
+			}
+		}
+	case OpEnroll:
+		bump(&st.catalogIDs.Enrollment, op.Enrollment.ID)
+		c.Enrollments = append(c.Enrollments, *op.Enrollment)
+	case OpUnenroll:
+		for i := range c.Enrollments {
+			if c.Enrollments[i].ID == op.ID {
+				c.Enrollments = append(c.Enrollments[:i:i], c.Enrollments[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+func bump(counter *int, id int) {
+	if id >= *counter {
+		*counter = id + 1
+	}
+}
+
+// 删除学生时一并删除其选课记录
+func (st *state) dropEnrollments(studentID int) {
+	c := &st.catalog
+	kept := c.Enrollments[:0]
+	for _, e := range c.Enrollments {
+		if e.StudentID != studentID {
+			kept = append(kept, e)
+		}
+	}
+	c.Enrollments = kept
+}
+
+// 成绩关联的选课记录必须属于该学生
+func (st *state) checkEnrollment(studentID int, g *Grade) error {
+	if g.EnrollmentID == 0 {
+		return nil
+	}
+	e, err := st.catalog.EnrollmentById(g.EnrollmentID)
+	if err != nil || e.StudentID != studentID {
+		return fmt.Errorf("%w: enrollment %d does not belong to student %d", ErrInvalidReference, g.EnrollmentID, studentID)
+	}
+	return nil
+}
@@ -0,0 +1,276 @@
+package grades
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// 课程目录中的对象
+type entity interface {
+	Validate() []FieldError
+	entityID() int
+	setEntityID(id int)
+}
+
+func (t *Term) entityID() int            { return t.ID }
+func (t *Term) setEntityID(id int)       { t.ID = id }
+func (c *Course) entityID() int          { return c.ID }
+func (c *Course) setEntityID(id int)     { c.ID = id }
+func (s *Section) entityID() int         { return s.ID }
+func (s *Section) setEntityID(id int)    { s.ID = id }
+func (e *Enrollment) entityID() int      { return e.ID }
+func (e *Enrollment) setEntityID(id int) { e.ID = id }
+
+// 课程目录的一类资源，对应 /{path} 与 /{path}/{id}
+type catalogResource struct {
+	path string
+	// 空对象，请求体解码到其中
+	blank func() entity
+	// 按查询参数过滤的列表
+	list func(c *Catalog, q url.Values) (interface{}, error)
+	find func(c *Catalog, id int) (entity, error)
+	// 新增、替换与删除使用的操作，put 为空时不支持 PUT
+	create, put, del OpKind
+	// 只读的子资源 /{path}/{id}/{name}
+	children map[string]func(w http.ResponseWriter, r *http.Request, id int)
+}
+
+// GET    /terms                                 所有学期
+// GET    /courses                               所有课程
+// GET    /sections?course={id}&term={id}        教学班，参数可选
+// GET    /enrollments?student={id}&section={id} 选课记录，参数可选
+// POST   /{resource}                            新增，ID 由服务分配
+// GET    /{resource}/{id}                       单个对象
+// PUT    /{resource}/{id}                       替换，选课记录不支持
+// DELETE /{resource}/{id}                       删除，仍被引用时返回 409
+// GET    /courses/{id}/gradebook                课程的成绩册
+var catalogResources = []*catalogResource{
+	{
+		path:  "terms",
+		blank: func() entity { return new(Term) },
+		list: func(c *Catalog, q url.Values) (interface{}, error) {
+			return append(make([]Term, 0), c.Terms...), nil
+		},
+		find:   func(c *Catalog, id int) (entity, error) { return c.TermById(id) },
+		create: OpPutTerm,
+		put:    OpPutTerm,
+		del:    OpDeleteTerm,
+	},
+	{
+		path:  "courses",
+		blank: func() entity { return new(Course) },
+		list: func(c *Catalog, q url.Values) (interface{}, error) {
+			return append(make([]Course, 0), c.Courses...), nil
+		},
+		find:   func(c *Catalog, id int) (entity, error) { return c.CourseById(id) },
+		create: OpPutCourse,
+		put:    OpPutCourse,
+		del:    OpDeleteCourse,
+		children: map[string]func(w http.ResponseWriter, r *http.Request, id int){
+			"gradebook": getGradebook,
+		},
+	},
+	{
+		path:  "sections",
+		blank: func() entity { return new(Section) },
+		list: func(c *Catalog, q url.Values) (interface{}, error) {
+			course, err := intParam(q, "course")
+			if err != nil {
+				return nil, err
+			}
+			term, err := intParam(q, "term")
+			if err != nil {
+				return nil, err
+			}
+			result := make([]Section, 0)
+			for _, s := range c.Sections {
+				if (course == 0 || s.CourseID == course) && (term == 0 || s.TermID == term) {
+					result = append(result, s)
+				}
+			}
+			return result, nil
+		},
+		find:   func(c *Catalog, id int) (entity, error) { return c.SectionById(id) },
+		create: OpPutSection,
+		put:    OpPutSection,
+		del:    OpDeleteSection,
+	},
+	{
+		path:  "enrollments",
+		blank: func() entity { return new(Enrollment) },
+		list: func(c *Catalog, q url.Values) (interface{}, error) {
+			student, err := intParam(q, "student")
+			if err != nil {
+				return nil, err
+			}
+			section, err := intParam(q, "section")
+			if err != nil {
+				return nil, err
+			}
+			result := make([]Enrollment, 0)
+			for _, e := range c.Enrollments {
+				if (student == 0 || e.StudentID == student) && (section == 0 || e.SectionID == section) {
+					result = append(result, e)
+				}
+			}
+			return result, nil
+		},
+		find:   func(c *Catalog, id int) (entity, error) { return c.EnrollmentById(id) },
+		create: OpEnroll,
+		del:    OpUnenroll,
+	},
+}
+
+// 查询参数中的 ID，不存在时返回 0
+func intParam(q url.Values, name string) (int, error) {
+	s := q.Get(name)
+	if s == "" {
+		return 0, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil || v <= 0 {
+		return 0, fmt.Errorf("Invalid %s %q", name, s)
+	}
+	return v, nil
+}
+
+// 构造写入对象的操作
+func entityOp(kind OpKind, e entity) Op {
+	op := Op{Kind: kind}
+	switch v := e.(type) {
+	case *Term:
+		op.Term = v
+	case *Course:
+		op.Course = v
+	case *Section:
+		op.Section = v
+	case *Enrollment:
+		op.Enrollment = v
+	}
+	return op
+}
+
+type catalogHandler struct {
+	res *catalogResource
+}
+
+func (h catalogHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	splitPath := strings.Split(r.URL.Path, "/")
+	switch len(splitPath) {
+	case 2:
+		route(w, r, map[string]func(){
+			http.MethodGet:  func() { h.list(w, r) },
+			http.MethodPost: func() { h.create(w, r) },
+		})
+	case 3:
+		id, err := strconv.Atoi(splitPath[2])
+		if err != nil {
+			writeProblem(w, r, http.StatusNotFound, fmt.Sprintf("Invalid Id %q", splitPath[2]))
+			return
+		}
+		handlers := map[string]func(){
+			http.MethodGet:    func() { h.getOne(w, r, id) },
+			http.MethodDelete: func() { h.remove(w, r, id) },
+		}
+		if h.res.put != "" {
+			handlers[http.MethodPut] = func() { h.update(w, r, id) }
+		}
+		route(w, r, handlers)
+	case 4:
+		id, err := strconv.Atoi(splitPath[2])
+		child, ok := h.res.children[splitPath[3]]
+		if err != nil || !ok {
+			writeProblem(w, r, http.StatusNotFound, "")
+			return
+		}
+		route(w, r, map[string]func(){
+			http.MethodGet: func() { child(w, r, id) },
+		})
+	default:
+		writeProblem(w, r, http.StatusNotFound, "")
+	}
+}
+
+func (h catalogHandler) list(w http.ResponseWriter, r *http.Request) {
+	catalog, err := db.Catalog()
+	if err != nil {
+		storeError(w, r, err)
+		return
+	}
+	result, err := h.res.list(&catalog, r.URL.Query())
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJson(w, r, http.StatusOK, result)
+}
+
+func (h catalogHandler) getOne(w http.ResponseWriter, r *http.Request, id int) {
+	catalog, err := db.Catalog()
+	if err != nil {
+		storeError(w, r, err)
+		return
+	}
+	e, err := h.res.find(&catalog, id)
+	if err != nil {
+		storeError(w, r, err)
+		return
+	}
+	writeJson(w, r, http.StatusOK, e)
+}
+
+func (h catalogHandler) create(w http.ResponseWriter, r *http.Request) {
+	e := h.res.blank()
+	if !decodeBody(w, r, e) {
+		return
+	}
+	errs := e.Validate()
+	if e.entityID() != 0 {
+		errs = append(errs, FieldError{Field: "ID", Message: "is assigned by the server"})
+	}
+	if len(errs) > 0 {
+		writeProblem(w, r, http.StatusUnprocessableEntity, "The request body is invalid", errs...)
+		return
+	}
+	if err := apply(r, entityOp(h.res.create, e)); err != nil {
+		storeError(w, r, err)
+		return
+	}
+	w.Header().Set("Location", fmt.Sprintf("/%s/%d", h.res.path, e.entityID()))
+	writeJson(w, r, http.StatusCreated, e)
+}
+
+func (h catalogHandler) update(w http.ResponseWriter, r *http.Request, id int) {
+	e := h.res.blank()
+	if !decodeBody(w, r, e) {
+		return
+	}
+	errs := e.Validate()
+	if e.entityID() != 0 && e.entityID() != id {
+		errs = append(errs, FieldError{Field: "ID", Message: "does not match the URL"})
+	}
+	if len(errs) > 0 {
+		writeProblem(w, r, http.StatusUnprocessableEntity, "The request body is invalid", errs...)
+		return
+	}
+	// Put 操作在对象不存在时会新增，PUT 只能修改已有的对象，由存储在加锁后检查
+	e.setEntityID(id)
+	op := entityOp(h.res.put, e)
+	op.MustExist = true
+	if err := apply(r, op); err != nil {
+		storeError(w, r, err)
+		return
+	}
+	writeJson(w, r, http.StatusOK, e)
+}
+
+func (h catalogHandler) remove(w http.ResponseWriter, r *http.Request, id int) {
+	if err := apply(r, Op{Kind: h.res.del, ID: id}); err != nil {
+		storeError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
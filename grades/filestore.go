@@ -0,0 +1,393 @@
+package grades
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	stlog "log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// 文件存储：每个修改操作先追加到 wal.ndjson 并同步到磁盘，再修改内存中的状态
+// WAL 中的操作数达到 compactEvery 后，将事件以外的完整状态写入 snapshot.json 并清空 WAL
+// 启动时读取快照，再重放 WAL 中序号大于快照的操作，只丢弃最后一条写了一半的操作，其余无法重放的操作使打开失败
+// 事件由操作生成，追加到 history.ndjson，快照只记录其中已经同步的事件数
+// 启动时丢弃 history.ndjson 中快照之后的事件，由重放 WAL 重新生成
+
+const (
+	snapshotFile = "snapshot.json"
+	walFile      = "wal.ndjson"
+	historyFile  = "history.ndjson"
+	compactEvery = 1000
+)
+
+type snapshot struct {
+	// 快照包含的最后一个操作的序号
+	Seq         int64
+	NextID      int `json:",omitempty"`
+	NextGradeID int `json:",omitempty"`
+	// 课程目录对象的 ID 计数器
+	NextCatalogIDs catalogIDs
+	Students       Students
+	Catalog        Catalog
+	// 写入快照时 history.ndjson 中已经同步的事件数
+	HistorySeq int64 `json:",omitempty"`
+	// 旧版本的快照包含所有事件，打开时移到 history.ndjson
+	History []Event `json:",omitempty"`
+}
+
+type walEntry struct {
+	Seq int64
+	Op  Op
+}
+
+type fileStore struct {
+	dir   string
+	state state
+	// 最后一个操作的序号
+	seq int64
+	wal *os.File
+	// WAL 中的操作数与字节数
+	walOps  int
+	walSize int64
+	history *os.File
+	// history.ndjson 中的事件数与字节数，之后的事件尚未写入
+	historySaved int
+	historySize  int64
+	// 最近一次写入的错误，写入成功后清除
+	err   error
+	mutex *sync.RWMutex
+}
+
+/**
+ * OpenFileStore
+ * @Description: 打开目录中的文件存储，目录不存在时创建
+ * @param dir
+ * @return Store
+ * @return error
+ */
+func OpenFileStore(dir string) (Store, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	s := &fileStore{dir: dir, mutex: new(sync.RWMutex)}
+	var snap snapshot
+	data, err := os.ReadFile(filepath.Join(dir, snapshotFile))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &snap); err != nil {
+			return nil, fmt.Errorf("Corrupted grades snapshot: %s", err)
+		}
+		s.state.students, s.state.nextID, s.seq = snap.Students, snap.NextID, snap.Seq
+		s.state.nextGradeID = snap.NextGradeID
+		s.state.catalog, s.state.catalogIDs = snap.Catalog, snap.NextCatalogIDs
+		s.state.normalize()
+	}
+	// 旧版本的快照中的事件整体写入 history.ndjson，之后立即写入不含事件的快照
+	migrate := len(snap.History) > 0
+	if migrate {
+		s.state.history = snap.History
+		if err := os.Truncate(filepath.Join(dir, historyFile), 0); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	} else if err := s.loadHistory(snap.HistorySeq); err != nil {
+		return nil, err
+	}
+	if err := s.replay(); err != nil {
+		return nil, err
+	}
+	s.history, err = os.OpenFile(filepath.Join(dir, historyFile), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.saveHistory(); err != nil {
+		return nil, err
+	}
+	s.wal, err = os.OpenFile(filepath.Join(dir, walFile), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if migrate || s.walOps >= compactEvery {
+		if err := s.compact(); err != nil {
+			stlog.Println("Failed to compact grades store: ", err)
+		}
+	}
+	return s, nil
+}
+
+// 目录中还没有快照与 WAL，即文件存储从未写入过
+func newDataDir(dir string) (bool, error) {
+	for _, name := range []string{snapshotFile, walFile} {
+		_, err := os.Stat(filepath.Join(dir, name))
+		if err == nil {
+			return false, nil
+		}
+		if !os.IsNotExist(err) {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// 读取 history.ndjson 中的前 count 个事件，之后的事件由重放 WAL 重新生成，从文件中截掉
+func (s *fileStore) loadHistory(count int64) error {
+	path := filepath.Join(s.dir, historyFile)
+	f, err := os.Open(path)
+	if os.IsNotExist(err) && count == 0 {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+	r := bufio.NewReader(f)
+	for int64(len(s.state.history)) < count {
+		data, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			return fmt.Errorf("Grades history ends after %d of %d events", len(s.state.history), count)
+		}
+		if err != nil {
+			return err
+		}
+		var e Event
+		if err := json.Unmarshal(data, &e); err != nil {
+			return fmt.Errorf("Corrupted grades history entry on line %d: %s", len(s.state.history)+1, err)
+		}
+		if e.Seq != int64(len(s.state.history))+1 {
+			return fmt.Errorf("Grades history entry on line %d has sequence number %d", len(s.state.history)+1, e.Seq)
+		}
+		s.state.history = append(s.state.history, e)
+		s.historySize += int64(len(data))
+	}
+	s.historySaved = len(s.state.history)
+	return os.Truncate(path, s.historySize)
+}
+
+// 追加尚未写入 history.ndjson 的事件，不同步到磁盘，事件在快照之前仍可由 WAL 重新生成
+func (s *fileStore) saveHistory() error {
+	var data []byte
+	for _, e := range s.state.history[s.historySaved:] {
+		line, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		data = append(append(data, line...), '\n')
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	if _, err := s.history.Write(data); err != nil {
+		// 去掉可能写入了一部分的内容，下次写入时重试
+		_ = s.history.Truncate(s.historySize)
+		return err
+	}
+	s.historySaved = len(s.state.history)
+	s.historySize += int64(len(data))
+	return nil
+}
+
+// 重放 WAL，上次写入中断留下的不完整行被截掉
+func (s *fileStore) replay() error {
+	path := filepath.Join(s.dir, walFile)
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+	r := bufio.NewReader(f)
+	for line := 1; ; line++ {
+		data, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			if len(data) > 0 {
+				stlog.Printf("Discarding incomplete grades WAL entry on line %d\n", line)
+				return os.Truncate(path, s.walSize)
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var e walEntry
+		if err := json.Unmarshal(data, &e); err != nil {
+			return fmt.Errorf("Corrupted grades WAL entry on line %d: %s", line, err)
+		}
+		s.walSize += int64(len(data))
+		s.walOps++
+		// 快照之前已经包含的操作
+		if e.Seq <= s.seq {
+			continue
+		}
+		if e.Seq != s.seq+1 {
+			return fmt.Errorf("Grades WAL entry on line %d has sequence number %d, expected %d", line, e.Seq, s.seq+1)
+		}
+		// 写入 WAL 之前操作已经检查过，此时失败说明快照或 WAL 已经损坏，跳过会丢失之后依赖它的修改
+		if err := s.state.apply(e.Op); err != nil {
+			return fmt.Errorf("Grades WAL entry %d on line %d can not be applied: %s", e.Seq, line, err)
+		}
+		s.seq = e.Seq
+	}
+}
+
+func (s *fileStore) Students() (Students, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.state.all(), nil
+}
+
+func (s *fileStore) Counts() (int, int) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.state.counts()
+}
+
+func (s *fileStore) List(q StudentQuery) (Students, int, bool, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	page, total, more := s.state.list(q)
+	return page, total, more, nil
+}
+
+func (s *fileStore) Student(id int) (Student, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.state.one(id)
+}
+
+func (s *fileStore) Catalog() (Catalog, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.state.catalog.clone(), nil
+}
+
+func (s *fileStore) History(studentID int, after int64, limit int) ([]Event, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.state.events(studentID, after, limit), nil
+}
+
+func (s *fileStore) StudentAt(id int, at time.Time) (Student, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.state.studentAt(id, at)
+}
+
+func (s *fileStore) Generation() uint64 {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.state.gen
+}
+
+func (s *fileStore) Apply(op Op) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := s.state.prepare(&op); err != nil {
+		return err
+	}
+	data, err := json.Marshal(walEntry{Seq: s.seq + 1, Op: op})
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if _, err = s.wal.Write(data); err == nil {
+		err = s.wal.Sync()
+	}
+	if err != nil {
+		// 去掉可能写入了一部分的内容
+		_ = s.wal.Truncate(s.walSize)
+		s.err = err
+		return err
+	}
+	s.err = nil
+	s.seq++
+	s.walOps++
+	s.walSize += int64(len(data))
+	s.state.mutate(op)
+	if err := s.saveHistory(); err != nil {
+		stlog.Println("Failed to append grades history: ", err)
+		s.err = err
+	}
+	if s.walOps >= compactEvery {
+		if err := s.compact(); err != nil {
+			stlog.Println("Failed to compact grades store: ", err)
+		}
+	}
+	return nil
+}
+
+// 写入快照后清空 WAL，调用方需持有写锁或处于初始化阶段
+// 快照先写入临时文件再重命名，清空 WAL 之前中断时，重放会跳过快照已包含的操作
+// 快照不包含事件，写入快照前先将事件同步到 history.ndjson
+func (s *fileStore) compact() error {
+	err := s.saveHistory()
+	if err == nil {
+		err = s.history.Sync()
+	}
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(snapshot{
+		Seq:            s.seq,
+		NextID:         s.state.nextID,
+		NextGradeID:    s.state.nextGradeID,
+		NextCatalogIDs: s.state.catalogIDs,
+		Students:       s.state.students,
+		Catalog:        s.state.catalog,
+		HistorySeq:     int64(s.historySaved),
+	})
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(s.dir, snapshotFile)
+	f, err := os.OpenFile(path+".tmp", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		_ = os.Remove(path + ".tmp")
+		return err
+	}
+	if err := s.wal.Truncate(0); err != nil {
+		return err
+	}
+	s.walOps, s.walSize = 0, 0
+	return nil
+}
+
+func (s *fileStore) Check() error {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if s.err != nil {
+		return s.err
+	}
+	_, err := s.wal.Stat()
+	return err
+}
+
+func (s *fileStore) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	err := s.wal.Close()
+	if closeErr := s.history.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
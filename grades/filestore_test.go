@@ -0,0 +1,369 @@
+package grades
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// 打开 dir 中的文件存储，测试结束时关闭
+func openTestFileStore(t *testing.T, dir string) *fileStore {
+	t.Helper()
+	s, err := OpenFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = s.Close() })
+	return s.(*fileStore)
+}
+
+func mustApply(t *testing.T, s Store, ops ...Op) {
+	t.Helper()
+	for _, op := range ops {
+		if err := s.Apply(op); err != nil {
+			t.Fatalf("Apply(%s): %s", op.Kind, err)
+		}
+	}
+}
+
+// 学生的 JSON，比较重新打开前后的状态，时间经过序列化后不能直接比较
+func studentsJSON(t *testing.T, s Store) string {
+	t.Helper()
+	students, err := s.Students()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(students)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func appendFile(t *testing.T, path, data string) {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = f.Close() }()
+	if _, err := f.WriteString(data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 三个学生，删除其中一个，其余两个各有一条成绩
+var testOps = []Op{
+	{Kind: OpCreateStudent, Actor: "test", Student: &Student{FirstName: "Ada", LastName: "Lovelace"}},
+	{Kind: OpCreateStudent, Actor: "test", Student: &Student{FirstName: "Alan", LastName: "Turing"}},
+	{Kind: OpCreateStudent, Actor: "test", Student: &Student{FirstName: "Grace", LastName: "Hopper"}},
+	{Kind: OpAddGrade, Actor: "test", StudentID: 1, Grade: &Grade{Title: "Quiz 1", Type: GradeQuiz, Score: 90}},
+	{Kind: OpAddGrade, Actor: "test", StudentID: 3, Grade: &Grade{Title: "Exam 1", Type: GradeExam, Score: 75}},
+	{Kind: OpDeleteStudent, Actor: "test", StudentID: 2},
+}
+
+// 每次使用新的操作，避免存储写回的字段在测试之间共享
+func freshTestOps() []Op {
+	ops := make([]Op, len(testOps))
+	for i, op := range testOps {
+		if op.Student != nil {
+			stu := op.Student.clone()
+			op.Student = &stu
+		}
+		if op.Grade != nil {
+			g := *op.Grade
+			op.Grade = &g
+		}
+		ops[i] = op
+	}
+	return ops
+}
+
+func TestFileStoreReplay(t *testing.T) {
+	tests := []struct {
+		name string
+		// 关闭存储之后、重新打开之前修改目录
+		change func(t *testing.T, dir string)
+		// 为空表示重新打开后状态不变，否则为打开时的错误包含的内容
+		wantErr string
+	}{
+		{
+			name:   "operations are replayed",
+			change: func(*testing.T, string) {},
+		},
+		{
+			name: "a torn last entry is discarded",
+			change: func(t *testing.T, dir string) {
+				appendFile(t, filepath.Join(dir, walFile), `{"Seq":7,"Op":{"Kind":"Delete`)
+			},
+		},
+		{
+			name: "operations already in the snapshot are skipped",
+			change: func(t *testing.T, dir string) {
+				wal, err := os.ReadFile(filepath.Join(dir, walFile))
+				if err != nil {
+					t.Fatal(err)
+				}
+				s := openTestFileStore(t, dir)
+				s.mutex.Lock()
+				err = s.compact()
+				s.mutex.Unlock()
+				if err != nil {
+					t.Fatal(err)
+				}
+				_ = s.Close()
+				// 写入快照之后、清空 WAL 之前中断
+				if err := os.WriteFile(filepath.Join(dir, walFile), wal, 0600); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+		{
+			name: "a corrupted entry fails",
+			change: func(t *testing.T, dir string) {
+				appendFile(t, filepath.Join(dir, walFile), "not json\n")
+			},
+			wantErr: "Corrupted grades WAL entry on line 7",
+		},
+		{
+			name: "an entry that can not be applied fails",
+			change: func(t *testing.T, dir string) {
+				appendFile(t, filepath.Join(dir, walFile), `{"Seq":7,"Op":{"Kind":"DeleteStudent","StudentID":2}}`+"\n")
+			},
+			wantErr: "Grades WAL entry 7 on line 7 can not be applied",
+		},
+		{
+			name: "a missing entry fails",
+			change: func(t *testing.T, dir string) {
+				appendFile(t, filepath.Join(dir, walFile), `{"Seq":8,"Op":{"Kind":"DeleteStudent","StudentID":1}}`+"\n")
+			},
+			wantErr: "has sequence number 8, expected 7",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			s := openTestFileStore(t, dir)
+			mustApply(t, s, freshTestOps()...)
+			want := studentsJSON(t, s)
+			_ = s.Close()
+
+			tt.change(t, dir)
+			reopened, err := OpenFileStore(dir)
+			if tt.wantErr != "" {
+				if err == nil {
+					_ = reopened.Close()
+					t.Fatalf("OpenFileStore() succeeded, want an error containing %q", tt.wantErr)
+				}
+				if !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("OpenFileStore() error = %q, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			s = reopened.(*fileStore)
+			t.Cleanup(func() { _ = s.Close() })
+			if got := studentsJSON(t, s); got != want {
+				t.Fatalf("students after reopening = %s, want %s", got, want)
+			}
+
+			// 之后的操作接着写入，再次打开后仍然保留
+			mustApply(t, s, Op{Kind: OpAddGrade, Actor: "test", StudentID: 1, Grade: &Grade{Title: "Quiz 2", Type: GradeQuiz, Score: 80}})
+			want = studentsJSON(t, s)
+			_ = s.Close()
+			if got := studentsJSON(t, openTestFileStore(t, dir)); got != want {
+				t.Errorf("students after writing and reopening = %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+func TestSeed(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  Config
+		// 打开之前在数据目录中写入的操作，nil 表示新目录
+		existing []Op
+		want     int
+	}{
+		{name: "memory store", cfg: Config{Store: "memory", Seed: true}, want: len(seedStudents)},
+		{name: "seeding disabled", cfg: Config{Store: "memory"}},
+		{name: "new data directory", cfg: Config{Store: "file", Seed: true}, want: len(seedStudents)},
+		{
+			name:     "data directory with students",
+			cfg:      Config{Store: "file", Seed: true},
+			existing: freshTestOps()[:1],
+			want:     1,
+		},
+		{
+			name: "data directory whose students were all deleted",
+			cfg:  Config{Store: "file", Seed: true},
+			existing: []Op{
+				{Kind: OpCreateStudent, Actor: "test", Student: &Student{FirstName: "Ada", LastName: "Lovelace"}},
+				{Kind: OpDeleteStudent, Actor: "test", StudentID: 1},
+			},
+		},
+	}
+	saved := db
+	defer func() { db = saved }()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.cfg.DataDir = filepath.Join(t.TempDir(), "data")
+			if tt.existing != nil {
+				s, err := OpenFileStore(tt.cfg.DataDir)
+				if err != nil {
+					t.Fatal(err)
+				}
+				mustApply(t, s, tt.existing...)
+				_ = s.Close()
+			}
+			if err := Open(tt.cfg); err != nil {
+				t.Fatal(err)
+			}
+			defer func() { _ = Close() }()
+			if students, _ := db.Counts(); students != tt.want {
+				t.Errorf("%d students after opening, want %d", students, tt.want)
+			}
+			// 示例数据本身不被存储修改
+			for _, stu := range seedStudents {
+				for _, g := range stu.Grades {
+					if g.ID != 0 || stu.Version != 0 {
+						t.Fatalf("seed student %d was modified by the store", stu.ID)
+					}
+				}
+			}
+		})
+	}
+}
+
+// 所有事件的 JSON
+func historyJSON(t *testing.T, s Store) string {
+	t.Helper()
+	events, err := s.History(0, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(events)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestFileStoreHistory(t *testing.T) {
+	readSnapshot := func(t *testing.T, dir string) snapshot {
+		t.Helper()
+		var snap snapshot
+		data, err := os.ReadFile(filepath.Join(dir, snapshotFile))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal(data, &snap); err != nil {
+			t.Fatal(err)
+		}
+		return snap
+	}
+	tests := []struct {
+		name string
+		// 存储写入 testOps、写入快照、再写入一个操作并关闭之后修改目录
+		change  func(t *testing.T, dir string)
+		wantErr string
+	}{
+		{
+			name:   "events after the snapshot are regenerated from the WAL",
+			change: func(*testing.T, string) {},
+		},
+		{
+			name: "unsynced events are replaced",
+			change: func(t *testing.T, dir string) {
+				appendFile(t, filepath.Join(dir, historyFile), `{"Seq":8,"Kind":"DeleteStudent"}`+"\n"+`{"Seq":9,`)
+			},
+		},
+		{
+			name: "a legacy snapshot with events is migrated",
+			change: func(t *testing.T, dir string) {
+				s := openTestFileStore(t, dir)
+				s.mutex.Lock()
+				err := s.compact()
+				snap := readSnapshot(t, dir)
+				snap.History, snap.HistorySeq = s.state.history, 0
+				s.mutex.Unlock()
+				_ = s.Close()
+				if err != nil {
+					t.Fatal(err)
+				}
+				data, err := json.Marshal(snap)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(filepath.Join(dir, snapshotFile), data, 0600); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.Remove(filepath.Join(dir, historyFile)); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+		{
+			name: "a history shorter than the snapshot fails",
+			change: func(t *testing.T, dir string) {
+				if err := os.WriteFile(filepath.Join(dir, historyFile), nil, 0600); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantErr: "Grades history ends after 0 of 6 events",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			s := openTestFileStore(t, dir)
+			mustApply(t, s, freshTestOps()...)
+			s.mutex.Lock()
+			err := s.compact()
+			s.mutex.Unlock()
+			if err != nil {
+				t.Fatal(err)
+			}
+			mustApply(t, s, Op{Kind: OpAddGrade, Actor: "test", StudentID: 3, Grade: &Grade{Title: "Quiz 1", Type: GradeQuiz, Score: 65}})
+			want := historyJSON(t, s)
+			_ = s.Close()
+
+			tt.change(t, dir)
+			reopened, err := OpenFileStore(dir)
+			if tt.wantErr != "" {
+				if err == nil {
+					_ = reopened.Close()
+					t.Fatalf("OpenFileStore() succeeded, want an error containing %q", tt.wantErr)
+				}
+				if !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("OpenFileStore() error = %q, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			s = reopened.(*fileStore)
+			t.Cleanup(func() { _ = s.Close() })
+			if got := historyJSON(t, s); got != want {
+				t.Fatalf("history after reopening = %s, want %s", got, want)
+			}
+			if snap := readSnapshot(t, dir); len(snap.History) > 0 {
+				t.Errorf("snapshot still holds %d events", len(snap.History))
+			}
+			// history.ndjson 中每行一个事件，与内存中的事件一致
+			data, err := os.ReadFile(filepath.Join(dir, historyFile))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if lines := strings.Count(string(data), "\n"); lines != len(s.state.history) || !strings.HasSuffix(string(data), "\n") {
+				t.Errorf("history file has %d lines for %d events", lines, len(s.state.history))
+			}
+		})
+	}
+}
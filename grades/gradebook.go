@@ -0,0 +1,385 @@
+package grades
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 导入文件中每一行是一条成绩，表头所在的第一行给出列名，列映射把字段对应到列名
+// 学生按 StudentID 查找，没有 StudentID 时按姓名查找，找不到时新增学生
+// 同一学生已有相同标题（且关联同一选课记录）的成绩时修改该成绩，否则追加
+
+// ImportColumns 导入时可以映射的字段
+var ImportColumns = []string{"StudentID", "FirstName", "LastName", "Title", "Type", "Score"}
+
+// ImportReport 导入的结果，试运行时只检查不修改
+type ImportReport struct {
+	DryRun bool
+	// 数据行数，不含表头与空行
+	Rows            int
+	StudentsCreated int
+	GradesAdded     int
+	GradesUpdated   int
+	// 字段名为 Rows[行号].字段，行号与文件中的行号相同，表头为第 1 行
+	Errors []FieldError `json:",omitempty"`
+}
+
+// 导入的一步及其所在的行，新增的学生连同其成绩在第一次出现的行中一起新增
+type importStep struct {
+	row int
+	op  Op
+}
+
+/**
+ * readTable
+ * @Description: 读取 CSV 或 XLSX 文件中的所有行
+ * @param format csv 或 xlsx
+ * @param data
+ * @return [][]string
+ * @return error
+ */
+func readTable(format string, data []byte) ([][]string, error) {
+	switch format {
+	case "csv":
+		r := csv.NewReader(strings.NewReader(strings.TrimPrefix(string(data), "\ufeff")))
+		r.FieldsPerRecord = -1
+		rows, err := r.ReadAll()
+		if err != nil {
+			return nil, fmt.Errorf("Invalid CSV file: %s", err)
+		}
+		return rows, nil
+	case "xlsx":
+		return readXLSX(data)
+	}
+	return nil, fmt.Errorf("Unknown format %q, expected csv or xlsx", format)
+}
+
+/**
+ * columnIndexes
+ * @Description: 按列映射在表头中查找每个字段所在的列，列名不区分大小写，没有映射的字段使用字段名作为列名
+ * 显式映射的列不存在时返回错误，没有映射且不存在的列视为没有该字段
+ * @param header
+ * @param mapping 字段名到列名
+ * @return map[string]int 字段名到列的下标
+ * @return error
+ */
+func columnIndexes(header []string, mapping map[string]string) (map[string]int, error) {
+	result := make(map[string]int)
+	for _, field := range ImportColumns {
+		name, explicit := mapping[field]
+		if !explicit {
+			name = field
+		}
+		found := false
+		for i, h := range header {
+			if strings.EqualFold(strings.TrimSpace(h), strings.TrimSpace(name)) {
+				result[field], found = i, true
+				break
+			}
+		}
+		if !found && explicit {
+			return nil, fmt.Errorf("Column %q mapped to %s is not in the header", name, field)
+		}
+	}
+	for _, field := range []string{"Title", "Type", "Score"} {
+		if _, ok := result[field]; !ok {
+			return nil, fmt.Errorf("Column for %s is required", field)
+		}
+	}
+	_, hasID := result["StudentID"]
+	_, hasFirst := result["FirstName"]
+	_, hasLast := result["LastName"]
+	if !hasID && !(hasFirst && hasLast) {
+		return nil, fmt.Errorf("Column for StudentID, or columns for FirstName and LastName, are required")
+	}
+	return result, nil
+}
+
+// 学生姓名的查找键，不区分大小写
+func nameKey(first, last string) string {
+	return strings.ToLower(strings.TrimSpace(first)) + "\x00" + strings.ToLower(strings.TrimSpace(last))
+}
+
+/**
+ * planImport
+ * @Description: 检查导入的所有行并生成要执行的操作，不修改存储
+ * @param rows 包括表头
+ * @param cols 字段名到列的下标
+ * @param courseID 不为 0 时成绩关联到学生在该课程中的选课记录
+ * @return []importStep
+ * @return ImportReport
+ */
+func planImport(rows [][]string, cols map[string]int, courseID int, students Students, catalog Catalog) ([]importStep, ImportReport) {
+	var report ImportReport
+	var steps []importStep
+	byName := make(map[string]*Student)
+	for i := range students {
+		byName[nameKey(students[i].FirstName, students[i].LastName)] = &students[i]
+	}
+	// 本次导入新增的学生
+	created := make(map[string]*Student)
+	// 本次导入已经写入的成绩，学生、选课记录与标题相同的行视为重复
+	seen := make(map[string]int)
+	for i, row := range rows[1:] {
+		line := i + 2
+		cell := func(field string) string {
+			if c, ok := cols[field]; ok && c < len(row) {
+				return strings.TrimSpace(row[c])
+			}
+			return ""
+		}
+		empty := true
+		for _, c := range row {
+			if strings.TrimSpace(c) != "" {
+				empty = false
+				break
+			}
+		}
+		if empty {
+			continue
+		}
+		report.Rows++
+		var errs []FieldError
+		fail := func(field, message string) {
+			errs = append(errs, FieldError{Field: fmt.Sprintf("Rows[%d].%s", line, field), Message: message})
+		}
+
+		g := Grade{Title: cell("Title")}
+		for _, t := range gradeTypes {
+			if strings.EqualFold(cell("Type"), string(t)) {
+				g.Type = t
+			}
+		}
+		if g.Type == "" {
+			g.Type = GradeType(cell("Type"))
+		}
+		if s := cell("Score"); s != "" {
+			score, err := strconv.ParseFloat(s, 32)
+			if err != nil {
+				fail("Score", fmt.Sprintf("%q is not a number", s))
+			}
+			g.Score = float32(score)
+		} else {
+			fail("Score", "must not be empty")
+		}
+		for _, e := range g.Validate() {
+			fail(e.Field, e.Message)
+		}
+
+		// 查找学生，按姓名找不到时新增
+		var stu, pending *Student
+		first, last := cell("FirstName"), cell("LastName")
+		key := "new\x00" + nameKey(first, last)
+		if s := cell("StudentID"); s != "" {
+			id, err := strconv.Atoi(s)
+			if err != nil {
+				fail("StudentID", fmt.Sprintf("%q is not a student Id", s))
+			} else if stu, err = students.GetById(id); err != nil {
+				fail("StudentID", fmt.Sprintf("student %d does not exist", id))
+			}
+		} else if stu = byName[nameKey(first, last)]; stu == nil {
+			if pending = created[key]; pending == nil {
+				pending = &Student{FirstName: first, LastName: last}
+				for _, e := range pending.Validate() {
+					fail(e.Field, e.Message)
+				}
+			}
+			// 新增的学生没有选课记录
+			if courseID != 0 {
+				fail("StudentID", fmt.Sprintf("a new student is not enrolled in course %d", courseID))
+			}
+		}
+		if stu != nil {
+			key = strconv.Itoa(stu.ID)
+			if courseID != 0 {
+				if g.EnrollmentID = catalog.enrollmentIn(stu.ID, courseID); g.EnrollmentID == 0 {
+					fail("StudentID", fmt.Sprintf("student %d is not enrolled in course %d", stu.ID, courseID))
+				}
+			}
+		}
+		if len(errs) > 0 {
+			report.Errors = append(report.Errors, errs...)
+			continue
+		}
+		if pending != nil && created[key] == nil {
+			created[key] = pending
+			report.StudentsCreated++
+			steps = append(steps, importStep{row: line, op: Op{Kind: OpCreateStudent, Student: pending}})
+		}
+
+		// 追加或修改成绩
+		key += fmt.Sprintf("\x00%d\x00%s", g.EnrollmentID, g.Title)
+		if prev, ok := seen[key]; ok {
+			fail("Title", fmt.Sprintf("duplicates row %d", prev))
+			report.Errors = append(report.Errors, errs...)
+			continue
+		}
+		seen[key] = line
+		if pending != nil {
+			pending.Grades = append(pending.Grades, g)
+			report.GradesAdded++
+			continue
+		}
+		// 修改成绩时期望计划时的版本，执行前被其他请求修改过时整个导入失败
+		step := importStep{row: line, op: Op{Kind: OpAddGrade, StudentID: stu.ID, Grade: &g}}
+		for _, existing := range stu.Grades {
+			if existing.Title == g.Title && existing.EnrollmentID == g.EnrollmentID {
+				g.ID, g.DaysLate, g.ExtraCredit = existing.ID, existing.DaysLate, existing.ExtraCredit
+				step.op.Kind, step.op.Version = OpUpdateGrade, existing.Version
+				break
+			}
+		}
+		if step.op.Kind == OpUpdateGrade {
+			report.GradesUpdated++
+		} else {
+			report.GradesAdded++
+		}
+		steps = append(steps, step)
+	}
+	return steps, report
+}
+
+// 学生在课程的某个教学班中的选课记录，没有时返回 0
+func (c *Catalog) enrollmentIn(studentID, courseID int) int {
+	for _, e := range c.Enrollments {
+		if e.StudentID != studentID {
+			continue
+		}
+		if s, err := c.SectionById(e.SectionID); err == nil && s.CourseID == courseID {
+			return e.ID
+		}
+	}
+	return 0
+}
+
+/**
+ * applyImport
+ * @Description: 以一个批量操作执行导入，存储在加锁后重新检查每一步，任何一步不能执行时不导入任何一行
+ * 计划之后学生或成绩被其他请求修改、删除时返回 ErrConflict
+ * @param steps
+ * @param actor
+ * @return error
+ */
+func applyImport(steps []importStep, actor string) error {
+	batch := Op{Kind: OpBatch, Actor: actor, Ops: make([]Op, len(steps))}
+	for i, step := range steps {
+		batch.Ops[i] = step.op
+	}
+	err := db.Apply(batch)
+	var be *BatchError
+	if errors.As(err, &be) {
+		return fmt.Errorf("%w: row %d can no longer be imported, nothing was imported: %s", ErrConflict, steps[be.Index].row, be.Err)
+	}
+	return err
+}
+
+/**
+ * gradebook
+ * @Description: 课程的成绩册，每个选课记录一行，每个作业标题一列，最后两列为按课程计分规则计算的分数与等级
+ * 作业按第一次出现的创建时间排序
+ * @param courseID
+ * @param students
+ * @param catalog
+ * @return [][]interface{} 第一行为表头，没有成绩的单元格为 nil
+ * @return error
+ */
+func gradebook(courseID int, students Students, catalog Catalog) ([][]interface{}, error) {
+	if _, err := catalog.CourseById(courseID); err != nil {
+		return nil, err
+	}
+	type entry struct {
+		stu     Student
+		section Section
+		summary CourseSummary
+	}
+	var entries []entry
+	// 作业标题及其最早的创建时间
+	var titles []string
+	created := make(map[string]time.Time)
+	for _, stu := range students {
+		summary := catalog.Summary(stu)
+		for _, c := range summary.Courses {
+			if c.Course.ID != courseID {
+				continue
+			}
+			entries = append(entries, entry{stu: stu, section: c.Section, summary: c})
+			for _, g := range stu.Grades {
+				if g.EnrollmentID != c.EnrollmentID {
+					continue
+				}
+				t, ok := created[g.Title]
+				if !ok {
+					titles = append(titles, g.Title)
+				}
+				if !ok || g.Created.Before(t) {
+					created[g.Title] = g.Created
+				}
+			}
+		}
+	}
+	sort.SliceStable(titles, func(i, j int) bool { return created[titles[i]].Before(created[titles[j]]) })
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].stu.LastName != entries[j].stu.LastName {
+			return entries[i].stu.LastName < entries[j].stu.LastName
+		}
+		if entries[i].stu.FirstName != entries[j].stu.FirstName {
+			return entries[i].stu.FirstName < entries[j].stu.FirstName
+		}
+		return entries[i].stu.ID < entries[j].stu.ID
+	})
+
+	header := []interface{}{"StudentID", "FirstName", "LastName", "Section"}
+	for _, t := range titles {
+		header = append(header, t)
+	}
+	header = append(header, "Score", "Letter")
+	table := [][]interface{}{header}
+	for _, e := range entries {
+		row := []interface{}{e.stu.ID, e.stu.FirstName, e.stu.LastName, e.section.Name}
+		for _, t := range titles {
+			var cell interface{}
+			for _, g := range e.stu.Grades {
+				if g.EnrollmentID == e.summary.EnrollmentID && g.Title == t {
+					cell = g.Score
+					break
+				}
+			}
+			row = append(row, cell)
+		}
+		if e.summary.Grades > 0 {
+			row = append(row, e.summary.Score, e.summary.Letter)
+		} else {
+			row = append(row, nil, nil)
+		}
+		table = append(table, row)
+	}
+	return table, nil
+}
+
+// 将表格写为 CSV，nil 为空字段
+func writeCSV(w io.Writer, rows [][]interface{}) error {
+	cw := csv.NewWriter(w)
+	for _, row := range rows {
+		record := make([]string, len(row))
+		for i, cell := range row {
+			switch v := cell.(type) {
+			case nil:
+			case float32:
+				record[i] = strconv.FormatFloat(float64(v), 'f', -1, 32)
+			default:
+				record[i] = fmt.Sprint(v)
+			}
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
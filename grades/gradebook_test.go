@@ -0,0 +1,218 @@
+package grades
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// 导入文件的表头与各列的下标，列的顺序与 ImportColumns 相同
+func importColumns() ([]string, map[string]int) {
+	cols := make(map[string]int, len(ImportColumns))
+	for i, c := range ImportColumns {
+		cols[c] = i
+	}
+	return ImportColumns, cols
+}
+
+// 存储中有 testOps 写入的学生：1 Ada（Quiz 1）与 3 Grace（Exam 1）
+func importTestStore(t *testing.T) Store {
+	t.Helper()
+	s := NewMemoryStore()
+	mustApply(t, s, freshTestOps()...)
+	return s
+}
+
+func planTestImport(t *testing.T, s Store, courseID int, rows ...[]string) ([]importStep, ImportReport) {
+	t.Helper()
+	header, cols := importColumns()
+	students, err := s.Students()
+	if err != nil {
+		t.Fatal(err)
+	}
+	catalog, err := s.Catalog()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return planImport(append([][]string{header}, rows...), cols, courseID, students, catalog)
+}
+
+func TestPlanImport(t *testing.T) {
+	tests := []struct {
+		name     string
+		courseID int
+		rows     [][]string
+		want     ImportReport
+		// 每一步的行号与操作类型
+		wantSteps []string
+		// 每个错误的字段名
+		wantErrors []string
+	}{
+		{
+			name:      "new grade for a student found by Id",
+			rows:      [][]string{{"1", "", "", "Quiz 2", "quiz", "88"}},
+			want:      ImportReport{Rows: 1, GradesAdded: 1},
+			wantSteps: []string{"2 AddGrade"},
+		},
+		{
+			name:      "a grade with the same title is updated",
+			rows:      [][]string{{"1", "", "", "Quiz 1", "Quiz", "60"}},
+			want:      ImportReport{Rows: 1, GradesUpdated: 1},
+			wantSteps: []string{"2 UpdateGrade"},
+		},
+		{
+			name:      "students are found by name ignoring case",
+			rows:      [][]string{{"", " grace", "HOPPER ", "Exam 1", "Exam", "80"}},
+			want:      ImportReport{Rows: 1, GradesUpdated: 1},
+			wantSteps: []string{"2 UpdateGrade"},
+		},
+		{
+			name: "a new student is created once with all of their grades",
+			rows: [][]string{
+				{"", "Alan", "Turing", "Quiz 1", "Quiz", "70"},
+				{"", "", "", "", "", ""},
+				{"", "alan", "turing", "Exam 1", "Exam", "90"},
+			},
+			want:      ImportReport{Rows: 2, StudentsCreated: 1, GradesAdded: 2},
+			wantSteps: []string{"2 CreateStudent"},
+		},
+		{
+			name: "duplicate rows are rejected",
+			rows: [][]string{
+				{"1", "", "", "Quiz 2", "Quiz", "70"},
+				{"", "Ada", "Lovelace", "Quiz 2", "Quiz", "75"},
+			},
+			want:       ImportReport{Rows: 2, GradesAdded: 1},
+			wantSteps:  []string{"2 AddGrade"},
+			wantErrors: []string{"Rows[3].Title"},
+		},
+		{
+			name: "invalid rows are reported and left out",
+			rows: [][]string{
+				{"x", "", "", "Quiz 2", "Quiz", "70"},
+				{"2", "", "", "Quiz 2", "Quiz", "70"},
+				{"1", "", "", "Quiz 2", "Quiz", "lots"},
+				{"1", "", "", "Quiz 3", "Quiz", ""},
+				{"3", "", "", "Quiz 2", "Quiz", "70"},
+			},
+			want:       ImportReport{Rows: 5, GradesAdded: 1},
+			wantSteps:  []string{"6 AddGrade"},
+			wantErrors: []string{"Rows[2].StudentID", "Rows[3].StudentID", "Rows[4].Score", "Rows[5].Score"},
+		},
+		{
+			name:       "new students are not enrolled in the course",
+			courseID:   1,
+			rows:       [][]string{{"", "Alan", "Turing", "Quiz 1", "Quiz", "70"}},
+			want:       ImportReport{Rows: 1},
+			wantErrors: []string{"Rows[2].StudentID"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			steps, report := planTestImport(t, importTestStore(t), tt.courseID, tt.rows...)
+			var gotErrors []string
+			for _, e := range report.Errors {
+				gotErrors = append(gotErrors, e.Field)
+			}
+			report.Errors = nil
+			if !reflect.DeepEqual(report, tt.want) {
+				t.Errorf("report = %+v, want %+v", report, tt.want)
+			}
+			if !reflect.DeepEqual(gotErrors, tt.wantErrors) {
+				t.Errorf("errors = %v, want %v", gotErrors, tt.wantErrors)
+			}
+			var gotSteps []string
+			for _, step := range steps {
+				gotSteps = append(gotSteps, fmt.Sprintf("%d %s", step.row, step.op.Kind))
+			}
+			if !reflect.DeepEqual(gotSteps, tt.wantSteps) {
+				t.Errorf("steps = %v, want %v", gotSteps, tt.wantSteps)
+			}
+		})
+	}
+}
+
+func TestApplyImport(t *testing.T) {
+	// 新增学生、为 Ada 修改成绩、为 Grace 追加成绩
+	rows := [][]string{
+		{"", "Alan", "Turing", "Quiz 1", "Quiz", "70"},
+		{"1", "", "", "Quiz 1", "Quiz", "60"},
+		{"3", "", "", "Quiz 1", "Quiz", "85"},
+	}
+	tests := []struct {
+		name string
+		// 计划之后、执行之前的其他修改
+		meanwhile []Op
+		// 为空表示导入成功，否则为冲突的行号
+		conflictRow string
+	}{
+		{name: "nothing changed"},
+		{
+			name:      "an unrelated change",
+			meanwhile: []Op{{Kind: OpCreateStudent, Student: &Student{FirstName: "Barbara", LastName: "Liskov"}}},
+		},
+		{
+			name:        "the updated grade changed",
+			meanwhile:   []Op{{Kind: OpUpdateGrade, StudentID: 1, Grade: &Grade{ID: 1, Title: "Quiz 1", Type: GradeQuiz, Score: 99}}},
+			conflictRow: "row 3",
+		},
+		{
+			name:        "the updated grade was deleted",
+			meanwhile:   []Op{{Kind: OpDeleteGrade, StudentID: 1, GradeID: 1}},
+			conflictRow: "row 3",
+		},
+		{
+			name:        "a student was deleted",
+			meanwhile:   []Op{{Kind: OpDeleteStudent, StudentID: 3}},
+			conflictRow: "row 4",
+		},
+	}
+	saved := db
+	defer func() { db = saved }()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db = importTestStore(t)
+			steps, report := planTestImport(t, db, 0, rows...)
+			if len(report.Errors) > 0 {
+				t.Fatalf("plan errors: %v", report.Errors)
+			}
+			mustApply(t, db, tt.meanwhile...)
+			before := studentsJSON(t, db)
+			students, _ := db.Counts()
+
+			err := applyImport(steps, "test")
+			if tt.conflictRow != "" {
+				if !errors.Is(err, ErrConflict) || !strings.Contains(err.Error(), tt.conflictRow) {
+					t.Fatalf("applyImport() error = %v, want a conflict on %s", err, tt.conflictRow)
+				}
+				if after := studentsJSON(t, db); after != before {
+					t.Errorf("a failed import changed the store:\n%s\nwas\n%s", after, before)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, _ := db.Counts(); got != students+1 {
+				t.Errorf("%d students after importing, want %d", got, students+1)
+			}
+			ada, _ := db.Student(1)
+			grace, _ := db.Student(3)
+			if len(ada.Grades) != 1 || ada.Grades[0].Score != 60 || len(grace.Grades) != 2 {
+				t.Errorf("imported grades: Ada %+v, Grace %+v", ada.Grades, grace.Grades)
+			}
+			// 整个导入是一个批量操作，在历史中的操作者相同
+			events, err := db.History(0, 0, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, e := range events[len(events)-3:] {
+				if e.Actor != "test" {
+					t.Errorf("event %d was recorded for %q", e.Seq, e.Actor)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,161 @@
+package grades
+
+import (
+	"Distribute/log"
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// 导入文件的大小上限
+const maxImportSize = 10 << 20
+
+//	POST /import  导入成绩，请求体为 CSV 或 XLSX 文件
+//
+// 查询参数：
+//
+//	format=csv|xlsx          文件格式，默认按 Content-Type 判断，否则为 csv
+//	dry_run=true             只检查不导入，返回 ImportReport
+//	course={id}              成绩关联到学生在该课程中的选课记录
+//	column.{字段}={列名}     列映射，字段为 ImportColumns 之一，默认列名与字段名相同
+//
+// 有任何一行不合法时不导入，返回 422，errors 中列出所有不合法的行
+// 所有行在存储中一次导入，检查之后某一行涉及的学生或成绩被修改时不导入，返回 409
+func importHandler(w http.ResponseWriter, r *http.Request) {
+	route(w, r, map[string]func(){
+		http.MethodPost: func() { importGrades(w, r) },
+	})
+}
+
+func importGrades(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	format := strings.ToLower(q.Get("format"))
+	if format == "" {
+		format = "csv"
+		if strings.Contains(r.Header.Get("Content-Type"), "spreadsheetml") {
+			format = "xlsx"
+		}
+	}
+	dryRun, _ := strconv.ParseBool(q.Get("dry_run"))
+	courseID, err := intParam(q, "course")
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	mapping := make(map[string]string)
+	for k, v := range q {
+		if !strings.HasPrefix(k, "column.") {
+			continue
+		}
+		field := strings.TrimPrefix(k, "column.")
+		known := false
+		for _, c := range ImportColumns {
+			known = known || c == field
+		}
+		if !known {
+			writeProblem(w, r, http.StatusBadRequest, fmt.Sprintf("Unknown import field %q, expected one of %s", field, strings.Join(ImportColumns, ", ")))
+			return
+		}
+		mapping[field] = v[0]
+	}
+
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxImportSize))
+	if err != nil {
+		writeProblem(w, r, http.StatusRequestEntityTooLarge, fmt.Sprintf("Failed to read the file: %s", err))
+		return
+	}
+	rows, err := readTable(format, data)
+	if err == nil && len(rows) == 0 {
+		err = fmt.Errorf("The file is empty")
+	}
+	var cols map[string]int
+	if err == nil {
+		cols, err = columnIndexes(rows[0], mapping)
+	}
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	students, err := db.Students()
+	if err != nil {
+		storeError(w, r, err)
+		return
+	}
+	catalog, err := db.Catalog()
+	if err != nil {
+		storeError(w, r, err)
+		return
+	}
+	if courseID != 0 {
+		if _, err := catalog.CourseById(courseID); err != nil {
+			writeProblem(w, r, http.StatusUnprocessableEntity, err.Error())
+			return
+		}
+	}
+	steps, report := planImport(rows, cols, courseID, students, catalog)
+	report.DryRun = dryRun
+	if dryRun {
+		writeJson(w, r, http.StatusOK, report)
+		return
+	}
+	if len(report.Errors) > 0 {
+		writeProblem(w, r, http.StatusUnprocessableEntity,
+			fmt.Sprintf("%d errors found, nothing was imported", len(report.Errors)), report.Errors...)
+		return
+	}
+	if err := applyImport(steps, actor(r)); err != nil {
+		storeError(w, r, err)
+		return
+	}
+	log.Infof(r.Context(), "Imported %d rows: %d students created, %d grades added, %d grades updated",
+		report.Rows, report.StudentsCreated, report.GradesAdded, report.GradesUpdated)
+	writeJson(w, r, http.StatusOK, report)
+}
+
+// GET /courses/{id}/gradebook?format=csv|xlsx  课程的成绩册，默认为 CSV
+func getGradebook(w http.ResponseWriter, r *http.Request, id int) {
+	format := strings.ToLower(r.URL.Query().Get("format"))
+	if format == "" {
+		format = "csv"
+	}
+	if format != "csv" && format != "xlsx" {
+		writeProblem(w, r, http.StatusBadRequest, fmt.Sprintf("Unknown format %q, expected csv or xlsx", format))
+		return
+	}
+	students, err := db.Students()
+	if err != nil {
+		storeError(w, r, err)
+		return
+	}
+	catalog, err := db.Catalog()
+	if err != nil {
+		storeError(w, r, err)
+		return
+	}
+	table, err := gradebook(id, students, catalog)
+	if err != nil {
+		storeError(w, r, err)
+		return
+	}
+	course, _ := catalog.CourseById(id)
+	var b bytes.Buffer
+	contentType := "text/csv; charset=utf-8"
+	if format == "xlsx" {
+		contentType = xlsxContentType
+		err = writeXLSX(&b, table)
+	} else {
+		err = writeCSV(&b, table)
+	}
+	if err != nil {
+		writeProblem(w, r, http.StatusInternalServerError, "")
+		log.Errorf(r.Context(), "Failed to write gradebook : %s", err)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", fmt.Sprintf("%s-gradebook.%s", course.Code, format)))
+	_, _ = w.Write(b.Bytes())
+}
@@ -1,8 +1,11 @@
 package grades
 
 import (
+	"Distribute/metrics"
 	"fmt"
-	"sync"
+	"strings"
+	"time"
+	"unicode/utf8"
 )
 
 type Student struct {
@@ -10,9 +13,15 @@ type Student struct {
 	FirstName string
 	LastName  string
 	Grades    []Grade
+	// 版本号，由存储设置，姓名或任何一条成绩修改后递增，作为 ETag
+	Version int
 }
 
+// Average 所有成绩的平均分，没有成绩时为 0
 func (stu Student) Average() float32 {
+	if len(stu.Grades) == 0 {
+		return 0
+	}
 	var result float32
 	for _, g := range stu.Grades {
 		result += g.Score
@@ -20,12 +29,41 @@ func (stu Student) Average() float32 {
 	return result / float32(len(stu.Grades))
 }
 
+// 姓名的最大长度
+const maxNameLen = 100
+
+// Validate 检查学生的姓名，返回所有不合法的字段
+func (stu Student) Validate() []FieldError {
+	var errs []FieldError
+	check := func(field, value string) {
+		switch {
+		case strings.TrimSpace(value) == "":
+			errs = append(errs, FieldError{Field: field, Message: "must not be empty"})
+		case utf8.RuneCountInString(value) > maxNameLen:
+			errs = append(errs, FieldError{Field: field, Message: fmt.Sprintf("must be at most %d characters", maxNameLen)})
+		}
+	}
+	check("FirstName", stu.FirstName)
+	check("LastName", stu.LastName)
+	return errs
+}
+
 type Students []Student
 
-var (
-	students      Students
-	studentsMutex = new(sync.Mutex)
-)
+func init() {
+	metrics.NewGaugeFunc("grades_students",
+		"Number of students known to the grading service.",
+		func() float64 {
+			students, _ := db.Counts()
+			return float64(students)
+		})
+	metrics.NewGaugeFunc("grades_grades",
+		"Number of grades recorded across all students.",
+		func() float64 {
+			_, grades := db.Counts()
+			return float64(grades)
+		})
+}
 
 // 使用 for range 查找内容需要返回地址时一定注意，其取出的value是单独开辟的内存空间存放
 // 1.22 版本后 可忽略
@@ -35,7 +73,7 @@ func (ss Students) GetById(id int) (*Student, error) {
 			return &ss[i], nil
 		}
 	}
-	return nil, fmt.Errorf("Student with Id %d not found", id)
+	return nil, fmt.Errorf("Student with Id %d %w", id, ErrNotFound)
 }
 
 type GradeType string
@@ -46,8 +84,61 @@ const (
 	GradeExam GradeType = "Exam"
 )
 
+// 成绩的类型是否有效
+func (t GradeType) Valid() bool {
+	switch t {
+	case GradeQuiz, GradeTest, GradeExam:
+		return true
+	}
+	return false
+}
+
 type Grade struct {
+	// 由存储分配，在所有学生的成绩中唯一
+	ID    int
 	Title string
 	Type  GradeType
 	Score float32
+	// 关联的选课记录，为 0 时不属于任何课程
+	EnrollmentID int `json:",omitempty"`
+	// 迟交的天数，按课程计分规则扣分
+	DaysLate int `json:",omitempty"`
+	// 额外加分，不计入类别平均分，直接加到最终分数上
+	ExtraCredit bool `json:",omitempty"`
+	// 创建与最后一次修改的时间，由存储设置
+	Created time.Time
+	Updated time.Time
+	// 版本号，由存储设置，每次修改后递增，作为 ETag
+	Version int
+}
+
+// Validate 检查成绩的标题、类型与分数，返回所有不合法的字段
+func (g Grade) Validate() []FieldError {
+	var errs []FieldError
+	switch {
+	case strings.TrimSpace(g.Title) == "":
+		errs = append(errs, FieldError{Field: "Title", Message: "must not be empty"})
+	case utf8.RuneCountInString(g.Title) > maxNameLen:
+		errs = append(errs, FieldError{Field: "Title", Message: fmt.Sprintf("must be at most %d characters", maxNameLen)})
+	}
+	if !g.Type.Valid() {
+		errs = append(errs, FieldError{Field: "Type", Message: fmt.Sprintf("must be one of %s, %s or %s", GradeQuiz, GradeTest, GradeExam)})
+	}
+	if g.Score < 0 {
+		errs = append(errs, FieldError{Field: "Score", Message: "must not be negative"})
+	}
+	if g.DaysLate < 0 {
+		errs = append(errs, FieldError{Field: "DaysLate", Message: "must not be negative"})
+	}
+	return errs
+}
+
+// GradeById 返回学生的某条成绩的地址
+func (stu *Student) GradeById(id int) (*Grade, error) {
+	for i := range stu.Grades {
+		if stu.Grades[i].ID == id {
+			return &stu.Grades[i], nil
+		}
+	}
+	return nil, fmt.Errorf("Grade with Id %d %w", id, ErrNotFound)
 }
@@ -0,0 +1,169 @@
+package grades
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Event 对存储的一次修改，由存储在执行操作时记录，之后不再改变
+// 删除学生后其事件仍然保留
+type Event struct {
+	// 从 1 开始递增
+	Seq  int64
+	Time time.Time
+	// 执行修改的人，由请求头 ActorHeader 提供
+	Actor string `json:",omitempty"`
+	Kind  OpKind
+	// 修改涉及的学生，课程目录的操作只有选课记录涉及学生
+	StudentID int `json:",omitempty"`
+	// 修改前后的值：学生的操作为整个学生，成绩的操作为该成绩，课程目录的操作为该对象
+	// 新增时 Old 为空，删除时 New 为空
+	Old json.RawMessage `json:",omitempty"`
+	New json.RawMessage `json:",omitempty"`
+}
+
+// ActorHeader 请求头，说明修改由谁执行，记录在事件中
+const ActorHeader = "X-Grades-Actor"
+
+// 操作涉及的学生
+func (st *state) eventStudent(op Op) int {
+	switch op.Kind {
+	case OpPutStudent, OpCreateStudent:
+		return op.Student.ID
+	case OpEnroll:
+		return op.Enrollment.StudentID
+	case OpUnenroll:
+		if e, err := st.catalog.EnrollmentById(op.ID); err == nil {
+			return e.StudentID
+		}
+		return 0
+	}
+	return op.StudentID
+}
+
+// 操作涉及的对象当前的值，不存在时为空
+func (st *state) eventValue(op Op) json.RawMessage {
+	var v interface{}
+	var err error
+	c := &st.catalog
+	switch op.Kind {
+	case OpPutStudent, OpCreateStudent:
+		v, err = st.students.GetById(op.Student.ID)
+	case OpUpdateStudent, OpDeleteStudent:
+		v, err = st.students.GetById(op.StudentID)
+	case OpAddGrade, OpUpdateGrade, OpDeleteGrade:
+		id := op.GradeID
+		if op.Grade != nil {
+			id = op.Grade.ID
+		}
+		var stu *Student
+		if stu, err = st.students.GetById(op.StudentID); err == nil {
+			v, err = stu.GradeById(id)
+		}
+	case OpPutTerm:
+		v, err = c.TermById(op.Term.ID)
+	case OpDeleteTerm:
+		v, err = c.TermById(op.ID)
+	case OpPutCourse:
+		v, err = c.CourseById(op.Course.ID)
+	case OpDeleteCourse:
+		v, err = c.CourseById(op.ID)
+	case OpPutSection:
+		v, err = c.SectionById(op.Section.ID)
+	case OpDeleteSection:
+		v, err = c.SectionById(op.ID)
+	case OpEnroll:
+		v, err = c.EnrollmentById(op.Enrollment.ID)
+	case OpUnenroll:
+		v, err = c.EnrollmentById(op.ID)
+	default:
+		return nil
+	}
+	if err != nil {
+		return nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
+// 学生在 at 时刻的状态：从当前状态开始，按序号从大到小撤销最后一个不晚于 at 的事件之后的所有事件
+// 系统时钟可能回拨，事件的时间不一定随序号递增，按序号而不是按时间划分，
+// 得到的总是某个事件之后实际存在过的状态，不会只撤销中间的某个事件
+// 不存在时返回 ErrNotFound
+func (st *state) studentAt(id int, at time.Time) (Student, error) {
+	var cur *Student
+	if stu, err := st.students.GetById(id); err == nil {
+		c := stu.clone()
+		cur = &c
+	}
+	// 事件按序号追加，下标即序号减 1，保留前 keep 个事件
+	keep := len(st.history)
+	for keep > 0 && st.history[keep-1].Time.After(at) {
+		keep--
+	}
+	for i := len(st.history) - 1; i >= keep; i-- {
+		e := st.history[i]
+		if e.StudentID != id {
+			continue
+		}
+		switch e.Kind {
+		case OpPutStudent, OpCreateStudent, OpUpdateStudent, OpDeleteStudent:
+			cur = nil
+			if len(e.Old) > 0 {
+				cur = new(Student)
+				if err := json.Unmarshal(e.Old, cur); err != nil {
+					return Student{}, err
+				}
+			}
+		case OpAddGrade, OpUpdateGrade, OpDeleteGrade:
+			if cur == nil {
+				continue
+			}
+			var old, current Grade
+			if len(e.New) > 0 {
+				if err := json.Unmarshal(e.New, &current); err != nil {
+					return Student{}, err
+				}
+				for j := range cur.Grades {
+					if cur.Grades[j].ID == current.ID {
+						cur.Grades = append(cur.Grades[:j:j], cur.Grades[j+1:]...)
+						break
+					}
+				}
+			}
+			if len(e.Old) > 0 {
+				if err := json.Unmarshal(e.Old, &old); err != nil {
+					return Student{}, err
+				}
+				cur.Grades = append(cur.Grades, old)
+				sort.SliceStable(cur.Grades, func(a, b int) bool { return cur.Grades[a].ID < cur.Grades[b].ID })
+			}
+			// 成绩的操作都会使学生的版本加 1
+			cur.Version--
+		}
+	}
+	if cur == nil {
+		return Student{}, fmt.Errorf("Student with Id %d at %s %w", id, at.Format(time.RFC3339), ErrNotFound)
+	}
+	return *cur, nil
+}
+
+// 学生的所有事件，studentID 为 0 时返回所有事件中序号大于 after 的最多 limit 个
+func (st *state) events(studentID int, after int64, limit int) []Event {
+	result := make([]Event, 0)
+	for _, e := range st.history {
+		if e.Seq <= after || (studentID != 0 && e.StudentID != studentID) {
+			continue
+		}
+		if limit > 0 && len(result) >= limit {
+			break
+		}
+		result = append(result, e)
+	}
+	return result
+}
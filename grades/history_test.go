@@ -0,0 +1,129 @@
+package grades
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// 第 minute 分钟执行的操作
+func opAt(minute int, op Op) Op {
+	op.Time = time.Date(2026, 1, 1, 0, minute, 0, 0, time.UTC)
+	return op
+}
+
+func TestStudentAt(t *testing.T) {
+	create := func(minute int) Op {
+		return opAt(minute, Op{Kind: OpCreateStudent, Student: &Student{FirstName: "Ada", LastName: "Lovelace"}})
+	}
+	addGrade := func(minute int, title string) Op {
+		return opAt(minute, Op{Kind: OpAddGrade, StudentID: 1, Grade: &Grade{Title: title, Type: GradeQuiz, Score: 80}})
+	}
+	tests := []struct {
+		name string
+		ops  []Op
+		at   int
+		// 当时的成绩标题与版本，nil 表示当时不存在
+		want    []string
+		version int
+	}{
+		{
+			name: "before the student was created",
+			ops:  []Op{create(10), addGrade(20, "Quiz 1")},
+			at:   5,
+		},
+		{
+			name:    "right after creation",
+			ops:     []Op{create(10), addGrade(20, "Quiz 1")},
+			at:      10,
+			want:    []string{},
+			version: 1,
+		},
+		{
+			name:    "between grades",
+			ops:     []Op{create(10), addGrade(20, "Quiz 1"), addGrade(30, "Quiz 2")},
+			at:      25,
+			want:    []string{"Quiz 1"},
+			version: 2,
+		},
+		{
+			name: "updated and deleted grades are restored",
+			ops: []Op{
+				create(10), addGrade(20, "Quiz 1"), addGrade(30, "Quiz 2"),
+				opAt(40, Op{Kind: OpUpdateGrade, StudentID: 1, Grade: &Grade{ID: 1, Title: "Quiz 1 (retake)", Type: GradeQuiz, Score: 90}}),
+				opAt(50, Op{Kind: OpDeleteGrade, StudentID: 1, GradeID: 2}),
+			},
+			at:      35,
+			want:    []string{"Quiz 1", "Quiz 2"},
+			version: 3,
+		},
+		{
+			name: "after the student was deleted",
+			ops: []Op{
+				create(10), addGrade(20, "Quiz 1"),
+				opAt(30, Op{Kind: OpDeleteStudent, StudentID: 1}),
+			},
+			at: 40,
+		},
+		{
+			name: "a deleted student before deletion",
+			ops: []Op{
+				create(10), addGrade(20, "Quiz 1"),
+				opAt(30, Op{Kind: OpDeleteStudent, StudentID: 1}),
+			},
+			at:      25,
+			want:    []string{"Quiz 1"},
+			version: 2,
+		},
+		{
+			// 时钟在第三个事件之前回拨，第三个事件之后的状态中两条成绩都存在
+			name:    "clock stepped back keeps later events",
+			ops:     []Op{create(10), addGrade(50, "Quiz 1"), addGrade(30, "Quiz 2")},
+			at:      40,
+			want:    []string{"Quiz 1", "Quiz 2"},
+			version: 3,
+		},
+		{
+			name:    "clock stepped back before the cutoff",
+			ops:     []Op{create(10), addGrade(50, "Quiz 1"), addGrade(30, "Quiz 2")},
+			at:      20,
+			want:    []string{},
+			version: 1,
+		},
+		{
+			// 其他学生的事件同样决定划分的位置
+			name: "events of other students set the cutoff",
+			ops: []Op{
+				create(10), addGrade(50, "Quiz 1"),
+				opAt(30, Op{Kind: OpCreateStudent, Student: &Student{FirstName: "Alan", LastName: "Turing"}}),
+			},
+			at:      40,
+			want:    []string{"Quiz 1"},
+			version: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewMemoryStore()
+			mustApply(t, s, tt.ops...)
+			stu, err := s.StudentAt(1, time.Date(2026, 1, 1, 0, tt.at, 0, 0, time.UTC))
+			if tt.want == nil {
+				if !errors.Is(err, ErrNotFound) {
+					t.Fatalf("StudentAt() = %+v, %v, want ErrNotFound", stu, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			titles := make([]string, 0)
+			for _, g := range stu.Grades {
+				titles = append(titles, g.Title)
+			}
+			if !reflect.DeepEqual(titles, tt.want) || stu.Version != tt.version {
+				t.Errorf("StudentAt() has grades %q and version %d, want %q and %d", titles, stu.Version, tt.want, tt.version)
+			}
+		})
+	}
+}
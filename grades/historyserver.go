@@ -0,0 +1,88 @@
+package grades
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// 每次返回的事件数的默认值与上限
+const (
+	defaultHistoryLimit = 100
+	maxHistoryLimit     = 1000
+)
+
+//	GET /history?after={seq}&limit={n}  所有事件，按序号排列，用于逐页读取
+//
+// 学生的事件通过 GET /students/{id}/history 获取
+func historyHandler(w http.ResponseWriter, r *http.Request) {
+	route(w, r, map[string]func(){
+		http.MethodGet: func() {
+			q := r.URL.Query()
+			after, err := strconv.ParseInt(q.Get("after"), 10, 64)
+			if q.Get("after") == "" {
+				after, err = 0, nil
+			}
+			if err != nil || after < 0 {
+				writeProblem(w, r, http.StatusBadRequest, fmt.Sprintf("Invalid after %q", q.Get("after")))
+				return
+			}
+			limit, err := intParam(q, "limit")
+			if err != nil {
+				writeProblem(w, r, http.StatusBadRequest, err.Error())
+				return
+			}
+			if limit == 0 {
+				limit = defaultHistoryLimit
+			}
+			if limit > maxHistoryLimit {
+				limit = maxHistoryLimit
+			}
+			events, err := db.History(0, after, limit)
+			if err != nil {
+				storeError(w, r, err)
+				return
+			}
+			writeJson(w, r, http.StatusOK, events)
+		},
+	})
+}
+
+// 学生的所有事件，学生已被删除时仍然返回
+func (sh studentsHandler) getHistory(w http.ResponseWriter, r *http.Request, id int) {
+	events, err := db.History(id, 0, 0)
+	if err != nil {
+		storeError(w, r, err)
+		return
+	}
+	if len(events) == 0 {
+		if _, err := db.Student(id); err != nil {
+			storeError(w, r, err)
+			return
+		}
+	}
+	writeJson(w, r, http.StatusOK, events)
+}
+
+// 查询参数 as_of 中的时间，没有时返回零值，格式不正确时返回 400
+func asOf(w http.ResponseWriter, r *http.Request) (time.Time, bool) {
+	s := r.URL.Query().Get("as_of")
+	if s == "" {
+		return time.Time{}, true
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, fmt.Sprintf("Invalid as_of %q, expected an RFC 3339 timestamp", s))
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// 学生的当前状态，at 不为零值时为该时刻的状态
+func findStudent(id int, at time.Time) (Student, error) {
+	if at.IsZero() {
+		return db.Student(id)
+	}
+	return db.StudentAt(id, at)
+}
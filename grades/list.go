@@ -0,0 +1,138 @@
+package grades
+
+import (
+	"sort"
+	"strings"
+)
+
+// StudentQuery 学生列表的过滤、排序与分页条件
+type StudentQuery struct {
+	// 姓名包含的字符串，不区分大小写
+	Name string
+	// 选修了该课程任一教学班的学生
+	CourseID int
+	// 平均分的范围，包含边界，设置任一边界时不包括没有成绩的学生
+	MinAverage *float32
+	MaxAverage *float32
+	// id、name 或 average，为空时按 id，分数或姓名相同时按 ID 升序
+	Sort string
+	Desc bool
+	// 按偏移量分页，或从 After 之后开始，两者只能使用一个
+	Offset int
+	After  *ListPosition
+	// 为 0 时不限
+	Limit int
+}
+
+// ListPosition 学生在排序中的位置，用于游标分页
+type ListPosition struct {
+	Sort    string
+	Desc    bool `json:",omitempty"`
+	ID      int
+	Name    string  `json:",omitempty"`
+	Average float32 `json:",omitempty"`
+}
+
+// 学生列表的排序字段
+const (
+	SortByID      = "id"
+	SortByName    = "name"
+	SortByAverage = "average"
+)
+
+// 学生在排序中的位置
+func (q StudentQuery) position(stu *Student) ListPosition {
+	p := ListPosition{Sort: q.Sort, Desc: q.Desc, ID: stu.ID}
+	switch q.Sort {
+	case SortByName:
+		p.Name = strings.ToLower(stu.LastName + "\x00" + stu.FirstName)
+	case SortByAverage:
+		p.Average = stu.Average()
+	}
+	return p
+}
+
+// a 是否排在 b 之前
+func (q StudentQuery) less(a, b ListPosition) bool {
+	switch {
+	case q.Sort == SortByName && a.Name != b.Name:
+		return (a.Name < b.Name) != q.Desc
+	case q.Sort == SortByAverage && a.Average != b.Average:
+		return (a.Average < b.Average) != q.Desc
+	case (q.Sort == SortByID || q.Sort == "") && a.ID != b.ID:
+		return (a.ID < b.ID) != q.Desc
+	}
+	// 同一位置不排在自身之前，游标分页从游标之后开始
+	return a.ID < b.ID
+}
+
+// 学生是否满足过滤条件，enrolled 为选修了课程的学生
+func (q StudentQuery) match(stu *Student, enrolled map[int]bool) bool {
+	if q.Name != "" {
+		name := strings.ToLower(stu.FirstName + " " + stu.LastName + ", " + stu.FirstName)
+		if !strings.Contains(name, strings.ToLower(q.Name)) {
+			return false
+		}
+	}
+	if q.CourseID != 0 && !enrolled[stu.ID] {
+		return false
+	}
+	if q.MinAverage != nil || q.MaxAverage != nil {
+		if len(stu.Grades) == 0 {
+			return false
+		}
+		avg := stu.Average()
+		if (q.MinAverage != nil && avg < *q.MinAverage) || (q.MaxAverage != nil && avg > *q.MaxAverage) {
+			return false
+		}
+	}
+	return true
+}
+
+/**
+ * list
+ * @Description: 按条件过滤、排序并分页，只复制返回的一页
+ * @param q
+ * @return Students 一页中的学生
+ * @return int 满足过滤条件的学生数
+ * @return bool 之后是否还有学生
+ */
+func (st *state) list(q StudentQuery) (Students, int, bool) {
+	enrolled := make(map[int]bool)
+	if q.CourseID != 0 {
+		for _, e := range st.catalog.Enrollments {
+			if s, err := st.catalog.SectionById(e.SectionID); err == nil && s.CourseID == q.CourseID {
+				enrolled[e.StudentID] = true
+			}
+		}
+	}
+	type entry struct {
+		stu *Student
+		pos ListPosition
+	}
+	matched := make([]entry, 0, len(st.students))
+	for i := range st.students {
+		stu := &st.students[i]
+		if q.match(stu, enrolled) {
+			matched = append(matched, entry{stu: stu, pos: q.position(stu)})
+		}
+	}
+	sort.Slice(matched, func(i, j int) bool { return q.less(matched[i].pos, matched[j].pos) })
+
+	start := q.Offset
+	if q.After != nil {
+		start = sort.Search(len(matched), func(i int) bool { return q.less(*q.After, matched[i].pos) })
+	}
+	if start > len(matched) {
+		start = len(matched)
+	}
+	end := len(matched)
+	if q.Limit > 0 && start+q.Limit < end {
+		end = start + q.Limit
+	}
+	page := make(Students, 0, end-start)
+	for _, e := range matched[start:end] {
+		page = append(page, e.stu.clone())
+	}
+	return page, len(matched), end < len(matched)
+}
@@ -0,0 +1,158 @@
+package grades
+
+import (
+	"fmt"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+// 姓名与平均分都有相同的学生，5 没有成绩
+func listTestStore(t *testing.T) Store {
+	t.Helper()
+	s := NewMemoryStore()
+	for _, stu := range []Student{
+		{FirstName: "Ada", LastName: "Lovelace", Grades: []Grade{grade(0, GradeQuiz, 85), grade(0, GradeExam, 95)}},
+		{FirstName: "Alan", LastName: "Turing", Grades: []Grade{grade(0, GradeQuiz, 80)}},
+		{FirstName: "Grace", LastName: "Hopper", Grades: []Grade{grade(0, GradeExam, 90)}},
+		{FirstName: "ada", LastName: "lovelace", Grades: []Grade{grade(0, GradeQuiz, 70)}},
+		{FirstName: "Barbara", LastName: "Liskov"},
+		{FirstName: "Edsger", LastName: "Dijkstra", Grades: []Grade{grade(0, GradeQuiz, 80)}},
+	} {
+		stu := stu
+		mustApply(t, s, Op{Kind: OpCreateStudent, Student: &stu})
+	}
+	return s
+}
+
+// 按游标逐页读取所有学生的 ID，每页之前执行 before
+func listAll(t *testing.T, s Store, q StudentQuery, before func(page int)) []int {
+	t.Helper()
+	var ids []int
+	for page := 0; ; page++ {
+		if page > 10 {
+			t.Fatal("paging did not finish")
+		}
+		before(page)
+		students, _, more, err := s.List(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, stu := range students {
+			ids = append(ids, stu.ID)
+		}
+		if !more || len(students) == 0 {
+			return ids
+		}
+		// 与响应中的 NextCursor 相同，经过编码与解码
+		pos, err := decodeCursor(encodeCursor(q.position(&students[len(students)-1])))
+		if err != nil {
+			t.Fatal(err)
+		}
+		q.After = &pos
+	}
+}
+
+func TestListCursor(t *testing.T) {
+	minAverage := float32(80)
+	tests := []struct {
+		name string
+		q    StudentQuery
+		want []int
+	}{
+		{name: "id", q: StudentQuery{Sort: SortByID}, want: []int{1, 2, 3, 4, 5, 6}},
+		{name: "id descending", q: StudentQuery{Sort: SortByID, Desc: true}, want: []int{6, 5, 4, 3, 2, 1}},
+		{name: "name with ties by id", q: StudentQuery{Sort: SortByName}, want: []int{6, 3, 5, 1, 4, 2}},
+		{name: "name descending with ties by id", q: StudentQuery{Sort: SortByName, Desc: true}, want: []int{2, 1, 4, 5, 3, 6}},
+		{name: "average with ties by id", q: StudentQuery{Sort: SortByAverage}, want: []int{5, 4, 2, 6, 1, 3}},
+		{name: "average descending with ties by id", q: StudentQuery{Sort: SortByAverage, Desc: true}, want: []int{1, 3, 2, 6, 4, 5}},
+		{name: "filtered by name", q: StudentQuery{Sort: SortByName, Name: "lovelace"}, want: []int{1, 4}},
+		{name: "filtered by average", q: StudentQuery{Sort: SortByAverage, MinAverage: &minAverage}, want: []int{2, 6, 1, 3}},
+	}
+	s := listTestStore(t)
+	for _, tt := range tests {
+		for _, limit := range []int{1, 2, 4, 0} {
+			q := tt.q
+			q.Limit = limit
+			t.Run(fmt.Sprintf("%s/limit=%d", tt.name, limit), func(t *testing.T) {
+				if got := listAll(t, s, q, func(int) {}); !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("returned %v, want %v", got, tt.want)
+				}
+			})
+		}
+	}
+}
+
+func TestListCursorAfterChanges(t *testing.T) {
+	tests := []struct {
+		name string
+		q    StudentQuery
+		// 读取第二页之前执行的修改
+		change Op
+		want   []int
+	}{
+		{
+			name:   "the last student of the page is deleted",
+			q:      StudentQuery{Sort: SortByName, Limit: 2},
+			change: Op{Kind: OpDeleteStudent, StudentID: 3},
+			want:   []int{6, 3, 5, 1, 4, 2},
+		},
+		{
+			name:   "a student is added before the cursor",
+			q:      StudentQuery{Sort: SortByName, Limit: 2},
+			change: Op{Kind: OpCreateStudent, Student: &Student{FirstName: "Charles", LastName: "Babbage"}},
+			want:   []int{6, 3, 5, 1, 4, 2},
+		},
+		{
+			name:   "a student is added after the cursor",
+			q:      StudentQuery{Sort: SortByName, Limit: 2},
+			change: Op{Kind: OpCreateStudent, Student: &Student{FirstName: "John", LastName: "Backus", Grades: []Grade{grade(0, GradeQuiz, 60)}}},
+			want:   []int{6, 3, 5, 1, 4, 2},
+		},
+		{
+			name:   "a student moves past the cursor",
+			q:      StudentQuery{Sort: SortByAverage, Limit: 3},
+			change: Op{Kind: OpAddGrade, StudentID: 5, Grade: &Grade{Title: "Quiz", Type: GradeQuiz, Score: 100}},
+			want:   []int{5, 4, 2, 6, 1, 3, 5},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := listTestStore(t)
+			got := listAll(t, s, tt.q, func(page int) {
+				if page == 1 {
+					mustApply(t, s, tt.change)
+				}
+			})
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("returned %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStudentQueryCursor(t *testing.T) {
+	byName := encodeCursor(ListPosition{Sort: SortByName, ID: 3, Name: "hopper\x00grace"})
+	tests := []struct {
+		name    string
+		values  url.Values
+		wantErr bool
+	}{
+		{name: "cursor for the same order", values: url.Values{"sort": {"name"}, "cursor": {byName}}},
+		{name: "cursor for another order", values: url.Values{"sort": {"-name"}, "cursor": {byName}}, wantErr: true},
+		{name: "cursor for the default order", values: url.Values{"cursor": {byName}}, wantErr: true},
+		{name: "cursor with offset", values: url.Values{"sort": {"name"}, "cursor": {byName}, "offset": {"2"}}, wantErr: true},
+		{name: "invalid cursor", values: url.Values{"cursor": {"not a cursor"}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, _, err := studentQuery(tt.values)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("studentQuery() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && (q.After == nil || q.After.ID != 3) {
+				t.Errorf("studentQuery() After = %+v", q.After)
+			}
+		})
+	}
+}
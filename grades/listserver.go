@@ -0,0 +1,160 @@
+package grades
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// 每页学生数的默认值与上限
+const (
+	defaultListLimit = 50
+	maxListLimit     = 500
+)
+
+// StudentFields GET /students 可以选择的字段，Average 为所有成绩的平均分
+var StudentFields = []string{"ID", "FirstName", "LastName", "Grades", "Version", "Average"}
+
+// StudentList GET /students 的响应
+type StudentList struct {
+	// 一页中的学生，只包含 fields 参数选择的字段
+	Students []map[string]interface{}
+	// 满足过滤条件的学生数
+	Total  int
+	Limit  int
+	Offset int `json:",omitempty"`
+	// 下一页的游标，没有下一页时为空
+	NextCursor string `json:",omitempty"`
+}
+
+/**
+ * studentQuery
+ * @Description: 解析 GET /students 的查询参数
+ *
+ *	name={字符串}                 姓名包含的字符串，不区分大小写
+ *	course={id}                   选修了该课程的学生
+ *	min_average={分数}            平均分不低于该分数，不包括没有成绩的学生
+ *	max_average={分数}            平均分不高于该分数，不包括没有成绩的学生
+ *	sort=id|name|average          排序字段，前面加 - 时降序，默认为 id
+ *	limit={n}                     每页的学生数，默认为 50，最多 500
+ *	offset={n}                    跳过的学生数
+ *	cursor={游标}                 上一页响应中的 NextCursor，不能与 offset 同时使用
+ *	fields=ID,FirstName,...       返回的字段，默认为 StudentFields 中的所有字段
+ *
+ * @param values
+ * @return StudentQuery
+ * @return []string 返回的字段
+ * @return error
+ */
+func studentQuery(values url.Values) (StudentQuery, []string, error) {
+	q := StudentQuery{Name: strings.TrimSpace(values.Get("name")), Sort: SortByID, Limit: defaultListLimit}
+	var err error
+	if q.CourseID, err = intParam(values, "course"); err != nil {
+		return q, nil, err
+	}
+	for name, bound := range map[string]**float32{"min_average": &q.MinAverage, "max_average": &q.MaxAverage} {
+		if s := values.Get(name); s != "" {
+			v, err := strconv.ParseFloat(s, 32)
+			if err != nil {
+				return q, nil, fmt.Errorf("Invalid %s %q", name, s)
+			}
+			f := float32(v)
+			*bound = &f
+		}
+	}
+	if s := values.Get("sort"); s != "" {
+		q.Sort, q.Desc = strings.TrimPrefix(s, "-"), strings.HasPrefix(s, "-")
+		if q.Sort != SortByID && q.Sort != SortByName && q.Sort != SortByAverage {
+			return q, nil, fmt.Errorf("Invalid sort %q, expected id, name or average", s)
+		}
+	}
+	if values.Get("limit") != "" {
+		if q.Limit, err = intParam(values, "limit"); err != nil {
+			return q, nil, err
+		}
+		if q.Limit > maxListLimit {
+			q.Limit = maxListLimit
+		}
+	}
+	if s := values.Get("offset"); s != "" {
+		if q.Offset, err = strconv.Atoi(s); err != nil || q.Offset < 0 {
+			return q, nil, fmt.Errorf("Invalid offset %q", s)
+		}
+	}
+	if s := values.Get("cursor"); s != "" {
+		if values.Get("offset") != "" {
+			return q, nil, fmt.Errorf("Only one of cursor and offset can be used")
+		}
+		pos, err := decodeCursor(s)
+		if err != nil {
+			return q, nil, err
+		}
+		if pos.Sort != q.Sort || pos.Desc != q.Desc {
+			return q, nil, fmt.Errorf("The cursor was created for a different sort order")
+		}
+		q.After = &pos
+	}
+	fields := StudentFields
+	if s := values.Get("fields"); s != "" {
+		fields = nil
+		for _, f := range strings.Split(s, ",") {
+			f = strings.TrimSpace(f)
+			known := false
+			for _, name := range StudentFields {
+				known = known || name == f
+			}
+			if !known {
+				return q, nil, fmt.Errorf("Unknown field %q, expected some of %s", f, strings.Join(StudentFields, ", "))
+			}
+			fields = append(fields, f)
+		}
+	}
+	return q, fields, nil
+}
+
+// 学生中选择的字段
+func studentFields(stu *Student, fields []string) map[string]interface{} {
+	result := make(map[string]interface{}, len(fields))
+	for _, f := range fields {
+		switch f {
+		case "ID":
+			result[f] = stu.ID
+		case "FirstName":
+			result[f] = stu.FirstName
+		case "LastName":
+			result[f] = stu.LastName
+		case "Grades":
+			if stu.Grades == nil {
+				result[f] = []Grade{}
+			} else {
+				result[f] = stu.Grades
+			}
+		case "Version":
+			result[f] = stu.Version
+		case "Average":
+			result[f] = stu.Average()
+		}
+	}
+	return result
+}
+
+// 游标为学生在排序中位置的 JSON，使用 URL 安全的 base64 编码
+func encodeCursor(pos ListPosition) string {
+	data, _ := json.Marshal(pos)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(s string) (ListPosition, error) {
+	var pos ListPosition
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err == nil {
+		err = json.Unmarshal(data, &pos)
+	}
+	if err != nil {
+		return pos, fmt.Errorf("Invalid cursor %q", s)
+	}
+	return pos, nil
+}
@@ -0,0 +1,298 @@
+package grades
+
+import (
+	"fmt"
+	"sort"
+)
+
+// ScaleKind 最终分数换算为等级的方式
+type ScaleKind string
+
+const (
+	// ScaleLetter A–F 等级及对应的绩点
+	ScaleLetter ScaleKind = "Letter"
+	// ScalePassFail 通过或不通过
+	ScalePassFail ScaleKind = "PassFail"
+)
+
+// ScaleStep 等级制中的一档，分数不低于 Min 时得到该等级
+type ScaleStep struct {
+	Min    float32
+	Letter string
+	Points float32
+}
+
+// LetterScale 默认的 A–F 等级，绩点为 4 分制
+var LetterScale = []ScaleStep{
+	{Min: 90, Letter: "A", Points: 4},
+	{Min: 80, Letter: "B", Points: 3},
+	{Min: 70, Letter: "C", Points: 2},
+	{Min: 60, Letter: "D", Points: 1},
+	{Min: 0, Letter: "F", Points: 0},
+}
+
+// 通过制默认的及格线
+const defaultPassMark = 60
+
+// 成绩类别的计算顺序
+var gradeTypes = []GradeType{GradeQuiz, GradeTest, GradeExam}
+
+// Policy 课程的计分规则，零值为所有成绩等权平均，按 LetterScale 评级
+type Policy struct {
+	// 类别的权重，不必加起来等于 1，只在有成绩的类别之间归一化
+	// 为空时每条成绩等权；不为空时未列出的类别不计入
+	Weights map[GradeType]float32 `json:",omitempty"`
+	// 每个类别去掉最低的 N 条成绩，至少保留一条
+	DropLowest map[GradeType]int `json:",omitempty"`
+	// 额外加分的上限，额外加分的成绩直接加到最终分数上，为 0 时不限
+	ExtraCreditMax float32 `json:",omitempty"`
+	// 迟交每天扣除分数的百分比，以及最多扣除的百分比，上限为 0 时不限（最多 100）
+	LatePenaltyPerDay float32 `json:",omitempty"`
+	LatePenaltyMax    float32 `json:",omitempty"`
+	// 为空时使用 ScaleLetter
+	Scale ScaleKind `json:",omitempty"`
+	// 自定义的等级，按 Min 从高到低排列，为空时使用 LetterScale
+	Steps []ScaleStep `json:",omitempty"`
+	// 通过制的及格线，为 0 时使用 60
+	PassMark float32 `json:",omitempty"`
+}
+
+// Validate 检查计分规则，字段名以 prefix 开头
+func (p Policy) Validate(prefix string) []FieldError {
+	var errs []FieldError
+	add := func(field, message string) {
+		errs = append(errs, FieldError{Field: prefix + field, Message: message})
+	}
+	for t, w := range p.Weights {
+		if !t.Valid() {
+			add("Weights."+string(t), "is not a grade type")
+		} else if w < 0 {
+			add("Weights."+string(t), "must not be negative")
+		}
+	}
+	for t, n := range p.DropLowest {
+		if !t.Valid() {
+			add("DropLowest."+string(t), "is not a grade type")
+		} else if n < 0 {
+			add("DropLowest."+string(t), "must not be negative")
+		}
+	}
+	if p.ExtraCreditMax < 0 {
+		add("ExtraCreditMax", "must not be negative")
+	}
+	if p.LatePenaltyPerDay < 0 || p.LatePenaltyPerDay > 100 {
+		add("LatePenaltyPerDay", "must be between 0 and 100")
+	}
+	if p.LatePenaltyMax < 0 || p.LatePenaltyMax > 100 {
+		add("LatePenaltyMax", "must be between 0 and 100")
+	}
+	switch p.Scale {
+	case "", ScaleLetter, ScalePassFail:
+	default:
+		add("Scale", fmt.Sprintf("must be %s or %s", ScaleLetter, ScalePassFail))
+	}
+	for i, s := range p.Steps {
+		field := fmt.Sprintf("Steps[%d]", i)
+		if s.Letter == "" {
+			add(field+".Letter", "must not be empty")
+		}
+		if s.Min < 0 {
+			add(field+".Min", "must not be negative")
+		}
+		if i > 0 && s.Min >= p.Steps[i-1].Min {
+			add(field+".Min", "must be lower than the previous step")
+		}
+	}
+	if p.PassMark < 0 || p.PassMark > 100 {
+		add("PassMark", "must be between 0 and 100")
+	}
+	return errs
+}
+
+// CategoryResult 一个成绩类别的计算结果
+type CategoryResult struct {
+	Type GradeType
+	// 实际使用的权重，规则没有设置权重时为计入的成绩数
+	Weight float32
+	// 计入与去掉的成绩数
+	Grades  int
+	Dropped int
+	Average float32
+}
+
+// Result 按计分规则计算的结果
+type Result struct {
+	// 计入最终分数的成绩数，不含额外加分，为 0 时没有最终分数与等级
+	Grades     int
+	Categories []CategoryResult `json:",omitempty"`
+	// 被去掉的成绩的 ID
+	Dropped []int `json:",omitempty"`
+	// 迟交扣除的分数之和
+	LatePenalty float32 `json:",omitempty"`
+	// 计入的额外加分，已按上限截断
+	ExtraCredit float32 `json:",omitempty"`
+	Score       float32
+	// 等级与绩点，通过制只设置 Passed
+	Letter string  `json:",omitempty"`
+	Points float32 `json:",omitempty"`
+	Passed bool
+}
+
+// 扣除迟交分数后的分数
+func (p Policy) adjusted(g Grade) float32 {
+	if g.DaysLate <= 0 || p.LatePenaltyPerDay <= 0 {
+		return g.Score
+	}
+	penalty := float32(g.DaysLate) * p.LatePenaltyPerDay
+	if p.LatePenaltyMax > 0 && penalty > p.LatePenaltyMax {
+		penalty = p.LatePenaltyMax
+	}
+	if penalty > 100 {
+		penalty = 100
+	}
+	return g.Score * (1 - penalty/100)
+}
+
+/**
+ * Compute
+ * @Description: 按计分规则计算一组成绩的最终分数
+ * 依次扣除迟交分数、在每个类别中去掉最低的成绩、求类别平均分、按权重加权、加上额外加分，最后评级
+ * @param grades
+ * @return Result
+ */
+func (p Policy) Compute(grades []Grade) Result {
+	var result Result
+	byType := make(map[GradeType][]Grade)
+	var extra float32
+	for _, g := range grades {
+		score := p.adjusted(g)
+		result.LatePenalty += g.Score - score
+		g.Score = score
+		if g.ExtraCredit {
+			extra += score
+			continue
+		}
+		byType[g.Type] = append(byType[g.Type], g)
+	}
+	var total, weights float32
+	for _, t := range gradeTypes {
+		list := byType[t]
+		if len(list) == 0 {
+			continue
+		}
+		// 分数相同时先去掉 ID 较小的，保证结果稳定
+		sort.SliceStable(list, func(i, j int) bool {
+			if list[i].Score != list[j].Score {
+				return list[i].Score < list[j].Score
+			}
+			return list[i].ID < list[j].ID
+		})
+		drop := p.DropLowest[t]
+		if drop > len(list)-1 {
+			drop = len(list) - 1
+		}
+		for _, g := range list[:drop] {
+			result.Dropped = append(result.Dropped, g.ID)
+		}
+		list = list[drop:]
+		c := CategoryResult{Type: t, Grades: len(list), Dropped: drop}
+		for _, g := range list {
+			c.Average += g.Score
+		}
+		c.Average /= float32(len(list))
+		if len(p.Weights) == 0 {
+			// 按成绩数加权，与所有成绩直接平均相同
+			c.Weight = float32(len(list))
+		} else {
+			c.Weight = p.Weights[t]
+		}
+		result.Categories = append(result.Categories, c)
+		if c.Weight > 0 {
+			total += c.Average * c.Weight
+			weights += c.Weight
+			result.Grades += c.Grades
+		}
+	}
+	if result.Grades == 0 {
+		return result
+	}
+	if p.ExtraCreditMax > 0 && extra > p.ExtraCreditMax {
+		extra = p.ExtraCreditMax
+	}
+	result.ExtraCredit = extra
+	result.Score = total/weights + extra
+	p.grade(&result)
+	return result
+}
+
+// 按等级制设置等级、绩点与是否通过
+func (p Policy) grade(result *Result) {
+	if p.Scale == ScalePassFail {
+		mark := p.PassMark
+		if mark == 0 {
+			mark = defaultPassMark
+		}
+		result.Passed = result.Score >= mark
+		return
+	}
+	steps := p.Steps
+	if len(steps) == 0 {
+		steps = LetterScale
+	}
+	// 低于所有档位时使用最低的一档
+	step := steps[len(steps)-1]
+	for _, s := range steps {
+		if result.Score >= s.Min {
+			step = s
+			break
+		}
+	}
+	result.Letter, result.Points = step.Letter, step.Points
+	result.Passed = step.Points > 0
+}
+
+// CourseSummary 学生在一个教学班中按课程计分规则计算的结果
+type CourseSummary struct {
+	EnrollmentID int
+	Course       Course
+	Section      Section
+	Term         Term
+	Result
+}
+
+// Summary 学生的成绩汇总
+type Summary struct {
+	StudentID int
+	// 所有成绩按默认规则计算
+	Overall Result
+	Courses []CourseSummary
+}
+
+// Summary 计算学生的成绩汇总，每门课程只使用关联到该课程选课记录的成绩
+func (c *Catalog) Summary(stu Student) Summary {
+	summary := Summary{
+		StudentID: stu.ID,
+		Overall:   Policy{}.Compute(stu.Grades),
+		Courses:   make([]CourseSummary, 0),
+	}
+	for _, avg := range c.CourseAverages(stu) {
+		var grades []Grade
+		for _, g := range stu.Grades {
+			if g.EnrollmentID == avg.EnrollmentID {
+				grades = append(grades, g)
+			}
+		}
+		var policy Policy
+		if avg.Course.Policy != nil {
+			policy = *avg.Course.Policy
+		}
+		summary.Courses = append(summary.Courses, CourseSummary{
+			EnrollmentID: avg.EnrollmentID,
+			Course:       avg.Course,
+			Section:      avg.Section,
+			Term:         avg.Term,
+			Result:       policy.Compute(grades),
+		})
+	}
+	return summary
+}
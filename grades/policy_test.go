@@ -0,0 +1,303 @@
+package grades
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func grade(id int, t GradeType, score float32) Grade {
+	return Grade{ID: id, Title: string(t), Type: t, Score: score}
+}
+
+func lateBy(g Grade, days int) Grade {
+	g.DaysLate = days
+	return g
+}
+
+func extraCredit(g Grade) Grade {
+	g.ExtraCredit = true
+	return g
+}
+
+func near(a, b float32) bool {
+	return math.Abs(float64(a-b)) < 1e-4
+}
+
+func TestPolicyCompute(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy Policy
+		grades []Grade
+		// 不比较 Categories，由 TestPolicyComputeCategories 检查
+		want Result
+	}{
+		{
+			name: "no grades",
+		},
+		{
+			name:   "only extra credit",
+			grades: []Grade{extraCredit(grade(1, GradeQuiz, 5)), extraCredit(grade(2, GradeExam, 3))},
+		},
+		{
+			name:   "all weights zero",
+			policy: Policy{Weights: map[GradeType]float32{GradeQuiz: 0, GradeExam: 0}},
+			grades: []Grade{grade(1, GradeQuiz, 80), grade(2, GradeExam, 90)},
+		},
+		{
+			name:   "equal weights by default",
+			grades: []Grade{grade(1, GradeQuiz, 70), grade(2, GradeQuiz, 80), grade(3, GradeExam, 90)},
+			want:   Result{Grades: 3, Score: 80, Letter: "B", Points: 3, Passed: true},
+		},
+		{
+			name:   "weighted categories",
+			policy: Policy{Weights: map[GradeType]float32{GradeQuiz: 1, GradeExam: 3}},
+			grades: []Grade{grade(1, GradeQuiz, 60), grade(2, GradeExam, 100)},
+			want:   Result{Grades: 2, Score: 90, Letter: "A", Points: 4, Passed: true},
+		},
+		{
+			name:   "unweighted category is left out",
+			policy: Policy{Weights: map[GradeType]float32{GradeExam: 1}},
+			grades: []Grade{grade(1, GradeQuiz, 10), grade(2, GradeExam, 85)},
+			want:   Result{Grades: 1, Score: 85, Letter: "B", Points: 3, Passed: true},
+		},
+		{
+			name:   "drop lowest",
+			policy: Policy{DropLowest: map[GradeType]int{GradeQuiz: 1}},
+			grades: []Grade{grade(1, GradeQuiz, 50), grade(2, GradeQuiz, 70), grade(3, GradeQuiz, 90)},
+			want:   Result{Grades: 2, Dropped: []int{1}, Score: 80, Letter: "B", Points: 3, Passed: true},
+		},
+		{
+			name:   "drop lowest equal to the number of grades keeps one",
+			policy: Policy{DropLowest: map[GradeType]int{GradeQuiz: 1}},
+			grades: []Grade{grade(1, GradeQuiz, 40)},
+			want:   Result{Grades: 1, Score: 40, Letter: "F"},
+		},
+		{
+			name:   "drop lowest greater than the number of grades keeps the highest",
+			policy: Policy{DropLowest: map[GradeType]int{GradeQuiz: 5}},
+			grades: []Grade{grade(1, GradeQuiz, 90), grade(2, GradeQuiz, 50), grade(3, GradeQuiz, 70)},
+			want:   Result{Grades: 1, Dropped: []int{2, 3}, Score: 90, Letter: "A", Points: 4, Passed: true},
+		},
+		{
+			name:   "drop lowest ties drop the lower ID",
+			policy: Policy{DropLowest: map[GradeType]int{GradeQuiz: 1}},
+			grades: []Grade{grade(2, GradeQuiz, 70), grade(1, GradeQuiz, 70), grade(3, GradeQuiz, 90)},
+			want:   Result{Grades: 2, Dropped: []int{1}, Score: 80, Letter: "B", Points: 3, Passed: true},
+		},
+		{
+			name:   "late penalty per day",
+			policy: Policy{LatePenaltyPerDay: 10},
+			grades: []Grade{lateBy(grade(1, GradeQuiz, 80), 2)},
+			want:   Result{Grades: 1, LatePenalty: 16, Score: 64, Letter: "D", Points: 1, Passed: true},
+		},
+		{
+			name:   "late penalty capped by LatePenaltyMax",
+			policy: Policy{LatePenaltyPerDay: 10, LatePenaltyMax: 25},
+			grades: []Grade{lateBy(grade(1, GradeQuiz, 80), 5)},
+			want:   Result{Grades: 1, LatePenalty: 20, Score: 60, Letter: "D", Points: 1, Passed: true},
+		},
+		{
+			name:   "late penalty never exceeds the score",
+			policy: Policy{LatePenaltyPerDay: 30},
+			grades: []Grade{lateBy(grade(1, GradeQuiz, 80), 10)},
+			want:   Result{Grades: 1, LatePenalty: 80, Score: 0, Letter: "F"},
+		},
+		{
+			name:   "extra credit is added after averaging",
+			grades: []Grade{grade(1, GradeQuiz, 70), grade(2, GradeQuiz, 80), extraCredit(grade(3, GradeQuiz, 4))},
+			want:   Result{Grades: 2, ExtraCredit: 4, Score: 79, Letter: "C", Points: 2, Passed: true},
+		},
+		{
+			name:   "extra credit capped by ExtraCreditMax",
+			policy: Policy{ExtraCreditMax: 5},
+			grades: []Grade{grade(1, GradeQuiz, 80), extraCredit(grade(2, GradeQuiz, 6)), extraCredit(grade(3, GradeQuiz, 2))},
+			want:   Result{Grades: 1, ExtraCredit: 5, Score: 85, Letter: "B", Points: 3, Passed: true},
+		},
+		{
+			name: "score below every custom step uses the lowest step",
+			policy: Policy{Steps: []ScaleStep{
+				{Min: 85, Letter: "H", Points: 3},
+				{Min: 50, Letter: "P", Points: 1},
+			}},
+			grades: []Grade{grade(1, GradeQuiz, 30)},
+			want:   Result{Grades: 1, Score: 30, Letter: "P", Points: 1, Passed: true},
+		},
+		{
+			name:   "pass/fail with the default pass mark",
+			policy: Policy{Scale: ScalePassFail},
+			grades: []Grade{grade(1, GradeQuiz, 60)},
+			want:   Result{Grades: 1, Score: 60, Passed: true},
+		},
+		{
+			name:   "pass/fail below the default pass mark",
+			policy: Policy{Scale: ScalePassFail},
+			grades: []Grade{grade(1, GradeQuiz, 59.5)},
+			want:   Result{Grades: 1, Score: 59.5},
+		},
+		{
+			name:   "pass/fail below a custom pass mark",
+			policy: Policy{Scale: ScalePassFail, PassMark: 75},
+			grades: []Grade{grade(1, GradeQuiz, 70)},
+			want:   Result{Grades: 1, Score: 70},
+		},
+		{
+			name:   "pass/fail above a custom pass mark",
+			policy: Policy{Scale: ScalePassFail, PassMark: 50},
+			grades: []Grade{grade(1, GradeQuiz, 55)},
+			want:   Result{Grades: 1, Score: 55, Passed: true},
+		},
+	}
+	for _, tt := range tests {
+		got := tt.policy.Compute(tt.grades)
+		if got.Grades != tt.want.Grades || !near(got.Score, tt.want.Score) ||
+			!near(got.LatePenalty, tt.want.LatePenalty) || !near(got.ExtraCredit, tt.want.ExtraCredit) ||
+			got.Letter != tt.want.Letter || got.Points != tt.want.Points || got.Passed != tt.want.Passed ||
+			!reflect.DeepEqual(got.Dropped, tt.want.Dropped) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+		if math.IsNaN(float64(got.Score)) {
+			t.Errorf("%s: score is NaN", tt.name)
+		}
+	}
+}
+
+func TestPolicyComputeCategories(t *testing.T) {
+	p := Policy{Weights: map[GradeType]float32{GradeQuiz: 0, GradeExam: 2}, DropLowest: map[GradeType]int{GradeExam: 1}}
+	got := p.Compute([]Grade{grade(1, GradeQuiz, 80), grade(2, GradeExam, 60), grade(3, GradeExam, 90)})
+	want := []CategoryResult{
+		{Type: GradeQuiz, Weight: 0, Grades: 1, Average: 80},
+		{Type: GradeExam, Weight: 2, Grades: 1, Dropped: 1, Average: 90},
+	}
+	if !reflect.DeepEqual(got.Categories, want) {
+		t.Errorf("got %+v, want %+v", got.Categories, want)
+	}
+	// 权重为 0 的类别列出但不计入
+	if got.Grades != 1 || got.Score != 90 {
+		t.Errorf("got %d grades and score %v, want 1 and 90", got.Grades, got.Score)
+	}
+}
+
+func TestPolicyValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy Policy
+		fields []string
+	}{
+		{name: "zero value"},
+		{
+			name: "negative values",
+			policy: Policy{
+				Weights:        map[GradeType]float32{GradeQuiz: -1},
+				DropLowest:     map[GradeType]int{GradeExam: -1},
+				ExtraCreditMax: -1,
+			},
+			fields: []string{"Policy.Weights.Quiz", "Policy.DropLowest.Exam", "Policy.ExtraCreditMax"},
+		},
+		{
+			name:   "unknown grade type",
+			policy: Policy{Weights: map[GradeType]float32{"Homework": 1}},
+			fields: []string{"Policy.Weights.Homework"},
+		},
+		{
+			name:   "percentages out of range",
+			policy: Policy{LatePenaltyPerDay: 101, LatePenaltyMax: -1, PassMark: 120},
+			fields: []string{"Policy.LatePenaltyPerDay", "Policy.LatePenaltyMax", "Policy.PassMark"},
+		},
+		{
+			name:   "unknown scale",
+			policy: Policy{Scale: "Stars"},
+			fields: []string{"Policy.Scale"},
+		},
+		{
+			name:   "steps not descending",
+			policy: Policy{Steps: []ScaleStep{{Min: 50, Letter: "P"}, {Min: 50, Letter: ""}}},
+			fields: []string{"Policy.Steps[1].Letter", "Policy.Steps[1].Min"},
+		},
+	}
+	for _, tt := range tests {
+		var fields []string
+		for _, e := range tt.policy.Validate("Policy.") {
+			fields = append(fields, e.Field)
+		}
+		if !reflect.DeepEqual(fields, tt.fields) {
+			t.Errorf("%s: got errors for %v, want %v", tt.name, fields, tt.fields)
+		}
+	}
+}
+
+func TestCatalogSummary(t *testing.T) {
+	catalog := Catalog{
+		Terms: []Term{{ID: 1, Name: "Fall"}},
+		Courses: []Course{
+			{ID: 1, Code: "CS101", Title: "Programming", Policy: &Policy{Scale: ScalePassFail}},
+			{ID: 2, Code: "MA101", Title: "Calculus"},
+			{ID: 3, Code: "PH101", Title: "Physics"},
+		},
+		Sections: []Section{
+			{ID: 1, CourseID: 1, TermID: 1, Name: "A"},
+			{ID: 2, CourseID: 2, TermID: 1, Name: "A"},
+			{ID: 3, CourseID: 3, TermID: 1, Name: "A"},
+		},
+		Enrollments: []Enrollment{
+			{ID: 1, StudentID: 1, SectionID: 1},
+			{ID: 2, StudentID: 1, SectionID: 2},
+			{ID: 3, StudentID: 2, SectionID: 1},
+			{ID: 4, StudentID: 1, SectionID: 3},
+		},
+	}
+	stu := Student{ID: 1, Grades: []Grade{
+		{ID: 1, Type: GradeQuiz, Score: 70, EnrollmentID: 1},
+		{ID: 2, Type: GradeExam, Score: 95, EnrollmentID: 2},
+		{ID: 3, Type: GradeTest, Score: 40},
+	}}
+
+	summary := catalog.Summary(stu)
+	if summary.StudentID != 1 {
+		t.Errorf("got student %d, want 1", summary.StudentID)
+	}
+	// 所有成绩按默认规则计算，包括不属于任何课程的成绩
+	if summary.Overall.Grades != 3 || !near(summary.Overall.Score, 205.0/3) || summary.Overall.Letter != "D" {
+		t.Errorf("got overall %+v, want 3 grades, score 68.33 and D", summary.Overall)
+	}
+	if len(summary.Courses) != 3 {
+		t.Fatalf("got %d courses, want 3", len(summary.Courses))
+	}
+	byCourse := make(map[int]CourseSummary)
+	for _, c := range summary.Courses {
+		byCourse[c.Course.ID] = c
+	}
+	// 通过制的课程只设置 Passed
+	if c := byCourse[1]; c.EnrollmentID != 1 || c.Grades != 1 || c.Score != 70 || !c.Passed || c.Letter != "" {
+		t.Errorf("got %+v for the pass/fail course", c)
+	}
+	if c := byCourse[2]; c.EnrollmentID != 2 || c.Grades != 1 || c.Score != 95 || c.Letter != "A" || c.Term.Name != "Fall" {
+		t.Errorf("got %+v for the default course", c)
+	}
+	// 没有成绩的课程没有分数与等级
+	if c := byCourse[3]; c.Grades != 0 || c.Score != 0 || c.Letter != "" || c.Passed {
+		t.Errorf("got %+v for the course without grades", c)
+	}
+
+	if summary := catalog.Summary(Student{ID: 3}); len(summary.Courses) != 0 || summary.Overall.Grades != 0 {
+		t.Errorf("got %+v for a student without enrollments", summary)
+	}
+}
+
+func TestStudentAverage(t *testing.T) {
+	tests := []struct {
+		name   string
+		grades []Grade
+		want   float32
+	}{
+		{name: "no grades", want: 0},
+		{name: "one grade", grades: []Grade{grade(1, GradeQuiz, 75)}, want: 75},
+		{name: "several grades", grades: []Grade{grade(1, GradeQuiz, 70), grade(2, GradeExam, 85), grade(3, GradeTest, 90)}, want: 245.0 / 3},
+	}
+	for _, tt := range tests {
+		got := Student{Grades: tt.grades}.Average()
+		if math.IsNaN(float64(got)) || !near(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
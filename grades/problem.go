@@ -0,0 +1,62 @@
+package grades
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Problem RFC 7807 的错误描述，成绩服务的错误响应均使用该格式
+// 字段名按 RFC 使用小写
+type Problem struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+	// 校验失败的字段
+	Errors []FieldError `json:"errors,omitempty"`
+}
+
+// FieldError 单个字段的校验错误
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// 写入 application/problem+json 响应，type 使用 about:blank，title 为状态码的描述
+func writeProblem(w http.ResponseWriter, r *http.Request, status int, detail string, errs ...FieldError) {
+	p := Problem{
+		Type:     "about:blank",
+		Title:    http.StatusText(status),
+		Status:   status,
+		Detail:   detail,
+		Instance: r.URL.Path,
+		Errors:   errs,
+	}
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(p)
+}
+
+/**
+ * route
+ * @Description: 按请求方法分发，不支持的方法返回 405，并在 Allow 请求头中列出支持的方法
+ * @param w
+ * @param r
+ * @param handlers 请求方法到处理函数
+ */
+func route(w http.ResponseWriter, r *http.Request, handlers map[string]func()) {
+	if h, ok := handlers[r.Method]; ok {
+		h()
+		return
+	}
+	methods := make([]string, 0, len(handlers))
+	for m := range handlers {
+		methods = append(methods, m)
+	}
+	sort.Strings(methods)
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeProblem(w, r, http.StatusMethodNotAllowed, "Method "+r.Method+" is not supported on this resource")
+}
@@ -1,135 +1,590 @@
 package grades
 
 import (
+	"Distribute/log"
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"net"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 )
 
 func RegisterHandlers() {
 	//handler := new(studentsHandler)
 	http.Handle("/students", studentsHandler{})
 	http.Handle("/students/", studentsHandler{})
+	for _, res := range catalogResources {
+		http.Handle("/"+res.path, catalogHandler{res: res})
+		http.Handle("/"+res.path+"/", catalogHandler{res: res})
+	}
+	http.HandleFunc("/import", importHandler)
+	http.HandleFunc("/history", historyHandler)
+	http.HandleFunc("/stats", statsHandler)
+	http.HandleFunc("/stats/", statsHandler)
 }
 
 type studentsHandler struct{}
 
-//	/students
+//	GET    /students                     学生列表，返回 StudentList，支持过滤、排序与分页，参数见 studentQuery
+//	                                     /students/ 与 /students 相同
+//	POST   /students                     新增学生，ID 由服务分配
+//	GET    /students/{id}                单个学生，as_of={RFC 3339 时间} 时为该时刻的状态
+//	PUT    /students/{id}                修改学生的姓名
+//	PATCH  /students/{id}                修改学生的部分字段
+//	DELETE /students/{id}                删除学生
+//	GET    /students/{id}/courses        学生选修的课程及每门课程的平均分
+//	GET    /students/{id}/summary        按课程计分规则计算的最终分数与等级
+//	GET    /students/{id}/rank           学生的总排名及在每门课程中的排名
+//	GET    /students/{id}/history        学生及其成绩、选课记录的所有修改
+//	GET    /students/{id}/grades         学生的所有成绩，同样支持 as_of
+//	POST   /students/{id}/grades         为学生追加成绩，ID 由服务分配
+//	GET    /students/{id}/grades/{gid}   单条成绩
+//	PUT    /students/{id}/grades/{gid}   修改成绩
+//	PATCH  /students/{id}/grades/{gid}   修改成绩的部分字段
+//	DELETE /students/{id}/grades/{gid}   删除成绩
 //
-// /students/{id}
-// /students/{id}/grades
-// 正常处理可以使用正则表达式或对应的包接收url的参数，此处使用简单逻辑，作为演示使用
+// 错误以 application/problem+json 返回，不支持的方法返回 405
+// 学生与单条成绩的响应带有 ETag，修改与删除时可以通过 If-Match 指定期望的 ETag，不一致时返回 412
 func (sh studentsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	splitPath := strings.Split(r.URL.Path, "/")
-	//fmt.Println("splitpath = ", len(splitPath))
+	if len(splitPath) == 3 && splitPath[2] == "" {
+		splitPath = splitPath[:2]
+	}
 	switch len(splitPath) {
 	case 2:
-		//fmt.Println("===========")
-		sh.getAll(w, r)
+		route(w, r, map[string]func(){
+			http.MethodGet:  func() { sh.getAll(w, r) },
+			http.MethodPost: func() { sh.create(w, r) },
+		})
 	case 3:
 		id, err := strconv.Atoi(splitPath[2])
 		if err != nil {
-			w.WriteHeader(http.StatusNotFound)
+			writeProblem(w, r, http.StatusNotFound, fmt.Sprintf("Invalid student Id %q", splitPath[2]))
 			return
 		}
-		sh.getOne(w, r, id)
+		route(w, r, map[string]func(){
+			http.MethodGet:    func() { sh.getOne(w, r, id) },
+			http.MethodPut:    func() { sh.update(w, r, id) },
+			http.MethodPatch:  func() { sh.patch(w, r, id) },
+			http.MethodDelete: func() { sh.remove(w, r, id) },
+		})
 	case 4:
 		id, err := strconv.Atoi(splitPath[2])
 		if err != nil {
-			w.WriteHeader(http.StatusNotFound)
+			writeProblem(w, r, http.StatusNotFound, "")
+			return
+		}
+		switch splitPath[3] {
+		case "courses":
+			route(w, r, map[string]func(){
+				http.MethodGet: func() { sh.getCourses(w, r, id) },
+			})
+		case "rank":
+			route(w, r, map[string]func(){
+				http.MethodGet: func() { sh.getRank(w, r, id) },
+			})
+		case "history":
+			route(w, r, map[string]func(){
+				http.MethodGet: func() { sh.getHistory(w, r, id) },
+			})
+		case "summary":
+			route(w, r, map[string]func(){
+				http.MethodGet: func() { sh.getSummary(w, r, id) },
+			})
+		case "grades":
+			route(w, r, map[string]func(){
+				http.MethodGet:  func() { sh.getGrades(w, r, id) },
+				http.MethodPost: func() { sh.addGrade(w, r, id) },
+			})
+		default:
+			writeProblem(w, r, http.StatusNotFound, "")
+		}
+	case 5:
+		id, err := strconv.Atoi(splitPath[2])
+		if err != nil || splitPath[3] != "grades" {
+			writeProblem(w, r, http.StatusNotFound, "")
+			return
+		}
+		gradeID, err := strconv.Atoi(splitPath[4])
+		if err != nil {
+			writeProblem(w, r, http.StatusNotFound, fmt.Sprintf("Invalid grade Id %q", splitPath[4]))
 			return
 		}
-		fmt.Println("==========")
-		sh.addGrade(w, r, id)
+		route(w, r, map[string]func(){
+			http.MethodGet:    func() { sh.getGrade(w, r, id, gradeID) },
+			http.MethodPut:    func() { sh.updateGrade(w, r, id, gradeID) },
+			http.MethodPatch:  func() { sh.patchGrade(w, r, id, gradeID) },
+			http.MethodDelete: func() { sh.removeGrade(w, r, id, gradeID) },
+		})
 	default:
-		w.WriteHeader(http.StatusNotFound)
+		writeProblem(w, r, http.StatusNotFound, "")
 	}
 }
 
 func (sh studentsHandler) getAll(w http.ResponseWriter, r *http.Request) {
-	studentsMutex.Lock()
-	defer studentsMutex.Unlock()
-	data, err := sh.toJson(students)
+	q, fields, err := studentQuery(r.URL.Query())
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		log.Printf("Failed to serialize students : %s", err)
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
 		return
 	}
-	w.Header().Add("Content-Type", "application/json")
-	_, _ = w.Write(data)
+	students, total, more, err := db.List(q)
+	if err != nil {
+		storeError(w, r, err)
+		return
+	}
+	list := StudentList{
+		Students: make([]map[string]interface{}, 0, len(students)),
+		Total:    total,
+		Limit:    q.Limit,
+		Offset:   q.Offset,
+	}
+	for i := range students {
+		list.Students = append(list.Students, studentFields(&students[i], fields))
+	}
+	if more && len(students) > 0 {
+		list.NextCursor = encodeCursor(q.position(&students[len(students)-1]))
+	}
+	writeJson(w, r, http.StatusOK, list)
 }
 
 func (sh studentsHandler) getOne(w http.ResponseWriter, r *http.Request, id int) {
-	studentsMutex.Lock()
-	defer studentsMutex.Unlock()
-
 	// 根据 id 获取对应的内容
-	student, err := students.GetById(id)
+	at, ok := asOf(w, r)
+	if !ok {
+		return
+	}
+	student, err := findStudent(id, at)
 	if err != nil {
-		w.WriteHeader(http.StatusNotFound)
-		log.Printf("Failed to serialize students : %s", err)
+		storeError(w, r, err)
 		return
 	}
+	// 过去的状态不能用于 If-Match
+	if at.IsZero() {
+		w.Header().Set("ETag", etag(student.Version))
+	}
+	writeJson(w, r, http.StatusOK, student)
+}
 
-	data, err := sh.toJson(student)
+func (sh studentsHandler) create(w http.ResponseWriter, r *http.Request) {
+	var student Student
+	if !decodeBody(w, r, &student) {
+		return
+	}
+	errs := student.Validate()
+	if student.ID != 0 {
+		errs = append(errs, FieldError{Field: "ID", Message: "is assigned by the server"})
+	}
+	if len(errs) > 0 {
+		writeProblem(w, r, http.StatusUnprocessableEntity, "The student is invalid", errs...)
+		return
+	}
+	if err := apply(r, Op{Kind: OpCreateStudent, Student: &student}); err != nil {
+		storeError(w, r, err)
+		return
+	}
+	log.Infof(r.Context(), "Created student %d", student.ID)
+	w.Header().Set("Location", fmt.Sprintf("/students/%d", student.ID))
+	w.Header().Set("ETag", etag(student.Version))
+	writeJson(w, r, http.StatusCreated, student)
+}
+
+// 只修改姓名，成绩通过 /students/{id}/grades 修改
+func (sh studentsHandler) update(w http.ResponseWriter, r *http.Request, id int) {
+	var student Student
+	if !decodeBody(w, r, &student) {
+		return
+	}
+	errs := student.Validate()
+	if student.ID != 0 && student.ID != id {
+		errs = append(errs, FieldError{Field: "ID", Message: "does not match the URL"})
+	}
+	if student.Grades != nil {
+		errs = append(errs, FieldError{Field: "Grades", Message: "are managed through /students/{id}/grades"})
+	}
+	if len(errs) > 0 {
+		writeProblem(w, r, http.StatusUnprocessableEntity, "The student is invalid", errs...)
+		return
+	}
+	current, err := db.Student(id)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		log.Println(err)
+		storeError(w, r, err)
 		return
 	}
-	w.Header().Add("Content-Type", "application/json")
-	_, _ = w.Write(data)
+	version, ok := ifMatch(w, r, current.Version)
+	if !ok {
+		return
+	}
+	sh.save(w, r, id, student, version)
+}
+
+// PATCH 的请求体，未出现的字段保持不变
+type studentPatch struct {
+	FirstName *string
+	LastName  *string
+}
+
+func (sh studentsHandler) patch(w http.ResponseWriter, r *http.Request, id int) {
+	var p studentPatch
+	if !decodeBody(w, r, &p) {
+		return
+	}
+	student, err := db.Student(id)
+	if err != nil {
+		storeError(w, r, err)
+		return
+	}
+	if _, ok := ifMatch(w, r, student.Version); !ok {
+		return
+	}
+	if p.FirstName != nil {
+		student.FirstName = *p.FirstName
+	}
+	if p.LastName != nil {
+		student.LastName = *p.LastName
+	}
+	if errs := student.Validate(); len(errs) > 0 {
+		writeProblem(w, r, http.StatusUnprocessableEntity, "The student is invalid", errs...)
+		return
+	}
+	// 修改基于读取到的版本，期间被其他请求修改时返回 412，避免覆盖其他字段的修改
+	sh.save(w, r, id, student, student.Version)
+}
+
+// 保存修改后的姓名，返回修改后的学生，version 为期望的版本
+func (sh studentsHandler) save(w http.ResponseWriter, r *http.Request, id int, student Student, version int) {
+	if err := apply(r, Op{Kind: OpUpdateStudent, StudentID: id, Student: &student, Version: version}); err != nil {
+		storeError(w, r, err)
+		return
+	}
+	updated, err := db.Student(id)
+	if err != nil {
+		storeError(w, r, err)
+		return
+	}
+	w.Header().Set("ETag", etag(updated.Version))
+	writeJson(w, r, http.StatusOK, updated)
+}
+
+func (sh studentsHandler) remove(w http.ResponseWriter, r *http.Request, id int) {
+	current, err := db.Student(id)
+	if err != nil {
+		storeError(w, r, err)
+		return
+	}
+	version, ok := ifMatch(w, r, current.Version)
+	if !ok {
+		return
+	}
+	if err := apply(r, Op{Kind: OpDeleteStudent, StudentID: id, Version: version}); err != nil {
+		storeError(w, r, err)
+		return
+	}
+	log.Infof(r.Context(), "Deleted student %d", id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (sh studentsHandler) getCourses(w http.ResponseWriter, r *http.Request, id int) {
+	student, err := db.Student(id)
+	if err != nil {
+		storeError(w, r, err)
+		return
+	}
+	catalog, err := db.Catalog()
+	if err != nil {
+		storeError(w, r, err)
+		return
+	}
+	writeJson(w, r, http.StatusOK, catalog.CourseAverages(student))
+}
+
+func (sh studentsHandler) getSummary(w http.ResponseWriter, r *http.Request, id int) {
+	student, err := db.Student(id)
+	if err != nil {
+		storeError(w, r, err)
+		return
+	}
+	catalog, err := db.Catalog()
+	if err != nil {
+		storeError(w, r, err)
+		return
+	}
+	writeJson(w, r, http.StatusOK, catalog.Summary(student))
+}
+
+func (sh studentsHandler) getGrades(w http.ResponseWriter, r *http.Request, id int) {
+	at, ok := asOf(w, r)
+	if !ok {
+		return
+	}
+	student, err := findStudent(id, at)
+	if err != nil {
+		storeError(w, r, err)
+		return
+	}
+	if student.Grades == nil {
+		student.Grades = []Grade{}
+	}
+	writeJson(w, r, http.StatusOK, student.Grades)
 }
 
 func (sh studentsHandler) addGrade(w http.ResponseWriter, r *http.Request, id int) {
-	studentsMutex.Lock()
-	defer studentsMutex.Unlock()
+	var g Grade
+	if !decodeBody(w, r, &g) {
+		return
+	}
+	errs := g.Validate()
+	if g.ID != 0 {
+		errs = append(errs, FieldError{Field: "ID", Message: "is assigned by the server"})
+	}
+	if len(errs) > 0 {
+		writeProblem(w, r, http.StatusUnprocessableEntity, "The grade is invalid", errs...)
+		return
+	}
+	if err := apply(r, Op{Kind: OpAddGrade, StudentID: id, Grade: &g}); err != nil {
+		storeError(w, r, err)
+		return
+	}
+	w.Header().Set("Location", fmt.Sprintf("/students/%d/grades/%d", id, g.ID))
+	w.Header().Set("ETag", etag(g.Version))
+	writeJson(w, r, http.StatusCreated, g)
+}
 
-	// 根据 id 获取对应的内容
-	student, err := students.GetById(id)
-	fmt.Println("student = ", student)
+// 学生的某条成绩
+func findGrade(id, gradeID int) (Grade, error) {
+	student, err := db.Student(id)
+	if err != nil {
+		return Grade{}, err
+	}
+	g, err := student.GradeById(gradeID)
+	if err != nil {
+		return Grade{}, err
+	}
+	return *g, nil
+}
+
+func (sh studentsHandler) getGrade(w http.ResponseWriter, r *http.Request, id, gradeID int) {
+	g, err := findGrade(id, gradeID)
 	if err != nil {
-		w.WriteHeader(http.StatusNotFound)
-		log.Printf("Failed to serialize students : %s", err)
+		storeError(w, r, err)
 		return
 	}
+	w.Header().Set("ETag", etag(g.Version))
+	writeJson(w, r, http.StatusOK, g)
+}
 
+func (sh studentsHandler) updateGrade(w http.ResponseWriter, r *http.Request, id, gradeID int) {
 	var g Grade
+	if !decodeBody(w, r, &g) {
+		return
+	}
+	errs := g.Validate()
+	if g.ID != 0 && g.ID != gradeID {
+		errs = append(errs, FieldError{Field: "ID", Message: "does not match the URL"})
+	}
+	if len(errs) > 0 {
+		writeProblem(w, r, http.StatusUnprocessableEntity, "The grade is invalid", errs...)
+		return
+	}
+	current, err := findGrade(id, gradeID)
+	if err != nil {
+		storeError(w, r, err)
+		return
+	}
+	version, ok := ifMatch(w, r, current.Version)
+	if !ok {
+		return
+	}
+	sh.saveGrade(w, r, id, gradeID, g, version)
+}
+
+// PATCH 的请求体，未出现的字段保持不变
+type gradePatch struct {
+	Title        *string
+	Type         *GradeType
+	Score        *float32
+	EnrollmentID *int
+	DaysLate     *int
+	ExtraCredit  *bool
+}
+
+func (sh studentsHandler) patchGrade(w http.ResponseWriter, r *http.Request, id, gradeID int) {
+	var p gradePatch
+	if !decodeBody(w, r, &p) {
+		return
+	}
+	g, err := findGrade(id, gradeID)
+	if err != nil {
+		storeError(w, r, err)
+		return
+	}
+	if _, ok := ifMatch(w, r, g.Version); !ok {
+		return
+	}
+	if p.Title != nil {
+		g.Title = *p.Title
+	}
+	if p.Type != nil {
+		g.Type = *p.Type
+	}
+	if p.Score != nil {
+		g.Score = *p.Score
+	}
+	if p.EnrollmentID != nil {
+		g.EnrollmentID = *p.EnrollmentID
+	}
+	if p.DaysLate != nil {
+		g.DaysLate = *p.DaysLate
+	}
+	if p.ExtraCredit != nil {
+		g.ExtraCredit = *p.ExtraCredit
+	}
+	if errs := g.Validate(); len(errs) > 0 {
+		writeProblem(w, r, http.StatusUnprocessableEntity, "The grade is invalid", errs...)
+		return
+	}
+	sh.saveGrade(w, r, id, gradeID, g, g.Version)
+}
+
+// 保存修改后的成绩，创建时间保持不变，修改时间与版本由存储设置，version 为期望的版本
+func (sh studentsHandler) saveGrade(w http.ResponseWriter, r *http.Request, id, gradeID int, g Grade, version int) {
+	g.ID, g.Updated = gradeID, time.Time{}
+	if err := apply(r, Op{Kind: OpUpdateGrade, StudentID: id, Grade: &g, Version: version}); err != nil {
+		storeError(w, r, err)
+		return
+	}
+	w.Header().Set("ETag", etag(g.Version))
+	writeJson(w, r, http.StatusOK, g)
+}
+
+func (sh studentsHandler) removeGrade(w http.ResponseWriter, r *http.Request, id, gradeID int) {
+	current, err := findGrade(id, gradeID)
+	if err != nil {
+		storeError(w, r, err)
+		return
+	}
+	version, ok := ifMatch(w, r, current.Version)
+	if !ok {
+		return
+	}
+	if err := apply(r, Op{Kind: OpDeleteGrade, StudentID: id, GradeID: gradeID, Version: version}); err != nil {
+		storeError(w, r, err)
+		return
+	}
+	log.Infof(r.Context(), "Deleted grade %d of student %d", gradeID, id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// 解码 JSON 请求体，不允许未知字段，失败时返回 400
+func decodeBody(w http.ResponseWriter, r *http.Request, v interface{}) bool {
 	dec := json.NewDecoder(r.Body)
-	err = dec.Decode(&g)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		writeProblem(w, r, http.StatusBadRequest, fmt.Sprintf("Invalid request body: %s", err))
+		log.Warnf(r.Context(), "Failed to decode request body : %s", err)
+		return false
+	}
+	return true
+}
+
+// 执行请求中的修改，事件中记录执行修改的人
+func apply(r *http.Request, op Op) error {
+	op.Actor = actor(r)
+	return db.Apply(op)
+}
+
+// 执行修改的人，取自请求头 ActorHeader，没有时使用客户端的地址
+func actor(r *http.Request) string {
+	if a := strings.TrimSpace(r.Header.Get(ActorHeader)); a != "" {
+		if len(a) > maxNameLen {
+			a = a[:maxNameLen]
+		}
+		return a
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		log.Println(err)
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// 学生或成绩的版本对应的 ETag
+func etag(version int) string {
+	return fmt.Sprintf(`"%d"`, version)
+}
+
+/**
+ * ifMatch
+ * @Description: 检查 If-Match 请求头，与当前版本不一致时返回 412
+ * 一致时返回当前版本作为操作期望的版本，存储在执行时再次检查，避免检查之后被其他请求修改
+ * @param w
+ * @param r
+ * @param current 当前的版本
+ * @return int 操作期望的版本，没有 If-Match 时为 0
+ * @return bool 是否继续处理
+ */
+func ifMatch(w http.ResponseWriter, r *http.Request, current int) (int, bool) {
+	header := r.Header.Get("If-Match")
+	if header == "" {
+		return 0, true
+	}
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || tag == etag(current) {
+			return current, true
+		}
+	}
+	w.Header().Set("ETag", etag(current))
+	writeProblem(w, r, http.StatusPreconditionFailed,
+		fmt.Sprintf("The resource has been modified, the current ETag is %s", etag(current)))
+	return 0, false
+}
+
+// 存储返回的错误：不存在返回 404，冲突返回 409，引用的对象不存在返回 422，版本不一致返回 412，其余返回 500
+func storeError(w http.ResponseWriter, r *http.Request, err error) {
+	status := 0
+	switch {
+	case errors.Is(err, ErrNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, ErrPreconditionFailed):
+		status = http.StatusPreconditionFailed
+	case errors.Is(err, ErrConflict):
+		status = http.StatusConflict
+	case errors.Is(err, ErrInvalidReference):
+		status = http.StatusUnprocessableEntity
+	}
+	if status != 0 {
+		writeProblem(w, r, status, err.Error())
+		log.Warnf(r.Context(), "%s", err)
 		return
 	}
-	//fmt.Println("add g = ", g)
-	student.Grades = append(student.Grades, g)
-	//fmt.Println("new  student = ", student)
-	w.WriteHeader(http.StatusCreated)
+	writeProblem(w, r, http.StatusInternalServerError, "")
+	log.Errorf(r.Context(), "Grades store error : %s", err)
+}
 
-	data, err := sh.toJson(g)
+func writeJson(w http.ResponseWriter, r *http.Request, status int, obj interface{}) {
+	data, err := toJson(obj)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		log.Println(err)
+		writeProblem(w, r, http.StatusInternalServerError, "")
+		log.Errorf(r.Context(), "%s", err)
 		return
 	}
 	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(status)
 	_, _ = w.Write(data)
 }
 
 /**
  * toJson
  * @Description: 将传入的对象转换为字节切片
- * @receiver sh
  * @param obj
  * @return []byte
  * @return error
  */
-func (sh studentsHandler) toJson(obj interface{}) ([]byte, error) {
+func toJson(obj interface{}) ([]byte, error) {
 	var b bytes.Buffer
 	enc := json.NewEncoder(&b)
 	err := enc.Encode(obj)
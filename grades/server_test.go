@@ -0,0 +1,50 @@
+package grades
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestStudentsRoutes(t *testing.T) {
+	saved := db
+	defer func() { db = saved }()
+	db = NewMemoryStore()
+	mustApply(t, db, freshTestOps()...)
+
+	tests := []struct {
+		method string
+		path   string
+		want   int
+		// 响应为 StudentList 时其中的学生数
+		students int
+	}{
+		{method: http.MethodGet, path: "/students", want: http.StatusOK, students: 2},
+		{method: http.MethodGet, path: "/students/", want: http.StatusOK, students: 2},
+		{method: http.MethodGet, path: "/students/?limit=1", want: http.StatusOK, students: 1},
+		{method: http.MethodGet, path: "/students/1", want: http.StatusOK},
+		{method: http.MethodGet, path: "/students/2", want: http.StatusNotFound},
+		{method: http.MethodGet, path: "/students/x", want: http.StatusNotFound},
+		{method: http.MethodDelete, path: "/students/", want: http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			studentsHandler{}.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, nil))
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+			if tt.students == 0 {
+				return
+			}
+			var list StudentList
+			if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+				t.Fatal(err)
+			}
+			if len(list.Students) != tt.students || list.Total != 2 {
+				t.Errorf("list has %d of %d students, want %d of 2", len(list.Students), list.Total, tt.students)
+			}
+		})
+	}
+}
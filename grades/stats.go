@@ -0,0 +1,285 @@
+package grades
+
+import (
+	"math"
+	"sort"
+	"sync"
+)
+
+// 直方图的档数，每档 10 分
+const histogramBuckets = 10
+
+// Bucket 直方图的一档，包含 Min，不包含 Max，最后一档包含 100 及以上的分数
+type Bucket struct {
+	Min   float32
+	Max   float32
+	Count int
+}
+
+// Percentiles 分位数，按线性插值计算
+type Percentiles struct {
+	P10 float32
+	P25 float32
+	P75 float32
+	P90 float32
+}
+
+// GroupStats 一组成绩的统计，使用成绩的原始分数
+type GroupStats struct {
+	// 分组的名称：作业标题、成绩类型或课程代码
+	Key    string
+	Count  int
+	Mean   float32
+	Median float32
+	// 总体标准差
+	StdDev      float32
+	Min         float32
+	Max         float32
+	Percentiles Percentiles
+	Histogram   []Bucket
+}
+
+// Stats 所有成绩按作业标题、成绩类型与课程分组的统计
+// 课程只统计关联到该课程选课记录的成绩
+type Stats struct {
+	Assignments []GroupStats
+	Types       []GroupStats
+	Courses     []GroupStats
+}
+
+// Standing 学生在一组学生中的排名
+type Standing struct {
+	Score float32
+	// 从 1 开始，分数相同的学生排名相同
+	Rank int
+	// 参与排名的学生数
+	Of int
+	// 分数低于该学生的比例，相同分数的学生算一半
+	Percentile float32
+}
+
+// CourseStanding 学生在选修同一课程的学生中的排名，分数按课程计分规则计算
+type CourseStanding struct {
+	EnrollmentID int
+	CourseID     int
+	Code         string
+	Standing
+}
+
+// Rank 学生的排名，没有成绩时 Overall 为空
+type Rank struct {
+	StudentID int
+	// 按所有成绩的平均分排名
+	Overall *Standing `json:",omitempty"`
+	Courses []CourseStanding
+}
+
+/**
+ * groupStats
+ * @Description: 计算一组分数的统计
+ * @param key
+ * @param scores 会被排序
+ * @return GroupStats
+ */
+func groupStats(key string, scores []float32) GroupStats {
+	sort.Slice(scores, func(i, j int) bool { return scores[i] < scores[j] })
+	s := GroupStats{Key: key, Count: len(scores), Histogram: make([]Bucket, histogramBuckets)}
+	for i := range s.Histogram {
+		s.Histogram[i] = Bucket{Min: float32(i * 100 / histogramBuckets), Max: float32((i + 1) * 100 / histogramBuckets)}
+	}
+	if len(scores) == 0 {
+		return s
+	}
+	var sum float64
+	for _, v := range scores {
+		sum += float64(v)
+		i := int(v) * histogramBuckets / 100
+		if i >= histogramBuckets {
+			i = histogramBuckets - 1
+		}
+		s.Histogram[i].Count++
+	}
+	mean := sum / float64(len(scores))
+	var squares float64
+	for _, v := range scores {
+		squares += (float64(v) - mean) * (float64(v) - mean)
+	}
+	s.Mean = float32(mean)
+	s.StdDev = float32(math.Sqrt(squares / float64(len(scores))))
+	s.Min, s.Max = scores[0], scores[len(scores)-1]
+	s.Median = percentile(scores, 50)
+	s.Percentiles = Percentiles{
+		P10: percentile(scores, 10),
+		P25: percentile(scores, 25),
+		P75: percentile(scores, 75),
+		P90: percentile(scores, 90),
+	}
+	return s
+}
+
+// 已排序分数的第 p 百分位数，在相邻的两个分数之间线性插值
+func percentile(sorted []float32, p float64) float32 {
+	pos := p / 100 * float64(len(sorted)-1)
+	lower := int(math.Floor(pos))
+	if lower >= len(sorted)-1 {
+		return sorted[len(sorted)-1]
+	}
+	frac := float32(pos - float64(lower))
+	return sorted[lower] + (sorted[lower+1]-sorted[lower])*frac
+}
+
+// 按分组的名称排序后计算统计
+func groupAll(groups map[string][]float32) []GroupStats {
+	keys := make([]string, 0, len(groups))
+	for k := range groups {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	result := make([]GroupStats, 0, len(keys))
+	for _, k := range keys {
+		result = append(result, groupStats(k, groups[k]))
+	}
+	return result
+}
+
+// 排名的参与者
+type ranked struct {
+	id    int
+	score float32
+}
+
+// 计算每个参与者的排名，返回参与者 ID 到排名
+func standings(list []ranked) map[int]Standing {
+	result := make(map[int]Standing, len(list))
+	for _, a := range list {
+		var higher, lower, equal int
+		for _, b := range list {
+			switch {
+			case b.score > a.score:
+				higher++
+			case b.score < a.score:
+				lower++
+			default:
+				equal++
+			}
+		}
+		result[a.id] = Standing{
+			Score:      a.score,
+			Rank:       higher + 1,
+			Of:         len(list),
+			Percentile: (float32(lower) + float32(equal)/2) / float32(len(list)) * 100,
+		}
+	}
+	return result
+}
+
+// 统计与排名的计算结果
+type analyticsResult struct {
+	stats Stats
+	ranks map[int]Rank
+}
+
+func computeAnalytics(students Students, catalog Catalog) *analyticsResult {
+	assignments := make(map[string][]float32)
+	types := make(map[string][]float32)
+	courses := make(map[string][]float32)
+	// 选课记录对应的课程
+	enrollmentCourse := make(map[int]*Course)
+	for _, e := range catalog.Enrollments {
+		if section, err := catalog.SectionById(e.SectionID); err == nil {
+			if course, err := catalog.CourseById(section.CourseID); err == nil {
+				enrollmentCourse[e.ID] = course
+			}
+		}
+	}
+	var overall []ranked
+	byCourse := make(map[int][]ranked)
+	summaries := make(map[int]Summary, len(students))
+	for _, stu := range students {
+		for _, g := range stu.Grades {
+			assignments[g.Title] = append(assignments[g.Title], g.Score)
+			types[string(g.Type)] = append(types[string(g.Type)], g.Score)
+			if course, ok := enrollmentCourse[g.EnrollmentID]; ok {
+				courses[course.Code] = append(courses[course.Code], g.Score)
+			}
+		}
+		if len(stu.Grades) > 0 {
+			overall = append(overall, ranked{id: stu.ID, score: stu.Average()})
+		}
+		summary := catalog.Summary(stu)
+		summaries[stu.ID] = summary
+		for _, c := range summary.Courses {
+			if c.Grades > 0 {
+				byCourse[c.Course.ID] = append(byCourse[c.Course.ID], ranked{id: c.EnrollmentID, score: c.Score})
+			}
+		}
+	}
+	overallStandings := standings(overall)
+	courseStandings := make(map[int]map[int]Standing, len(byCourse))
+	for id, list := range byCourse {
+		courseStandings[id] = standings(list)
+	}
+	result := &analyticsResult{
+		stats: Stats{
+			Assignments: groupAll(assignments),
+			Types:       groupAll(types),
+			Courses:     groupAll(courses),
+		},
+		ranks: make(map[int]Rank, len(students)),
+	}
+	for _, stu := range students {
+		rank := Rank{StudentID: stu.ID, Courses: make([]CourseStanding, 0)}
+		if s, ok := overallStandings[stu.ID]; ok {
+			rank.Overall = &s
+		}
+		for _, c := range summaries[stu.ID].Courses {
+			if s, ok := courseStandings[c.Course.ID][c.EnrollmentID]; ok {
+				rank.Courses = append(rank.Courses, CourseStanding{
+					EnrollmentID: c.EnrollmentID,
+					CourseID:     c.Course.ID,
+					Code:         c.Course.Code,
+					Standing:     s,
+				})
+			}
+		}
+		result.ranks[stu.ID] = rank
+	}
+	return result
+}
+
+// 缓存的统计与排名，存储的 Generation 变化后重新计算
+type analyticsCache struct {
+	gen    uint64
+	result *analyticsResult
+	mutex  *sync.Mutex
+}
+
+var analytics = &analyticsCache{mutex: new(sync.Mutex)}
+
+// 返回当前的统计与排名，缓存过期时重新计算
+// 先读取 Generation 再读取数据，计算期间发生的修改会在下一次请求时重新计算
+func (c *analyticsCache) get() (*analyticsResult, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	gen := db.Generation()
+	if c.result != nil && c.gen == gen {
+		return c.result, nil
+	}
+	students, err := db.Students()
+	if err != nil {
+		return nil, err
+	}
+	catalog, err := db.Catalog()
+	if err != nil {
+		return nil, err
+	}
+	c.result, c.gen = computeAnalytics(students, catalog), gen
+	return c.result, nil
+}
+
+// 更换存储后清空缓存
+func (c *analyticsCache) reset() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.result = nil
+}
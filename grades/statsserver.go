@@ -0,0 +1,51 @@
+package grades
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+//	GET /stats              按作业标题、成绩类型与课程分组的统计
+//	GET /stats/assignments  按作业标题分组
+//	GET /stats/types        按成绩类型分组
+//	GET /stats/courses      按课程分组
+//
+// 学生的排名通过 GET /students/{id}/rank 获取
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	route(w, r, map[string]func(){
+		http.MethodGet: func() {
+			result, err := analytics.get()
+			if err != nil {
+				storeError(w, r, err)
+				return
+			}
+			switch strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/stats"), "/") {
+			case "":
+				writeJson(w, r, http.StatusOK, result.stats)
+			case "/assignments":
+				writeJson(w, r, http.StatusOK, result.stats.Assignments)
+			case "/types":
+				writeJson(w, r, http.StatusOK, result.stats.Types)
+			case "/courses":
+				writeJson(w, r, http.StatusOK, result.stats.Courses)
+			default:
+				writeProblem(w, r, http.StatusNotFound, "")
+			}
+		},
+	})
+}
+
+func (sh studentsHandler) getRank(w http.ResponseWriter, r *http.Request, id int) {
+	result, err := analytics.get()
+	if err != nil {
+		storeError(w, r, err)
+		return
+	}
+	rank, ok := result.ranks[id]
+	if !ok {
+		writeProblem(w, r, http.StatusNotFound, fmt.Sprintf("Student with Id %d not found", id))
+		return
+	}
+	writeJson(w, r, http.StatusOK, rank)
+}
@@ -0,0 +1,582 @@
+package grades
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Store 学生与成绩的存储，所有修改都以 Op 的形式通过 Apply 执行
+// 返回的学生均为副本，调用方修改不会影响存储中的数据
+type Store interface {
+	Students() (Students, error)
+	// Counts 学生数与成绩数，不复制学生
+	Counts() (int, int)
+	// List 按条件返回一页学生、满足条件的学生数，以及之后是否还有学生
+	List(q StudentQuery) (Students, int, bool, error)
+	Student(id int) (Student, error)
+	// Catalog 返回课程目录的副本
+	Catalog() (Catalog, error)
+	Apply(op Op) error
+	// History 学生的事件，studentID 为 0 时为所有事件，只返回序号大于 after 的最多 limit 个，limit 为 0 时不限
+	History(studentID int, after int64, limit int) ([]Event, error)
+	// StudentAt 学生在某一时刻的状态，当时不存在时返回 ErrNotFound
+	StudentAt(id int, at time.Time) (Student, error)
+	// Generation 每次修改后递增，用于判断缓存的计算结果是否过期
+	Generation() uint64
+	// Check 检查存储是否可用，作为成绩服务的就绪检查
+	Check() error
+	Close() error
+}
+
+// ErrNotFound 查找的对象不存在，可以使用 errors.Is 判断
+var ErrNotFound = errors.New("not found")
+
+// ErrPreconditionFailed 操作期望的版本与当前版本不同，对象已被其他人修改
+var ErrPreconditionFailed = errors.New("precondition failed")
+
+type OpKind string
+
+const (
+	// OpPutStudent 新增学生，ID 已存在时替换整个学生
+	OpPutStudent OpKind = "PutStudent"
+	// OpCreateStudent 新增学生，ID 由存储分配，执行后写回 Student.ID
+	OpCreateStudent OpKind = "CreateStudent"
+	// OpUpdateStudent 修改学生的姓名，成绩不变
+	OpUpdateStudent OpKind = "UpdateStudent"
+	// OpDeleteStudent 删除学生及其成绩
+	OpDeleteStudent OpKind = "DeleteStudent"
+	// OpAddGrade 为学生追加一条成绩，ID 与时间由存储设置，执行后写回 Grade
+	OpAddGrade OpKind = "AddGrade"
+	// OpUpdateGrade 修改 Grade.ID 对应的成绩，Created 保持不变，Updated 为空时由存储设置
+	OpUpdateGrade OpKind = "UpdateGrade"
+	// OpDeleteGrade 删除 GradeID 对应的成绩
+	OpDeleteGrade OpKind = "DeleteGrade"
+
+	// 课程目录的操作，Put 在 ID 为 0 时新增并分配 ID，否则新增或替换该 ID 的对象，Delete 删除 ID 对应的对象
+	OpPutTerm       OpKind = "PutTerm"
+	OpDeleteTerm    OpKind = "DeleteTerm"
+	OpPutCourse     OpKind = "PutCourse"
+	OpDeleteCourse  OpKind = "DeleteCourse"
+	OpPutSection    OpKind = "PutSection"
+	OpDeleteSection OpKind = "DeleteSection"
+	// OpEnroll 新增选课记录，OpUnenroll 删除 ID 对应的选课记录，仍有成绩关联时不能删除
+	OpEnroll   OpKind = "Enroll"
+	OpUnenroll OpKind = "Unenroll"
+
+	// OpBatch 按顺序执行 Ops 中的操作，任何一个不能执行时都不执行，返回 *BatchError
+	// 每个操作分别记录事件，文件存储只写入一条 WAL
+	OpBatch OpKind = "Batch"
+)
+
+// Op 对存储的一次修改，由存储分配的字段在写入 WAL 之前补全，重放时得到相同的结果
+type Op struct {
+	Kind OpKind
+	// 执行的时间，由存储设置，以及执行修改的人，记录在事件中
+	Time      time.Time
+	Actor     string   `json:",omitempty"`
+	StudentID int      `json:",omitempty"`
+	Student   *Student `json:",omitempty"`
+	GradeID   int      `json:",omitempty"`
+	Grade     *Grade   `json:",omitempty"`
+	// 修改或删除学生与成绩时期望的版本，不为 0 时与当前版本不同返回 ErrPreconditionFailed
+	// 学生的操作比较学生的版本，成绩的操作比较成绩的版本
+	Version int `json:",omitempty"`
+	// 课程目录的 Put 操作为 true 时只修改已有的对象，对象不存在时返回 ErrNotFound
+	MustExist bool `json:",omitempty"`
+	// 删除课程目录对象时的 ID
+	ID         int         `json:",omitempty"`
+	Term       *Term       `json:",omitempty"`
+	Course     *Course     `json:",omitempty"`
+	Section    *Section    `json:",omitempty"`
+	Enrollment *Enrollment `json:",omitempty"`
+	// 批量操作包含的操作，不能再包含批量操作
+	Ops []Op `json:",omitempty"`
+}
+
+// BatchError 批量操作中第 Index 个操作不能执行，整批操作都没有执行
+type BatchError struct {
+	Index int
+	Err   error
+}
+
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("Operation %d of the batch failed: %s", e.Index+1, e.Err)
+}
+
+func (e *BatchError) Unwrap() error { return e.Err }
+
+// 存储的内存状态，内存存储与文件存储共用，调用方负责加锁
+type state struct {
+	students Students
+	// 下一个分配的学生 ID 与成绩 ID，删除的 ID 不会被重新分配
+	nextID      int
+	nextGradeID int
+	catalog     Catalog
+	catalogIDs  catalogIDs
+	// 修改次数，不保存到磁盘
+	gen uint64
+	// 所有修改的事件，按序号排列
+	history []Event
+}
+
+// 下一个可以分配的 ID，不小于已有学生的最大 ID 加 1
+func (st *state) newID() int {
+	id := st.nextID
+	for _, stu := range st.students {
+		if stu.ID >= id {
+			id = stu.ID + 1
+		}
+	}
+	if id < 1 {
+		id = 1
+	}
+	return id
+}
+
+// 下一个可以分配的成绩 ID，不小于已有成绩的最大 ID 加 1
+func (st *state) newGradeID() int {
+	id := st.nextGradeID
+	for _, stu := range st.students {
+		for _, g := range stu.Grades {
+			if g.ID >= id {
+				id = g.ID + 1
+			}
+		}
+	}
+	if id < 1 {
+		id = 1
+	}
+	return id
+}
+
+// 为没有 ID 的成绩分配 ID 并设置时间，旧版本保存的数据与示例数据中的成绩没有 ID
+// 按顺序分配，同样的数据每次得到相同的 ID
+func (st *state) assignGradeIDs(grades []Grade, now time.Time) {
+	next := st.newGradeID()
+	for _, g := range grades {
+		if g.ID >= next {
+			next = g.ID + 1
+		}
+	}
+	for i := range grades {
+		if grades[i].ID == 0 {
+			grades[i].ID = next
+			next++
+		}
+		if grades[i].Created.IsZero() {
+			grades[i].Created, grades[i].Updated = now, now
+		}
+		if grades[i].Version == 0 {
+			grades[i].Version = 1
+		}
+	}
+}
+
+// 期望的版本不为 0 且与当前版本不同时返回 ErrPreconditionFailed
+func checkVersion(what string, current, expected int) error {
+	if expected != 0 && expected != current {
+		return fmt.Errorf("%w: %s has version %d, expected %d", ErrPreconditionFailed, what, current, expected)
+	}
+	return nil
+}
+
+// 加载快照后调用，补全旧数据中成绩的 ID
+func (st *state) normalize() {
+	for i := range st.students {
+		st.assignGradeIDs(st.students[i].Grades, time.Time{})
+		if st.students[i].Version == 0 {
+			st.students[i].Version = 1
+		}
+	}
+	st.nextGradeID = st.newGradeID()
+}
+
+// 检查操作是否可以执行，并补全由存储分配的字段与执行时间，不修改状态
+func (st *state) prepare(op *Op) error {
+	// 重放 WAL 时执行时间已经设置
+	if op.Time.IsZero() {
+		op.Time = time.Now()
+	}
+	now := op.Time
+	switch op.Kind {
+	case OpPutStudent:
+		if op.Student == nil {
+			return fmt.Errorf("Operation %s requires a student", op.Kind)
+		}
+		st.assignGradeIDs(op.Student.Grades, now)
+		op.Student.Version = 1
+		if existing, err := st.students.GetById(op.Student.ID); err == nil {
+			op.Student.Version = existing.Version + 1
+		}
+	case OpCreateStudent:
+		if op.Student == nil {
+			return fmt.Errorf("Operation %s requires a student", op.Kind)
+		}
+		// 重放 WAL 时 ID 已经分配
+		if op.Student.ID == 0 {
+			op.Student.ID = st.newID()
+		} else if _, err := st.students.GetById(op.Student.ID); err == nil {
+			return fmt.Errorf("Student with Id %d already exists", op.Student.ID)
+		}
+		st.assignGradeIDs(op.Student.Grades, now)
+		op.Student.Version = 1
+	case OpUpdateStudent:
+		if op.Student == nil {
+			return fmt.Errorf("Operation %s requires a student", op.Kind)
+		}
+		stu, err := st.students.GetById(op.StudentID)
+		if err != nil {
+			return err
+		}
+		if err := checkVersion(fmt.Sprintf("student %d", stu.ID), stu.Version, op.Version); err != nil {
+			return err
+		}
+	case OpDeleteStudent:
+		stu, err := st.students.GetById(op.StudentID)
+		if err != nil {
+			return err
+		}
+		if err := checkVersion(fmt.Sprintf("student %d", stu.ID), stu.Version, op.Version); err != nil {
+			return err
+		}
+	case OpAddGrade:
+		if op.Grade == nil {
+			return fmt.Errorf("Operation %s requires a grade", op.Kind)
+		}
+		if _, err := st.students.GetById(op.StudentID); err != nil {
+			return err
+		}
+		if err := st.checkEnrollment(op.StudentID, op.Grade); err != nil {
+			return err
+		}
+		if op.Grade.ID == 0 {
+			op.Grade.ID = st.newGradeID()
+			op.Grade.Created, op.Grade.Updated = now, now
+		}
+		op.Grade.Version = 1
+	case OpUpdateGrade:
+		if op.Grade == nil {
+			return fmt.Errorf("Operation %s requires a grade", op.Kind)
+		}
+		stu, err := st.students.GetById(op.StudentID)
+		if err != nil {
+			return err
+		}
+		existing, err := stu.GradeById(op.Grade.ID)
+		if err != nil {
+			return err
+		}
+		if err := checkVersion(fmt.Sprintf("grade %d", existing.ID), existing.Version, op.Version); err != nil {
+			return err
+		}
+		if err := st.checkEnrollment(op.StudentID, op.Grade); err != nil {
+			return err
+		}
+		op.Grade.Created, op.Grade.Version = existing.Created, existing.Version+1
+		// 重放 WAL 时修改时间已经设置
+		if op.Grade.Updated.IsZero() {
+			op.Grade.Updated = now
+		}
+	case OpDeleteGrade:
+		stu, err := st.students.GetById(op.StudentID)
+		if err != nil {
+			return err
+		}
+		existing, err := stu.GradeById(op.GradeID)
+		if err != nil {
+			return err
+		}
+		if err := checkVersion(fmt.Sprintf("grade %d", existing.ID), existing.Version, op.Version); err != nil {
+			return err
+		}
+	case OpBatch:
+		return st.prepareBatch(op)
+	default:
+		return st.prepareCatalog(*op, now)
+	}
+	return nil
+}
+
+// 在状态的副本上依次执行批量操作中的每个操作，补全它们由存储分配的字段
+// 后面的操作可以依赖前面的操作，例如使用前面新增的学生分配的 ID 之后的 ID
+func (st *state) prepareBatch(op *Op) error {
+	trial := st.copy()
+	for i := range op.Ops {
+		sub := &op.Ops[i]
+		if sub.Kind == OpBatch {
+			return &BatchError{Index: i, Err: fmt.Errorf("Operation %s can not be nested", OpBatch)}
+		}
+		sub.Actor = op.Actor
+		if sub.Time.IsZero() {
+			sub.Time = op.Time
+		}
+		if err := trial.prepare(sub); err != nil {
+			return &BatchError{Index: i, Err: err}
+		}
+		trial.mutate(*sub)
+	}
+	return nil
+}
+
+// 执行已经通过 prepare 的操作，并记录事件
+func (st *state) mutate(op Op) {
+	if op.Kind == OpBatch {
+		for _, sub := range op.Ops {
+			st.mutate(sub)
+		}
+		return
+	}
+	st.gen++
+	e := Event{
+		Seq:       int64(len(st.history)) + 1,
+		Time:      op.Time,
+		Actor:     op.Actor,
+		Kind:      op.Kind,
+		StudentID: st.eventStudent(op),
+		Old:       st.eventValue(op),
+	}
+	st.change(op)
+	e.New = st.eventValue(op)
+	st.history = append(st.history, e)
+}
+
+func (st *state) change(op Op) {
+	switch op.Kind {
+	case OpPutStudent, OpCreateStudent:
+		stu := op.Student.clone()
+		if stu.ID >= st.nextID {
+			st.nextID = stu.ID + 1
+		}
+		for _, g := range stu.Grades {
+			if g.ID >= st.nextGradeID {
+				st.nextGradeID = g.ID + 1
+			}
+		}
+		if existing, err := st.students.GetById(stu.ID); err == nil {
+			*existing = stu
+			return
+		}
+		st.students = append(st.students, stu)
+	case OpUpdateStudent:
+		stu, _ := st.students.GetById(op.StudentID)
+		stu.FirstName, stu.LastName = op.Student.FirstName, op.Student.LastName
+		stu.Version++
+	case OpDeleteStudent:
+		for i := range st.students {
+			if st.students[i].ID == op.StudentID {
+				st.students = append(st.students[:i:i], st.students[i+1:]...)
+				break
+			}
+		}
+		st.dropEnrollments(op.StudentID)
+	case OpAddGrade:
+		stu, _ := st.students.GetById(op.StudentID)
+		stu.Grades = append(stu.Grades, *op.Grade)
+		stu.Version++
+		if op.Grade.ID >= st.nextGradeID {
+			st.nextGradeID = op.Grade.ID + 1
+		}
+	case OpUpdateGrade:
+		stu, _ := st.students.GetById(op.StudentID)
+		g, _ := stu.GradeById(op.Grade.ID)
+		*g = *op.Grade
+		stu.Version++
+	case OpDeleteGrade:
+		stu, _ := st.students.GetById(op.StudentID)
+		for i := range stu.Grades {
+			if stu.Grades[i].ID == op.GradeID {
+				stu.Grades = append(stu.Grades[:i:i], stu.Grades[i+1:]...)
+				break
+			}
+		}
+		stu.Version++
+	default:
+		st.mutateCatalog(op)
+	}
+}
+
+func (st *state) apply(op Op) error {
+	if err := st.prepare(&op); err != nil {
+		return err
+	}
+	st.mutate(op)
+	return nil
+}
+
+// 状态的副本，修改副本不影响原状态，事件只追加到副本中
+func (st *state) copy() *state {
+	c := *st
+	c.students = st.all()
+	c.catalog = st.catalog.clone()
+	c.history = st.history[:len(st.history):len(st.history)]
+	return &c
+}
+
+func (st *state) all() Students {
+	result := make(Students, len(st.students))
+	for i, stu := range st.students {
+		result[i] = stu.clone()
+	}
+	return result
+}
+
+func (st *state) counts() (int, int) {
+	grades := 0
+	for i := range st.students {
+		grades += len(st.students[i].Grades)
+	}
+	return len(st.students), grades
+}
+
+func (st *state) one(id int) (Student, error) {
+	stu, err := st.students.GetById(id)
+	if err != nil {
+		return Student{}, err
+	}
+	return stu.clone(), nil
+}
+
+func (stu Student) clone() Student {
+	stu.Grades = append([]Grade(nil), stu.Grades...)
+	return stu
+}
+
+// 数据只保存在内存中，服务重启后丢失
+type memoryStore struct {
+	state state
+	mutex *sync.RWMutex
+}
+
+// NewMemoryStore 创建内存存储
+func NewMemoryStore() Store {
+	return &memoryStore{mutex: new(sync.RWMutex)}
+}
+
+func (s *memoryStore) Students() (Students, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.state.all(), nil
+}
+
+func (s *memoryStore) Counts() (int, int) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.state.counts()
+}
+
+func (s *memoryStore) List(q StudentQuery) (Students, int, bool, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	page, total, more := s.state.list(q)
+	return page, total, more, nil
+}
+
+func (s *memoryStore) Student(id int) (Student, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.state.one(id)
+}
+
+func (s *memoryStore) Catalog() (Catalog, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.state.catalog.clone(), nil
+}
+
+func (s *memoryStore) Apply(op Op) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.state.apply(op)
+}
+
+func (s *memoryStore) History(studentID int, after int64, limit int) ([]Event, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.state.events(studentID, after, limit), nil
+}
+
+func (s *memoryStore) StudentAt(id int, at time.Time) (Student, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.state.studentAt(id, at)
+}
+
+func (s *memoryStore) Generation() uint64 {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.state.gen
+}
+
+func (s *memoryStore) Check() error { return nil }
+
+func (s *memoryStore) Close() error { return nil }
+
+// Config 成绩服务的存储配置
+type Config struct {
+	// memory 或 file
+	Store string
+	// 文件存储的目录
+	DataDir string
+	// 在新建的存储中写入示例数据，文件存储只在数据目录中还没有快照与 WAL 时写入，
+	// 已有数据的学生被全部删除后不会重新写入
+	Seed bool
+}
+
+var DefaultConfig = Config{
+	Store:   "memory",
+	DataDir: "./grades-data",
+	Seed:    true,
+}
+
+// 成绩服务使用的存储，由 Open 设置
+var db Store = NewMemoryStore()
+
+/**
+ * Open
+ * @Description: 按配置打开存储，替换成绩服务使用的存储，需要在注册 handler 之前调用
+ * @param cfg
+ * @return error
+ */
+func Open(cfg Config) error {
+	var s Store
+	seed := cfg.Seed
+	switch cfg.Store {
+	case "memory":
+		s = NewMemoryStore()
+	case "file":
+		if seed {
+			fresh, err := newDataDir(cfg.DataDir)
+			if err != nil {
+				return err
+			}
+			seed = fresh
+		}
+		var err error
+		if s, err = OpenFileStore(cfg.DataDir); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("Unknown grades store %q, expected memory or file", cfg.Store)
+	}
+	if seed {
+		if err := Seed(s); err != nil {
+			_ = s.Close()
+			return err
+		}
+	}
+	db = s
+	analytics.reset()
+	return nil
+}
+
+// CheckStorage 检查存储是否可用
+func CheckStorage() error {
+	return db.Check()
+}
+
+// Close 关闭存储，服务退出前调用
+func Close() error {
+	return db.Close()
+}
@@ -0,0 +1,54 @@
+// Package httputil 服务内部共用的 http 工具
+package httputil
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// StatusRecorder 记录响应状态码，同时保留 Flusher 与 Hijacker，流式接口依赖它们
+// Unwrap 使 http.ResponseController 可以访问被包装的 ResponseWriter
+type StatusRecorder struct {
+	http.ResponseWriter
+	// 响应状态码，处理函数没有调用 WriteHeader 时为 200，连接被接管时为 101
+	Status      int
+	wroteHeader bool
+}
+
+// NewStatusRecorder 包装 w，记录写入的状态码
+func NewStatusRecorder(w http.ResponseWriter) *StatusRecorder {
+	return &StatusRecorder{ResponseWriter: w, Status: http.StatusOK}
+}
+
+func (sr *StatusRecorder) WriteHeader(code int) {
+	if !sr.wroteHeader {
+		sr.Status = code
+		sr.wroteHeader = true
+	}
+	sr.ResponseWriter.WriteHeader(code)
+}
+
+func (sr *StatusRecorder) Write(data []byte) (int, error) {
+	sr.wroteHeader = true
+	return sr.ResponseWriter.Write(data)
+}
+
+func (sr *StatusRecorder) Flush() {
+	if f, ok := sr.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (sr *StatusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if h, ok := sr.ResponseWriter.(http.Hijacker); ok {
+		sr.Status = http.StatusSwitchingProtocols
+		return h.Hijack()
+	}
+	return nil, nil, fmt.Errorf("ResponseWriter does not support hijacking")
+}
+
+func (sr *StatusRecorder) Unwrap() http.ResponseWriter {
+	return sr.ResponseWriter
+}
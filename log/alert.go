@@ -0,0 +1,487 @@
+package log
+
+import (
+	"Distribute/metrics"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	stlog "log"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// 告警规则的类型
+const (
+	// 每条匹配的记录都满足条件，告警期间的重复匹配不再通知，Window 内没有新的匹配后恢复
+	RuleMatch = "match"
+	// Window 内匹配的记录数达到 Threshold 时告警，低于 Threshold 后恢复
+	RuleRate = "rate"
+	// Window 内没有匹配的记录时告警，出现匹配的记录后恢复
+	RuleAbsence = "absence"
+)
+
+// Rule 告警规则，匹配条件与查询 API 的参数相同
+type Rule struct {
+	Name string
+	Kind string
+	// 服务名，为空时匹配所有服务
+	Service string `json:",omitempty"`
+	// 最低日志级别
+	Level string `json:",omitempty"`
+	// 消息中包含的子串
+	Substring string `json:",omitempty"`
+	// 消息需要匹配的正则表达式
+	Pattern string `json:",omitempty"`
+	// rate 规则的阈值
+	Threshold int `json:",omitempty"`
+	// 时间窗口，如 1m、30s
+	Window string `json:",omitempty"`
+}
+
+// RuleSet 规则文件的内容
+//
+//	{
+//	  "Rules": [
+//	    {"Name": "grading-errors", "Kind": "rate", "Service": "GradingService", "Level": "error", "Threshold": 10, "Window": "1m"},
+//	    {"Name": "panic", "Kind": "match", "Pattern": "panic|fatal"},
+//	    {"Name": "portal-silent", "Kind": "absence", "Service": "Portal", "Window": "10m"}
+//	  ]
+//	}
+type RuleSet struct {
+	Rules []Rule
+}
+
+// match 规则默认的恢复时间
+const defaultMatchWindow = 5 * time.Minute
+
+// Alert 告警通知的内容
+type Alert struct {
+	Rule   string
+	Kind   string
+	Status string
+	// 开始告警的时间
+	StartsAt time.Time
+	// 发送通知的时间
+	Time time.Time
+	// 告警期间匹配的记录数，rate 规则为窗口内的记录数
+	Count   int
+	Message string
+	// 最近一条匹配的记录
+	Sample *Record `json:",omitempty"`
+}
+
+// 告警通知的状态
+const (
+	AlertFiring   = "firing"
+	AlertResolved = "resolved"
+)
+
+// AlertConfig 告警的配置
+type AlertConfig struct {
+	// 规则文件，修改后自动重新加载
+	RulesFile string
+	// 接收告警的地址，以 POST 发送 JSON
+	Webhook string
+	// 告警以 JSON Lines 追加到该文件
+	File string
+}
+
+// 检查规则文件是否修改以及规则状态的间隔
+const alertInterval = 5 * time.Second
+
+var (
+	alertNotifications = metrics.NewCounter("log_alert_notifications_total",
+		"Alert notifications sent by the log service, by status and result.",
+		"status", "result")
+	alertReloads = metrics.NewCounter("log_alert_rule_reloads_total",
+		"Reloads of the alert rules file, by result.",
+		"result")
+)
+
+func init() {
+	metrics.NewGaugeFunc("log_alerts_firing",
+		"Alert rules currently firing.",
+		func() float64 {
+			if alerts == nil {
+				return 0
+			}
+			return float64(len(alerts.firing()))
+		})
+}
+
+// 规则及其运行状态
+type alertRule struct {
+	Rule
+	query  Query
+	window time.Duration
+
+	active   bool
+	startsAt time.Time
+	// 最近一次匹配的时间
+	lastMatch time.Time
+	count     int
+	// rate 规则最近 Threshold 次匹配的时间
+	hits   []time.Time
+	sample *Record
+}
+
+type alerter struct {
+	cfg     AlertConfig
+	modTime time.Time
+	rules   []*alertRule
+	queue   chan Alert
+	mutex   *sync.Mutex
+}
+
+var alerts *alerter
+
+/**
+ * StartAlerts
+ * @Description: 加载规则文件并开始根据写入的记录检查告警条件，规则文件修改后自动重新加载
+ * @param cfg
+ * @return error 规则文件无法加载时返回
+ */
+func StartAlerts(cfg AlertConfig) error {
+	a := &alerter{
+		cfg:   cfg,
+		queue: make(chan Alert, 1000),
+		mutex: new(sync.Mutex),
+	}
+	if err := a.reload(); err != nil {
+		return err
+	}
+	alerts = a
+	go a.notify()
+	go a.run()
+	return nil
+}
+
+func loadRules(path string) ([]*alertRule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var set RuleSet
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("Invalid alert rules %s: %s", path, err)
+	}
+	rules := make([]*alertRule, 0, len(set.Rules))
+	names := make(map[string]bool)
+	for _, rule := range set.Rules {
+		r, err := compileRule(rule)
+		if err != nil {
+			return nil, err
+		}
+		if names[rule.Name] {
+			return nil, fmt.Errorf("Duplicate alert rule %q", rule.Name)
+		}
+		names[rule.Name] = true
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// 校验规则并转换为查询条件
+func compileRule(rule Rule) (*alertRule, error) {
+	if rule.Name == "" {
+		return nil, fmt.Errorf("Alert rule without a name")
+	}
+	values := url.Values{}
+	values.Set("service", rule.Service)
+	values.Set("level", rule.Level)
+	values.Set("q", rule.Substring)
+	values.Set("regex", rule.Pattern)
+	q, err := ParseQuery(values)
+	if err != nil {
+		return nil, fmt.Errorf("Alert rule %q: %s", rule.Name, err)
+	}
+	r := &alertRule{Rule: rule, query: q, lastMatch: time.Now()}
+	if rule.Window != "" {
+		if r.window, err = time.ParseDuration(rule.Window); err != nil || r.window <= 0 {
+			return nil, fmt.Errorf("Alert rule %q: invalid window %q", rule.Name, rule.Window)
+		}
+	}
+	switch rule.Kind {
+	case RuleMatch:
+		if r.window == 0 {
+			r.window = defaultMatchWindow
+		}
+	case RuleRate:
+		if rule.Threshold <= 0 || r.window == 0 {
+			return nil, fmt.Errorf("Alert rule %q: rate rules need a positive Threshold and a Window", rule.Name)
+		}
+	case RuleAbsence:
+		if r.window == 0 {
+			return nil, fmt.Errorf("Alert rule %q: absence rules need a Window", rule.Name)
+		}
+	default:
+		return nil, fmt.Errorf("Alert rule %q: unknown kind %q", rule.Name, rule.Kind)
+	}
+	return r, nil
+}
+
+// 重新加载规则文件，定义未变化的规则保留运行状态，被删除或修改的规则如果正在告警则发送恢复通知
+func (a *alerter) reload() error {
+	info, err := os.Stat(a.cfg.RulesFile)
+	if err != nil {
+		alertReloads.With("failure").Inc()
+		return err
+	}
+	rules, err := loadRules(a.cfg.RulesFile)
+	if err != nil {
+		alertReloads.With("failure").Inc()
+		return err
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	previous := make(map[string]*alertRule, len(a.rules))
+	for _, r := range a.rules {
+		previous[r.Name] = r
+	}
+	for i, r := range rules {
+		if old, ok := previous[r.Name]; ok && old.Rule == r.Rule {
+			rules[i] = old
+			delete(previous, r.Name)
+		}
+	}
+	now := time.Now()
+	for _, old := range previous {
+		if old.active {
+			a.send(old.resolve(now, "Rule removed or changed"))
+		}
+	}
+	a.rules = rules
+	a.modTime = info.ModTime()
+	alertReloads.With("success").Inc()
+	return nil
+}
+
+// 检查写入的记录，由 write 调用
+func observeAlerts(rec Record) {
+	if alerts != nil {
+		alerts.observe(rec, time.Now())
+	}
+}
+
+func (a *alerter) observe(rec Record, now time.Time) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	for _, r := range a.rules {
+		if !r.query.Matches(rec) {
+			continue
+		}
+		r.lastMatch = now
+		sample := rec
+		r.sample = &sample
+		switch r.Kind {
+		case RuleMatch:
+			r.count++
+			if !r.active {
+				r.count = 1
+				a.send(r.fire(now, rec.Message))
+			}
+		case RuleRate:
+			r.hits = append(r.hits, now)
+			if len(r.hits) > r.Threshold {
+				r.hits = r.hits[len(r.hits)-r.Threshold:]
+			}
+			if !r.active && len(r.hits) == r.Threshold && now.Sub(r.hits[0]) <= r.window {
+				r.count = r.Threshold
+				a.send(r.fire(now, fmt.Sprintf("%d matching records within %s", r.Threshold, r.window)))
+			}
+		case RuleAbsence:
+			if r.active {
+				a.send(r.resolve(now, "Matching records are back"))
+			}
+		}
+	}
+}
+
+// 定期检查窗口到期的规则与规则文件的修改
+func (a *alerter) run() {
+	ticker := time.NewTicker(alertInterval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		a.mutex.Lock()
+		modTime := a.modTime
+		a.mutex.Unlock()
+		if info, err := os.Stat(a.cfg.RulesFile); err == nil && !info.ModTime().Equal(modTime) {
+			if err := a.reload(); err != nil {
+				stlog.Println("Failed to reload alert rules, keeping the previous ones: ", err)
+				// 记录修改时间，避免每次都重新加载同一个错误的文件
+				a.mutex.Lock()
+				a.modTime = info.ModTime()
+				a.mutex.Unlock()
+			}
+		}
+		a.tick(now)
+	}
+}
+
+func (a *alerter) tick(now time.Time) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	for _, r := range a.rules {
+		switch r.Kind {
+		case RuleMatch:
+			if r.active && now.Sub(r.lastMatch) > r.window {
+				a.send(r.resolve(now, fmt.Sprintf("No matching records for %s", r.window)))
+			}
+		case RuleRate:
+			for len(r.hits) > 0 && now.Sub(r.hits[0]) > r.window {
+				r.hits = r.hits[1:]
+			}
+			if r.active && len(r.hits) < r.Threshold {
+				r.count = len(r.hits)
+				a.send(r.resolve(now, fmt.Sprintf("Fewer than %d matching records within %s", r.Threshold, r.window)))
+			}
+		case RuleAbsence:
+			if !r.active && now.Sub(r.lastMatch) > r.window {
+				r.count = 0
+				r.sample = nil
+				a.send(r.fire(now, fmt.Sprintf("No matching records for %s", r.window)))
+			}
+		}
+	}
+}
+
+func (r *alertRule) fire(now time.Time, message string) Alert {
+	r.active = true
+	r.startsAt = now
+	return r.alert(AlertFiring, now, message)
+}
+
+func (r *alertRule) resolve(now time.Time, message string) Alert {
+	r.active = false
+	return r.alert(AlertResolved, now, message)
+}
+
+func (r *alertRule) alert(status string, now time.Time, message string) Alert {
+	return Alert{
+		Rule:     r.Name,
+		Kind:     r.Kind,
+		Status:   status,
+		StartsAt: r.startsAt,
+		Time:     now,
+		Count:    r.count,
+		Message:  message,
+		Sample:   r.sample,
+	}
+}
+
+// 放入通知队列，调用方需持有锁，队列已满时丢弃
+func (a *alerter) send(alert Alert) {
+	select {
+	case a.queue <- alert:
+	default:
+		alertNotifications.With(alert.Status, "dropped").Inc()
+	}
+}
+
+// 正在告警的规则
+func (a *alerter) firing() []Alert {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	result := make([]Alert, 0)
+	for _, r := range a.rules {
+		if r.active {
+			result = append(result, r.alert(AlertFiring, r.startsAt, ""))
+		}
+	}
+	return result
+}
+
+// 依次发送通知，webhook 失败时重试
+func (a *alerter) notify() {
+	client := &http.Client{Timeout: 5 * time.Second}
+	for alert := range a.queue {
+		data, err := json.Marshal(alert)
+		if err != nil {
+			continue
+		}
+		stlog.Printf("Alert %s: %s (%s)\n", alert.Status, alert.Rule, alert.Message)
+		if a.cfg.File != "" {
+			if err := appendLine(a.cfg.File, data); err != nil {
+				alertNotifications.With(alert.Status, "failure").Inc()
+				stlog.Println("Failed to write alert: ", err)
+			} else {
+				alertNotifications.With(alert.Status, "success").Inc()
+			}
+		}
+		if a.cfg.Webhook != "" {
+			if err := postAlert(client, a.cfg.Webhook, data); err != nil {
+				alertNotifications.With(alert.Status, "failure").Inc()
+				stlog.Println("Failed to send alert: ", err)
+			} else {
+				alertNotifications.With(alert.Status, "success").Inc()
+			}
+		}
+	}
+}
+
+func appendLine(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(data, '\n'))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// 最多尝试 3 次，间隔逐渐增加
+func postAlert(client *http.Client, webhook string, data []byte) error {
+	var err error
+	for attempt, wait := 0, time.Second; attempt < 3; attempt, wait = attempt+1, wait*2 {
+		if attempt > 0 {
+			time.Sleep(wait)
+		}
+		var res *http.Response
+		res, err = client.Post(webhook, "application/json", bytes.NewReader(data))
+		if err != nil {
+			continue
+		}
+		_ = res.Body.Close()
+		if res.StatusCode >= 200 && res.StatusCode < 300 {
+			return nil
+		}
+		err = fmt.Errorf("Webhook responded with code %v", res.StatusCode)
+	}
+	return err
+}
+
+// GET /alerts 返回规则与正在告警的规则
+// POST /alerts/reload 立即重新加载规则文件
+func alertsHandler(w http.ResponseWriter, r *http.Request) {
+	if alerts == nil {
+		http.Error(w, "Alerting is not enabled", http.StatusNotFound)
+		return
+	}
+	switch {
+	case r.URL.Path == "/alerts" && r.Method == http.MethodGet:
+		alerts.mutex.Lock()
+		rules := make([]Rule, 0, len(alerts.rules))
+		for _, rule := range alerts.rules {
+			rules = append(rules, rule.Rule)
+		}
+		alerts.mutex.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(struct {
+			Rules  []Rule
+			Firing []Alert
+		}{rules, alerts.firing()})
+	case r.URL.Path == "/alerts/reload" && r.Method == http.MethodPost:
+		if err := alerts.reload(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
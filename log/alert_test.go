@@ -0,0 +1,221 @@
+package log
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCompileRule(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    Rule
+		wantErr bool
+		// 编译后的时间窗口
+		window time.Duration
+	}{
+		{name: "match without window", rule: Rule{Name: "m", Kind: RuleMatch}, window: defaultMatchWindow},
+		{name: "match with window", rule: Rule{Name: "m", Kind: RuleMatch, Window: "30s"}, window: 30 * time.Second},
+		{name: "rate", rule: Rule{Name: "r", Kind: RuleRate, Threshold: 3, Window: "1m"}, window: time.Minute},
+		{name: "absence", rule: Rule{Name: "a", Kind: RuleAbsence, Window: "10m"}, window: 10 * time.Minute},
+		{name: "missing name", rule: Rule{Kind: RuleMatch}, wantErr: true},
+		{name: "unknown kind", rule: Rule{Name: "x", Kind: "often"}, wantErr: true},
+		{name: "invalid window", rule: Rule{Name: "m", Kind: RuleMatch, Window: "soon"}, wantErr: true},
+		{name: "negative window", rule: Rule{Name: "m", Kind: RuleMatch, Window: "-1m"}, wantErr: true},
+		{name: "rate without threshold", rule: Rule{Name: "r", Kind: RuleRate, Window: "1m"}, wantErr: true},
+		{name: "rate without window", rule: Rule{Name: "r", Kind: RuleRate, Threshold: 3}, wantErr: true},
+		{name: "absence without window", rule: Rule{Name: "a", Kind: RuleAbsence}, wantErr: true},
+		{name: "invalid level", rule: Rule{Name: "m", Kind: RuleMatch, Level: "loud"}, wantErr: true},
+		{name: "invalid pattern", rule: Rule{Name: "m", Kind: RuleMatch, Pattern: "("}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := compileRule(tt.rule)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("compileRule() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && r.window != tt.window {
+				t.Errorf("window = %s, want %s", r.window, tt.window)
+			}
+		})
+	}
+}
+
+// 规则检查中的一步：在 at 秒时写入消息为 message 的记录，message 为空时检查窗口到期
+type alertStep struct {
+	at      int
+	message string
+}
+
+func TestAlertRules(t *testing.T) {
+	errorRecord := func(message string) Record {
+		return Record{Level: LevelError, Service: "GradingService", Message: message}
+	}
+	tests := []struct {
+		name  string
+		rule  Rule
+		steps []alertStep
+		// 依次发送的通知状态与计数
+		want []string
+	}{
+		{
+			name:  "match fires once and resolves after the window",
+			rule:  Rule{Name: "panic", Kind: RuleMatch, Pattern: "panic", Window: "1m"},
+			steps: []alertStep{{0, "panic: a"}, {10, "panic: b"}, {30, ""}, {69, ""}, {71, ""}},
+			want:  []string{"firing 1", "resolved 2"},
+		},
+		{
+			name:  "match ignores other records",
+			rule:  Rule{Name: "panic", Kind: RuleMatch, Pattern: "panic", Window: "1m"},
+			steps: []alertStep{{0, "ok"}, {10, "fine"}, {120, ""}},
+		},
+		{
+			name:  "match fires again after resolving",
+			rule:  Rule{Name: "panic", Kind: RuleMatch, Substring: "panic", Window: "1m"},
+			steps: []alertStep{{0, "panic"}, {61, ""}, {62, "panic"}},
+			want:  []string{"firing 1", "resolved 1", "firing 1"},
+		},
+		{
+			name:  "rate below threshold",
+			rule:  Rule{Name: "errors", Kind: RuleRate, Threshold: 3, Window: "1m"},
+			steps: []alertStep{{0, "a"}, {10, "b"}, {120, ""}},
+		},
+		{
+			name:  "rate fires at threshold within the window",
+			rule:  Rule{Name: "errors", Kind: RuleRate, Threshold: 3, Window: "1m"},
+			steps: []alertStep{{0, "a"}, {10, "b"}, {20, "c"}, {30, "d"}, {75, ""}, {95, ""}},
+			want:  []string{"firing 3", "resolved 2"},
+		},
+		{
+			name:  "rate spread over more than the window",
+			rule:  Rule{Name: "errors", Kind: RuleRate, Threshold: 3, Window: "1m"},
+			steps: []alertStep{{0, "a"}, {40, "b"}, {80, "c"}},
+		},
+		{
+			name:  "rate counts only matching records",
+			rule:  Rule{Name: "errors", Kind: RuleRate, Service: "Portal", Threshold: 2, Window: "1m"},
+			steps: []alertStep{{0, "a"}, {1, "b"}, {2, "c"}},
+		},
+		{
+			name:  "absence fires after the window and resolves on a match",
+			rule:  Rule{Name: "silent", Kind: RuleAbsence, Window: "1m"},
+			steps: []alertStep{{30, ""}, {61, ""}, {90, ""}, {100, "back"}, {130, ""}},
+			want:  []string{"firing 0", "resolved 0"},
+		},
+		{
+			name:  "absence is quiet while records arrive",
+			rule:  Rule{Name: "silent", Kind: RuleAbsence, Window: "1m"},
+			steps: []alertStep{{50, "a"}, {100, "b"}, {150, "c"}, {200, ""}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := compileRule(tt.rule)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r.lastMatch = testTime
+			a := &alerter{rules: []*alertRule{r}, queue: make(chan Alert, 100), mutex: new(sync.Mutex)}
+			var got []string
+			for _, step := range tt.steps {
+				now := testTime.Add(time.Duration(step.at) * time.Second)
+				if step.message == "" {
+					a.tick(now)
+				} else {
+					a.observe(errorRecord(step.message), now)
+				}
+				for len(a.queue) > 0 {
+					alert := <-a.queue
+					got = append(got, fmt.Sprintf("%s %d", alert.Status, alert.Count))
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("alerts = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAlertReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.json")
+	writeRules := func(rules string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(`{"Rules": [`+rules+`]}`), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	const (
+		panicRule  = `{"Name": "panic", "Kind": "match", "Pattern": "panic"}`
+		errorsRule = `{"Name": "errors", "Kind": "rate", "Threshold": 1, "Window": "1m"}`
+	)
+	tests := []struct {
+		name  string
+		rules string
+		// 重新加载后的规则与发送的通知
+		want     []string
+		wantSent []string
+		wantErr  bool
+	}{
+		{name: "unchanged rules keep firing", rules: panicRule + "," + errorsRule, want: []string{"panic", "errors"}},
+		{name: "removed rule resolves", rules: panicRule, want: []string{"panic"}, wantSent: []string{"resolved errors"}},
+		{
+			name:     "changed rule resolves and starts over",
+			rules:    `{"Name": "panic", "Kind": "match", "Pattern": "fatal"}, ` + errorsRule,
+			want:     []string{"panic", "errors"},
+			wantSent: []string{"resolved panic"},
+		},
+		{name: "duplicate names are rejected", rules: panicRule + "," + panicRule, wantErr: true},
+		{name: "invalid rules are rejected", rules: `{"Name": "x"}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			writeRules(panicRule + "," + errorsRule)
+			a := &alerter{cfg: AlertConfig{RulesFile: path}, queue: make(chan Alert, 100), mutex: new(sync.Mutex)}
+			if err := a.reload(); err != nil {
+				t.Fatal(err)
+			}
+			a.observe(Record{Level: LevelError, Service: "test", Message: "panic"}, testTime)
+			<-a.queue
+			<-a.queue
+			before := a.rules
+
+			writeRules(tt.rules)
+			err := a.reload()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("reload() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				if !reflect.DeepEqual(a.rules, before) {
+					t.Error("a failed reload replaced the rules")
+				}
+				return
+			}
+			var names []string
+			for _, r := range a.rules {
+				names = append(names, r.Name)
+				if r.Rule == before[0].Rule || r.Rule == before[1].Rule {
+					if !r.active {
+						t.Errorf("unchanged rule %s lost its state", r.Name)
+					}
+				} else if r.active {
+					t.Errorf("changed rule %s is still firing", r.Name)
+				}
+			}
+			if !reflect.DeepEqual(names, tt.want) {
+				t.Errorf("rules = %v, want %v", names, tt.want)
+			}
+			var sent []string
+			for len(a.queue) > 0 {
+				alert := <-a.queue
+				sent = append(sent, alert.Status+" "+alert.Rule)
+			}
+			if !reflect.DeepEqual(sent, tt.wantSent) {
+				t.Errorf("sent %v, want %v", sent, tt.wantSent)
+			}
+		})
+	}
+}
@@ -0,0 +1,351 @@
+package log
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// 审计模式：每条记录保存时带有 Hash = sha256(前一条记录的 Hash + "\n" + 不含 Hash 的记录 JSON)，
+// 并定期将最后一条记录的序号与 Hash 用 ed25519 签名后追加到 checkpoints.ndjson
+// 修改、删除或插入记录会使哈希链断开，截断日志会使检查点找不到对应的记录
+// manifest 中记录已写入的检查点数，删除或截断检查点文件同样会被发现
+// 审计模式下每条记录都必须有 Hash，因此需要在空的日志目录中开启，也不会按保留策略删除分段
+
+const checkpointFile = "checkpoints.ndjson"
+
+// 每写入该数量的记录生成一个检查点，此外每次后台维护时也会为新记录生成检查点
+const checkpointEvery = 1000
+
+// 校验结果中最多列出的问题数
+const maxAuditProblems = 100
+
+// 行尾的 Hash 字段：,"Hash":"<64 位十六进制>"}
+const (
+	hashPrefix    = `,"Hash":"`
+	hashSuffixLen = len(hashPrefix) + sha256.Size*2 + len(`"}`)
+)
+
+// Checkpoint 签名的检查点，表示序号 Ordinal 的记录的 Hash 为该值
+type Checkpoint struct {
+	Ordinal   int64
+	Hash      string
+	Time      time.Time
+	Signature string
+}
+
+func (c Checkpoint) message() []byte {
+	return []byte(fmt.Sprintf("%d\n%s\n%s", c.Ordinal, c.Hash, c.Time.UTC().Format(time.RFC3339Nano)))
+}
+
+// AuditReport 审计日志的校验结果
+type AuditReport struct {
+	OK bool
+	// 校验过哈希链的记录数
+	Records     int64
+	Checkpoints int
+	// 已确认的最后一个检查点的记录序号，-1 表示没有
+	LastCheckpoint int64
+	Problems       []string `json:",omitempty"`
+}
+
+/**
+ * LoadAuditKey
+ * @Description: 读取十六进制编码的 ed25519 私钥种子，create 为 true 且文件不存在时生成新的密钥，并将公钥写入 path.pub
+ * @param path
+ * @param create
+ * @return ed25519.PrivateKey
+ * @return error
+ */
+func LoadAuditKey(path string, create bool) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) && create {
+		seed := make([]byte, ed25519.SeedSize)
+		if _, err := rand.Read(seed); err != nil {
+			return nil, err
+		}
+		key := ed25519.NewKeyFromSeed(seed)
+		if err := os.WriteFile(path, []byte(hex.EncodeToString(seed)+"\n"), 0600); err != nil {
+			return nil, err
+		}
+		pub := key.Public().(ed25519.PublicKey)
+		if err := os.WriteFile(path+".pub", []byte(hex.EncodeToString(pub)+"\n"), 0644); err != nil {
+			return nil, err
+		}
+		return key, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	seed, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("Invalid audit key %s", path)
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// LoadAuditPublicKey 读取十六进制编码的 ed25519 公钥，即 LoadAuditKey 生成的 .pub 文件
+func LoadAuditPublicKey(path string) (ed25519.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pub, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("Invalid audit public key %s", path)
+	}
+	return pub, nil
+}
+
+func chainHash(prev string, body []byte) string {
+	h := sha256.New()
+	_, _ = h.Write([]byte(prev))
+	_, _ = h.Write([]byte{'\n'})
+	_, _ = h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// 将不含 Hash 的记录 JSON 与哈希拼接为一行，结果与 Hash 字段非空时的序列化结果相同
+func sealLine(data []byte, hash string) []byte {
+	line := make([]byte, 0, len(data)+hashSuffixLen+1)
+	line = append(line, data[:len(data)-1]...)
+	line = append(line, hashPrefix...)
+	line = append(line, hash...)
+	line = append(line, `"}`...)
+	return append(line, '\n')
+}
+
+// 拆分出不含 Hash 的记录 JSON 与 Hash，没有 Hash 时 ok 为 false
+func splitLine(line []byte) (body []byte, hash string, ok bool) {
+	line = bytes.TrimRight(line, "\r\n")
+	if len(line) <= hashSuffixLen {
+		return nil, "", false
+	}
+	suffix := line[len(line)-hashSuffixLen:]
+	if !bytes.HasPrefix(suffix, []byte(hashPrefix)) || !bytes.HasSuffix(suffix, []byte(`"}`)) {
+		return nil, "", false
+	}
+	hash = string(suffix[len(hashPrefix) : len(hashPrefix)+sha256.Size*2])
+	body = append(append([]byte(nil), line[:len(line)-hashSuffixLen]...), '}')
+	return body, hash, true
+}
+
+// 为最后一条记录生成检查点，调用方需持有写锁
+func (s *store) checkpoint() error {
+	ordinal := int64(s.first) + int64(len(s.entries)) - 1
+	if ordinal < 0 || ordinal <= s.checkpointed || s.lastHash == "" {
+		return nil
+	}
+	// 检查点之前的记录必须已经写入磁盘
+	if err := s.active.Sync(); err != nil {
+		return err
+	}
+	c := Checkpoint{Ordinal: ordinal, Hash: s.lastHash, Time: time.Now().UTC()}
+	c.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(s.cfg.AuditKey, c.message()))
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	if err := appendLine(filepath.Join(s.cfg.Dir, checkpointFile), data); err != nil {
+		return err
+	}
+	s.checkpointed = ordinal
+	s.checkpoints++
+	return s.saveManifest()
+}
+
+func readCheckpoints(dir string) ([]Checkpoint, error) {
+	f, err := os.Open(filepath.Join(dir, checkpointFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+	var result []Checkpoint
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var c Checkpoint
+		if err := json.Unmarshal(scanner.Bytes(), &c); err != nil {
+			return result, fmt.Errorf("Corrupted checkpoint on line %d", line)
+		}
+		result = append(result, c)
+	}
+	return result, scanner.Err()
+}
+
+// Verify 校验目录中的审计日志，日志服务未运行时使用
+func Verify(dir string, pub ed25519.PublicKey) (AuditReport, error) {
+	m, err := readManifest(filepath.Join(dir, manifestFile))
+	if err != nil {
+		return AuditReport{LastCheckpoint: -1}, err
+	}
+	open := func(seg Segment) (io.ReadCloser, error) {
+		return os.Open(filepath.Join(dir, seg.File))
+	}
+	return verifyAudit(dir, m.Segments, m.Checkpoints, open, pub), nil
+}
+
+/**
+ * verifyAudit
+ * @Description: 按顺序读取所有分段，检查每条记录的哈希链，并确认每个检查点的签名与对应记录的 Hash
+ * @param dir
+ * @param segments
+ * @param written 存储记录的已写入检查点数，检查点文件中少于该数量时说明文件被删除或截断
+ * @param open 打开分段，返回未压缩前的内容
+ * @param pub
+ * @return AuditReport
+ */
+func verifyAudit(dir string, segments []Segment, written int, open func(Segment) (io.ReadCloser, error), pub ed25519.PublicKey) AuditReport {
+	report := AuditReport{LastCheckpoint: -1}
+	problem := func(format string, v ...interface{}) {
+		if len(report.Problems) < maxAuditProblems {
+			report.Problems = append(report.Problems, fmt.Sprintf(format, v...))
+		}
+	}
+
+	checkpoints, err := readCheckpoints(dir)
+	if err != nil {
+		problem("%s", err)
+	}
+	report.Checkpoints = len(checkpoints)
+	switch {
+	case err != nil:
+	case len(checkpoints) == 0 && written > 0:
+		problem("The checkpoints file is missing or empty, %d checkpoints were written", written)
+	case len(checkpoints) < written:
+		problem("The checkpoints file has %d of the %d checkpoints written, it was truncated", len(checkpoints), written)
+	}
+	expected := make(map[int64]string, len(checkpoints))
+	for _, c := range checkpoints {
+		sig, err := base64.StdEncoding.DecodeString(c.Signature)
+		if err != nil || !ed25519.Verify(pub, c.message(), sig) {
+			problem("Checkpoint at record %d has an invalid signature", c.Ordinal)
+			continue
+		}
+		expected[c.Ordinal] = c.Hash
+	}
+
+	var ordinal int64
+	if len(segments) > 0 {
+		ordinal = segments[0].FirstOrdinal
+	}
+	prev := ""
+	for _, seg := range segments {
+		rc, err := open(seg)
+		if err != nil {
+			problem("Segment %s: %s", seg.File, err)
+			continue
+		}
+		var src io.Reader = rc
+		if seg.Compressed {
+			zr, err := gzip.NewReader(rc)
+			if err != nil {
+				problem("Segment %s: %s", seg.File, err)
+				_ = rc.Close()
+				continue
+			}
+			src = zr
+		}
+		r := bufio.NewReaderSize(src, 64*1024)
+		var offset int64
+		for {
+			line, err := r.ReadBytes('\n')
+			if len(line) == 0 {
+				if err != nil && err != io.EOF {
+					problem("Segment %s: %s", seg.File, err)
+				}
+				break
+			}
+			if _, ok := parseLine(line); !ok {
+				problem("Unreadable line in %s at offset %d", seg.File, offset)
+				offset += int64(len(line))
+				continue
+			}
+			body, hash, hashed := splitLine(line)
+			if !hashed {
+				problem("Record %d in %s at offset %d has no hash", ordinal, seg.File, offset)
+			} else {
+				if chainHash(prev, body) != hash {
+					problem("Record %d in %s at offset %d does not match the hash chain", ordinal, seg.File, offset)
+				}
+				prev = hash
+				report.Records++
+				if want, ok := expected[ordinal]; ok {
+					delete(expected, ordinal)
+					if want != hash {
+						problem("Record %d does not match its checkpoint", ordinal)
+					} else if ordinal > report.LastCheckpoint {
+						report.LastCheckpoint = ordinal
+					}
+				}
+			}
+			offset += int64(len(line))
+			ordinal++
+		}
+		_ = rc.Close()
+	}
+	for missing := range expected {
+		problem("Checkpoint at record %d refers to a missing record, the log was truncated", missing)
+	}
+	report.OK = len(report.Problems) == 0
+	return report
+}
+
+// 校验运行中的存储，只校验开始校验时已经写入的内容
+func (s *store) verify() AuditReport {
+	s.mutex.RLock()
+	segments := append([]Segment(nil), s.segments...)
+	written := s.checkpoints
+	s.mutex.RUnlock()
+	open := func(seg Segment) (io.ReadCloser, error) {
+		s.mutex.RLock()
+		defer s.mutex.RUnlock()
+		// 压缩完成后文件名会改变
+		if i := s.segmentIndex(seg.ID); i >= 0 {
+			seg = s.segments[i]
+		}
+		f, err := os.Open(filepath.Join(s.cfg.Dir, seg.File))
+		if err != nil || seg.Compressed {
+			return f, err
+		}
+		return limitedFile{Reader: io.LimitReader(f, seg.Size), Closer: f}, nil
+	}
+	return verifyAudit(s.cfg.Dir, segments, written, open, s.cfg.AuditKey.Public().(ed25519.PublicKey))
+}
+
+type limitedFile struct {
+	io.Reader
+	io.Closer
+}
+
+// GET /audit/verify 校验审计日志
+func auditHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if logStore == nil || logStore.cfg.AuditKey == nil {
+		http.Error(w, "Audit mode is not enabled", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(logStore.verify())
+}
@@ -0,0 +1,162 @@
+package log
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestVerifyAudit(t *testing.T) {
+	key := ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+	pub := key.Public().(ed25519.PublicKey)
+	// 修改目录中的文件，segment 为分段文件的路径
+	type change func(t *testing.T, dir, segment string)
+	// name 为空时修改分段文件
+	rewriteLines := func(name string, edit func(lines [][]byte) [][]byte) change {
+		return func(t *testing.T, dir, segment string) {
+			path := segment
+			if name != "" {
+				path = filepath.Join(dir, name)
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			lines := bytes.SplitAfter(data, []byte("\n"))
+			if err := os.WriteFile(path, bytes.Join(edit(lines), nil), 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	tests := []struct {
+		name   string
+		change change
+		// 为空表示校验通过，否则为其中一个问题包含的内容
+		problem string
+	}{
+		{
+			name:   "untouched log",
+			change: func(*testing.T, string, string) {},
+		},
+		{
+			name: "modified message",
+			change: rewriteLines("", func(lines [][]byte) [][]byte {
+				lines[3] = bytes.Replace(lines[3], []byte("record 000003"), []byte("record 999999"), 1)
+				return lines
+			}),
+			problem: "Record 3 in segment",
+		},
+		{
+			name: "deleted record",
+			change: rewriteLines("", func(lines [][]byte) [][]byte {
+				return append(lines[:2:2], lines[3:]...)
+			}),
+			problem: "does not match the hash chain",
+		},
+		{
+			name: "truncated log",
+			change: rewriteLines("", func(lines [][]byte) [][]byte {
+				return lines[:7]
+			}),
+			problem: "Checkpoint at record 9 refers to a missing record",
+		},
+		{
+			name: "leading record without a hash",
+			change: rewriteLines("", func(lines [][]byte) [][]byte {
+				data, _ := json.Marshal(testRecord(0))
+				lines[0] = append(data, '\n')
+				return lines
+			}),
+			problem: "Record 0 in segment",
+		},
+		{
+			name: "all hashes removed",
+			change: rewriteLines("", func(lines [][]byte) [][]byte {
+				for i := range lines {
+					if len(lines[i]) > 0 {
+						data, _ := json.Marshal(testRecord(i))
+						lines[i] = append(data, '\n')
+					}
+				}
+				return lines
+			}),
+			problem: "has no hash",
+		},
+		{
+			name: "bad checkpoint signature",
+			change: rewriteLines(checkpointFile, func(lines [][]byte) [][]byte {
+				var c Checkpoint
+				_ = json.Unmarshal(lines[0], &c)
+				c.Ordinal = 3
+				data, _ := json.Marshal(c)
+				lines[0] = append(data, '\n')
+				return lines
+			}),
+			problem: "Checkpoint at record 3 has an invalid signature",
+		},
+		{
+			name: "deleted checkpoints file",
+			change: func(t *testing.T, dir, _ string) {
+				if err := os.Remove(filepath.Join(dir, checkpointFile)); err != nil {
+					t.Fatal(err)
+				}
+			},
+			problem: "missing or empty, 2 checkpoints were written",
+		},
+		{
+			name: "emptied checkpoints file",
+			change: rewriteLines(checkpointFile, func([][]byte) [][]byte {
+				return nil
+			}),
+			problem: "missing or empty",
+		},
+		{
+			name: "truncated checkpoints file",
+			change: rewriteLines(checkpointFile, func(lines [][]byte) [][]byte {
+				return lines[:1]
+			}),
+			problem: "has 1 of the 2 checkpoints written",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := openTestStore(t, Config{AuditKey: key})
+			for _, n := range []int{5, 10} {
+				appendRecords(t, s, int(s.first)+len(s.entries), n)
+				s.mutex.Lock()
+				err := s.checkpoint()
+				s.mutex.Unlock()
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			dir := s.cfg.Dir
+			tt.change(t, dir, filepath.Join(dir, s.manifest()[0].File))
+
+			report, err := Verify(dir, pub)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.problem == "" {
+				if !report.OK || report.Records != 10 || report.Checkpoints != 2 || report.LastCheckpoint != 9 {
+					t.Fatalf("report = %+v, want OK with 10 records and 2 checkpoints", report)
+				}
+				return
+			}
+			if report.OK {
+				t.Fatalf("report is OK, want a problem containing %q", tt.problem)
+			}
+			found := false
+			for _, p := range report.Problems {
+				found = found || strings.Contains(p, tt.problem)
+			}
+			if !found {
+				t.Errorf("problems = %q, want one containing %q", report.Problems, tt.problem)
+			}
+		})
+	}
+}
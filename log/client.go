@@ -2,31 +2,138 @@ package log
 
 import (
 	"Distribute/registry"
-	"bytes"
-	"fmt"
+	"hash/fnv"
 	stlog "log"
-	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
 )
 
-func SetClientLogger(ServiceURL string, clientService registry.ServiceName) {
-	stlog.SetPrefix(fmt.Sprintf("[%v] - ", clientService))
-	// 不设置 flag
+// 关闭客户端时最多等待发送剩余日志的时间
+const closeTimeout = 5 * time.Second
+
+// SetClientLogger 将当前进程的日志批量异步发送到日志服务
+// 存在多个日志服务实例时按服务名选择其中一个，并跟随注册中心的更新切换
+// 没有可用的日志服务或发送失败时，记录暂存到 spool 并同时写入 ClientOptions.Fallback，日志服务出现后自动补发
+// 标准库 log 的输出同样会转换为 info 级别的记录，方便未改造的代码继续使用
+// spool 文件按服务名与服务地址区分，同一主机上的多个实例互不影响
+func SetClientLogger(r registry.Registration) {
+	clientService := r.ServiceName
+	var target string
+	if urls := registry.ProvidersOf(registry.LogService); len(urls) > 0 {
+		target = partition(urls, string(clientService))
+	}
+	listenOnce.Do(func() { registry.AddProviderListener(logServiceChanged) })
+	cl := clientLogger{shipper: newShipper(target, spoolName(r), DefaultClientOptions, nil)}
+	outputMutex.Lock()
+	previous, _ := output.(clientLogger)
+	serviceName = string(clientService)
+	output = cl
+	outputMutex.Unlock()
+	if previous.shipper != nil {
+		previous.shipper.Close(closeTimeout)
+	}
+	// 服务名已经记录在日志中，不再设置前缀与 flag
+	stlog.SetPrefix("")
 	stlog.SetFlags(0)
-	stlog.SetOutput(clientLogger{url: ServiceURL})
+	stlog.SetOutput(cl)
+}
+
+var listenOnce sync.Once
+
+// spool 文件名，由服务名与服务监听的地址组成，重启后仍使用同一个文件
+func spoolName(r registry.Registration) string {
+	name := string(r.ServiceName)
+	if u, err := url.Parse(r.ServiceURL); err == nil && u.Host != "" {
+		// Windows 的文件名不能包含冒号
+		name += "-" + strings.ReplaceAll(u.Host, ":", "_")
+	}
+	return name
+}
+
+// 日志服务实例变化时重新选择发送目标，没有可用实例时断开，之后的记录暂存到 spool 并写入 fallback
+func logServiceChanged(name registry.ServiceName, urls []string) {
+	if name != registry.LogService {
+		return
+	}
+	outputMutex.RLock()
+	cl, ok := output.(clientLogger)
+	service := serviceName
+	outputMutex.RUnlock()
+	if !ok {
+		return
+	}
+	target := ""
+	if len(urls) > 0 {
+		target = partition(urls, service)
+	}
+	if previous := cl.shipper.retarget(target); previous != target {
+		if target == "" {
+			stlog.Printf("Log service %s removed, logging locally until another one is available\n", previous)
+		} else {
+			stlog.Printf("Shipping logs to %s\n", target)
+		}
+	}
+}
+
+// 按 rendezvous hashing 为 key 选择实例，实例增减时只有少部分 key 改变目标
+func partition(urls []string, key string) string {
+	var best string
+	var bestScore uint64
+	for _, url := range urls {
+		h := fnv.New64a()
+		_, _ = h.Write([]byte(url))
+		_, _ = h.Write([]byte{0})
+		_, _ = h.Write([]byte(key))
+		if score := h.Sum64(); best == "" || score > bestScore {
+			best, bestScore = url, score
+		}
+	}
+	return best
+}
+
+// Flush 立即发送缓存中的日志
+func Flush() {
+	outputMutex.RLock()
+	cl, ok := output.(clientLogger)
+	outputMutex.RUnlock()
+	if ok {
+		cl.shipper.Flush(closeTimeout)
+	}
+}
+
+// Close 发送剩余日志并停止客户端，之后的日志输出到标准错误，服务退出前调用
+func Close() {
+	outputMutex.Lock()
+	cl, ok := output.(clientLogger)
+	output = console
+	outputMutex.Unlock()
+	stlog.SetOutput(os.Stderr)
+	if ok {
+		cl.shipper.Close(closeTimeout)
+	}
 }
 
 type clientLogger struct {
-	url string
+	shipper *shipper
 }
 
+// Write 接收标准库 log 的输出
 func (cl clientLogger) Write(data []byte) (int, error) {
-	b := bytes.NewBuffer(data)
-	res, err := http.Post(cl.url+"/log", "text/plain", b)
-	if err != nil {
+	rec := recordFromText(string(data))
+	outputMutex.RLock()
+	rec.Service, rec.Instance = serviceName, instanceID
+	outputMutex.RUnlock()
+	if err := cl.WriteRecord(rec); err != nil {
 		return 0, err
 	}
-	if res.StatusCode != http.StatusOK {
-		return 0, fmt.Errorf("Failed to send log message , Service Responded wrong")
-	}
 	return len(data), nil
 }
+
+// WriteRecord 放入发送队列后立即返回，队列已满时记录被丢弃
+func (cl clientLogger) WriteRecord(rec Record) error {
+	cl.shipper.enqueue(rec)
+	return nil
+}
@@ -0,0 +1,357 @@
+package log
+
+import (
+	"Distribute/registry"
+	"Distribute/trace"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 日志服务可以部署多个实例，客户端按服务名将记录发送到其中一个实例
+// 查询时接收请求的实例同时查询其他实例（scope=local），再按时间合并结果
+
+// scope 参数为 local 时只查询本实例，实例之间互相查询时使用
+const scopeLocal = "local"
+
+// 合并查询的游标以该前缀开头，其余部分为各实例游标的 base64 编码
+const clusterCursorPrefix = "c."
+
+// 查询其他实例的超时时间
+const peerTimeout = 5 * time.Second
+
+// 本实例的地址，由 Run 根据 Config.URL 设置，用于在合并查询的游标中标识本实例
+var selfURL string
+
+func selfKey() string {
+	if selfURL == "" {
+		return "self"
+	}
+	return selfURL
+}
+
+// 其他日志服务实例，注册中心不会将实例自身发送给自己
+func peers() []string {
+	var result []string
+	for _, u := range registry.ProvidersOf(registry.LogService) {
+		if u != selfURL {
+			result = append(result, u)
+		}
+	}
+	return result
+}
+
+func encodeCursor(cursors map[string]string) string {
+	data, _ := json.Marshal(cursors)
+	return clusterCursorPrefix + base64.RawURLEncoding.EncodeToString(data)
+}
+
+// 解析合并查询的游标，单实例的游标视为本实例的游标
+func decodeCursor(cursor string) (map[string]string, error) {
+	result := make(map[string]string)
+	if cursor == "" {
+		return result, nil
+	}
+	if !strings.HasPrefix(cursor, clusterCursorPrefix) {
+		result[selfKey()] = cursor
+		return result, nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(cursor, clusterCursorPrefix))
+	if err == nil {
+		err = json.Unmarshal(data, &result)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Invalid cursor %q", cursor)
+	}
+	return result, nil
+}
+
+// 本实例的查询，游标可以是合并查询的游标，跳过其中记录的已经返回过的记录
+func queryLocal(q Query, page Page) (QueryResult, error) {
+	cursors, err := decodeCursor(page.Cursor)
+	if err != nil {
+		return QueryResult{}, err
+	}
+	base, skip, err := splitCursor(cursors[selfKey()])
+	if err != nil {
+		return QueryResult{}, fmt.Errorf("Invalid cursor %q", page.Cursor)
+	}
+	page.Cursor = base
+	result, err := logStore.query(q, page)
+	if err != nil || len(skip) == 0 {
+		return result, err
+	}
+	// 合并查询中已经返回过的记录
+	records, ordinals := result.Records[:0], result.Cursors[:0]
+	for i, rec := range result.Records {
+		if ordinal, _ := strconv.Atoi(result.Cursors[i]); !skip[ordinal] {
+			records = append(records, rec)
+			ordinals = append(ordinals, result.Cursors[i])
+		}
+	}
+	result.Records, result.Cursors = records, ordinals
+	if result.NextCursor != "" {
+		result.NextCursor = joinCursor(result.NextCursor, skipAfter(skip, result.NextCursor, page.Desc))
+	}
+	return result, nil
+}
+
+/**
+ * queryCluster
+ * @Description: 并发查询本实例与其他实例，按时间合并各实例的结果，游标中记录每个实例已返回到的位置
+ *	各实例的结果按写入顺序排列，合并前先按时间排序，见 sortPage 与 nextCursor
+ *	无法访问的实例记录在 Unavailable 中，其游标保持不变，下一页时重试
+ * @param ctx
+ * @param values 原始查询参数，原样转发给其他实例
+ * @param q
+ * @param page
+ * @param instances 其他实例的地址
+ * @return QueryResult
+ * @return error
+ */
+func queryCluster(ctx context.Context, values url.Values, q Query, page Page, instances []string) (QueryResult, error) {
+	cursors, err := decodeCursor(page.Cursor)
+	if err != nil {
+		return QueryResult{}, err
+	}
+	keys := append([]string{selfKey()}, instances...)
+	bases := make([]string, len(keys))
+	skips := make([]map[int]bool, len(keys))
+	for i, key := range keys {
+		if bases[i], skips[i], err = splitCursor(cursors[key]); err != nil {
+			return QueryResult{}, fmt.Errorf("Invalid cursor %q", page.Cursor)
+		}
+	}
+	results := make([]QueryResult, len(keys))
+	errs := make([]error, len(keys))
+	var wg sync.WaitGroup
+	for i, key := range keys {
+		wg.Add(1)
+		go func(i int, key string) {
+			defer wg.Done()
+			p := page
+			p.Cursor = bases[i]
+			if i == 0 {
+				results[i], errs[i] = logStore.query(q, p)
+				return
+			}
+			results[i], errs[i] = queryPeer(ctx, key, values, p)
+		}(i, key)
+	}
+	wg.Wait()
+	pages := make([][]pageRecord, len(keys))
+	for i, key := range keys {
+		if errs[i] == nil {
+			pages[i], errs[i] = sortPage(key, results[i], skips[i], page.Desc)
+		}
+	}
+	if errs[0] != nil {
+		return QueryResult{}, errs[0]
+	}
+
+	result := QueryResult{Records: make([]Record, 0)}
+	for i, key := range keys {
+		if errs[i] != nil {
+			result.Unavailable = append(result.Unavailable, key)
+		}
+	}
+	// 每页按时间排序后依次取出时间最早（倒序时最晚）的记录，时间相同时按实例顺序
+	heads := make([]int, len(keys))
+	for len(result.Records) < page.Limit {
+		best := -1
+		for i := range keys {
+			if errs[i] != nil || heads[i] >= len(pages[i]) {
+				continue
+			}
+			if best < 0 {
+				best = i
+				continue
+			}
+			t, bestTime := pages[i][heads[i]].rec.Time, pages[best][heads[best]].rec.Time
+			if (!page.Desc && t.Before(bestTime)) || (page.Desc && t.After(bestTime)) {
+				best = i
+			}
+		}
+		if best < 0 {
+			break
+		}
+		r := &pages[best][heads[best]]
+		r.taken = true
+		result.Records = append(result.Records, r.rec)
+		heads[best]++
+	}
+
+	next := make(map[string]string, len(keys))
+	more := false
+	for i, key := range keys {
+		if errs[i] != nil {
+			if cursors[key] != "" {
+				next[key] = cursors[key]
+			}
+			continue
+		}
+		if heads[i] < len(pages[i]) || results[i].NextCursor != "" {
+			more = true
+		}
+		if c := nextCursor(bases[i], skips[i], pages[i], page.Desc); c != "" {
+			next[key] = c
+		}
+	}
+	if more {
+		result.NextCursor = encodeCursor(next)
+	}
+	return result, nil
+}
+
+// 合并时实例返回的一条记录，pos 为记录在实例结果中的位置，taken 表示已经放入本页
+type pageRecord struct {
+	rec     Record
+	ordinal int
+	pos     int
+	taken   bool
+}
+
+/**
+ * sortPage
+ * @Description: 实例的结果按写入顺序排列，记录的时间由客户端给出，不一定有序
+ *	去掉之前已经返回过的记录后按时间排序，时间相同时保持写入顺序
+ * @param key
+ * @param result
+ * @param skip 之前已经返回过的记录序号
+ * @param desc
+ * @return []pageRecord 按时间排序的记录，pos 仍为排序前的位置
+ * @return error
+ */
+func sortPage(key string, result QueryResult, skip map[int]bool, desc bool) ([]pageRecord, error) {
+	if len(result.Cursors) != len(result.Records) {
+		return nil, fmt.Errorf("Log service %s returned %d cursors for %d records", key, len(result.Cursors), len(result.Records))
+	}
+	page := make([]pageRecord, 0, len(result.Records))
+	for i, rec := range result.Records {
+		ordinal, err := strconv.Atoi(result.Cursors[i])
+		if err != nil {
+			return nil, fmt.Errorf("Log service %s returned invalid cursor %q", key, result.Cursors[i])
+		}
+		if !skip[ordinal] {
+			page = append(page, pageRecord{rec: rec, ordinal: ordinal, pos: len(page)})
+		}
+	}
+	sort.SliceStable(page, func(i, j int) bool {
+		if desc {
+			return page[i].rec.Time.After(page[j].rec.Time)
+		}
+		return page[i].rec.Time.Before(page[j].rec.Time)
+	})
+	return page, nil
+}
+
+/**
+ * nextCursor
+ * @Description: 实例的游标只能表示按写入顺序返回到的位置
+ *	游标前进到写入顺序中连续已返回的最后一条记录，其后已经返回的记录序号记在游标中，下一页时跳过
+ * @param base 本页查询实例时使用的游标
+ * @param skip 本页之前已经返回过的记录序号
+ * @param page
+ * @param desc
+ * @return string
+ */
+func nextCursor(base string, skip map[int]bool, page []pageRecord, desc bool) string {
+	taken := make([]*pageRecord, len(page))
+	for i := range page {
+		if page[i].taken {
+			taken[page[i].pos] = &page[i]
+		}
+	}
+	i := 0
+	for i < len(taken) && taken[i] != nil {
+		base = strconv.Itoa(taken[i].ordinal)
+		i++
+	}
+	rest := skipAfter(skip, base, desc)
+	for _, r := range taken[i:] {
+		if r != nil {
+			rest = append(rest, r.ordinal)
+		}
+	}
+	return joinCursor(base, rest)
+}
+
+// skip 中仍在游标 base 之后、需要继续跳过的记录序号，base 为空表示从头开始
+func skipAfter(skip map[int]bool, base string, desc bool) []int {
+	b, err := strconv.Atoi(base)
+	var result []int
+	for ordinal := range skip {
+		if err != nil || (!desc && ordinal > b) || (desc && ordinal < b) {
+			result = append(result, ordinal)
+		}
+	}
+	return result
+}
+
+// 合并查询的游标中单个实例的部分，格式为 实例游标[+已返回的记录序号,...]
+func splitCursor(cursor string) (string, map[int]bool, error) {
+	base, list, found := strings.Cut(cursor, "+")
+	if !found {
+		return base, nil, nil
+	}
+	skip := make(map[int]bool)
+	for _, s := range strings.Split(list, ",") {
+		ordinal, err := strconv.Atoi(s)
+		if err != nil {
+			return "", nil, err
+		}
+		skip[ordinal] = true
+	}
+	return base, skip, nil
+}
+
+func joinCursor(base string, skip []int) string {
+	if len(skip) == 0 {
+		return base
+	}
+	sort.Ints(skip)
+	list := make([]string, len(skip))
+	for i, ordinal := range skip {
+		list[i] = strconv.Itoa(ordinal)
+	}
+	return base + "+" + strings.Join(list, ",")
+}
+
+// 以 scope=local 查询其他实例
+func queryPeer(ctx context.Context, peer string, values url.Values, page Page) (QueryResult, error) {
+	var result QueryResult
+	params := url.Values{}
+	for k, v := range values {
+		params[k] = v
+	}
+	params.Set("scope", scopeLocal)
+	params.Set("limit", fmt.Sprint(page.Limit))
+	params.Del("cursor")
+	if page.Cursor != "" {
+		params.Set("cursor", page.Cursor)
+	}
+	ctx, cancel := context.WithTimeout(ctx, peerTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, peer+"/logs?"+params.Encode(), nil)
+	if err != nil {
+		return result, err
+	}
+	res, err := trace.Client.Do(req)
+	if err != nil {
+		return result, err
+	}
+	defer func() { _ = res.Body.Close() }()
+	if res.StatusCode != http.StatusOK {
+		return result, fmt.Errorf("Log service %s responded with code %v", peer, res.StatusCode)
+	}
+	err = json.NewDecoder(res.Body).Decode(&result)
+	return result, err
+}
@@ -0,0 +1,184 @@
+package log
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"testing"
+	"time"
+)
+
+// 以 scope=local 提供 s 中记录的日志服务实例
+func servePeer(t *testing.T, s *store) string {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q, err := ParseQuery(r.URL.Query())
+		if err != nil {
+			t.Error(err)
+		}
+		page, err := ParsePage(r.URL.Query())
+		if err != nil {
+			t.Error(err)
+		}
+		result, err := s.query(q, page)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(result)
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+// 按给定的秒数写入记录，消息为实例名与写入顺序
+func appendAt(t *testing.T, s *store, name string, seconds []int) {
+	t.Helper()
+	for i, sec := range seconds {
+		rec := Record{
+			Time:    testTime.Add(time.Duration(sec) * time.Second),
+			Level:   LevelInfo,
+			Service: "test",
+			Message: fmt.Sprintf("%s-%d", name, i),
+		}
+		if err := s.append(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestQueryClusterOrder(t *testing.T) {
+	tests := []struct {
+		name string
+		// 各实例记录的时间（秒），按写入顺序，第一个为本实例
+		seconds [][]int
+	}{
+		{
+			name:    "sorted instances",
+			seconds: [][]int{{1, 3, 5, 7}, {2, 4, 6, 8}},
+		},
+		{
+			name:    "records written out of time order",
+			seconds: [][]int{{9, 1, 5, 2, 8}, {4, 3, 7, 0, 6}},
+		},
+		{
+			name:    "late records written after newer ones",
+			seconds: [][]int{{10, 11, 12, 1, 2, 3}, {5, 6}},
+		},
+		{
+			name:    "equal times",
+			seconds: [][]int{{1, 1, 1}, {1, 0, 1}},
+		},
+		{
+			name:    "three instances",
+			seconds: [][]int{{3, 2, 1}, {6, 5, 4}, {9, 8, 7}},
+		},
+	}
+	for _, tt := range tests {
+		stores := make([]*store, len(tt.seconds))
+		var instances []string
+		for i, seconds := range tt.seconds {
+			stores[i] = openTestStore(t, Config{})
+			appendAt(t, stores[i], fmt.Sprint(i), seconds)
+			if i > 0 {
+				instances = append(instances, servePeer(t, stores[i]))
+			}
+		}
+		total := 0
+		for _, seconds := range tt.seconds {
+			total += len(seconds)
+		}
+		for _, desc := range []bool{false, true} {
+			for _, limit := range []int{1, 2, 3, 100} {
+				t.Run(fmt.Sprintf("%s/desc=%v/limit=%d", tt.name, desc, limit), func(t *testing.T) {
+					saved := logStore
+					logStore = stores[0]
+					defer func() { logStore = saved }()
+
+					values := url.Values{}
+					if desc {
+						values.Set("order", "desc")
+					}
+					seen := make(map[string]bool)
+					page := Page{Limit: limit, Desc: desc}
+					for pages := 0; ; pages++ {
+						if pages > total {
+							t.Fatalf("paging did not finish after %d pages", pages)
+						}
+						result, err := queryCluster(context.Background(), values, Query{}, page, instances)
+						if err != nil {
+							t.Fatal(err)
+						}
+						if len(result.Unavailable) > 0 {
+							t.Fatalf("unavailable instances %v", result.Unavailable)
+						}
+						if len(result.Records) > limit {
+							t.Fatalf("page has %d records, limit is %d", len(result.Records), limit)
+						}
+						sorted := sort.SliceIsSorted(result.Records, func(i, j int) bool {
+							if desc {
+								return result.Records[i].Time.After(result.Records[j].Time)
+							}
+							return result.Records[i].Time.Before(result.Records[j].Time)
+						})
+						if !sorted {
+							t.Errorf("page is not in time order: %v", result.Records)
+						}
+						for _, rec := range result.Records {
+							if seen[rec.Message] {
+								t.Errorf("record %s returned twice", rec.Message)
+							}
+							seen[rec.Message] = true
+						}
+						if result.NextCursor == "" {
+							break
+						}
+						page.Cursor = result.NextCursor
+					}
+					if len(seen) != total {
+						t.Errorf("returned %d records, want %d", len(seen), total)
+					}
+				})
+			}
+		}
+	}
+}
+
+func TestCursorSkips(t *testing.T) {
+	tests := []struct {
+		cursor string
+		base   string
+		skip   []int
+	}{
+		{cursor: "", base: ""},
+		{cursor: "12", base: "12"},
+		{cursor: "12+15,17", base: "12", skip: []int{15, 17}},
+		{cursor: "+0,3", base: "", skip: []int{0, 3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.cursor, func(t *testing.T) {
+			base, skip, err := splitCursor(tt.cursor)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if base != tt.base || len(skip) != len(tt.skip) {
+				t.Fatalf("splitCursor(%q) = %q, %v", tt.cursor, base, skip)
+			}
+			for _, ordinal := range tt.skip {
+				if !skip[ordinal] {
+					t.Errorf("splitCursor(%q) does not skip %d", tt.cursor, ordinal)
+				}
+			}
+			if got := joinCursor(base, skipAfter(skip, "", false)); got != tt.cursor {
+				t.Errorf("joinCursor = %q, want %q", got, tt.cursor)
+			}
+		})
+	}
+	if _, _, err := splitCursor("12+x"); err == nil {
+		t.Error("splitCursor accepted an invalid ordinal")
+	}
+}
@@ -0,0 +1,153 @@
+package log
+
+import (
+	"Distribute/trace"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// 记录的输出目标，默认输出到标准错误，SetClientLogger 后发送到日志服务
+type recordWriter interface {
+	WriteRecord(rec Record) error
+}
+
+// 本地输出，每条记录一行 JSON
+type consoleWriter struct {
+	mutex *sync.Mutex
+}
+
+func (cw consoleWriter) WriteRecord(rec Record) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	cw.mutex.Lock()
+	defer cw.mutex.Unlock()
+	_, err = os.Stderr.Write(append(data, '\n'))
+	return err
+}
+
+var console = consoleWriter{mutex: new(sync.Mutex)}
+
+var (
+	output      recordWriter = console
+	serviceName string
+	instanceID  = defaultInstance()
+	minLevel    = LevelInfo
+	outputMutex = new(sync.RWMutex)
+)
+
+// 默认实例 id 为 主机名-进程号
+func defaultInstance() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprintf("%s-%d", host, os.Getpid())
+}
+
+// SetLevel 设置最低输出级别，低于该级别的日志被忽略
+func SetLevel(level Level) {
+	outputMutex.Lock()
+	minLevel = level
+	outputMutex.Unlock()
+}
+
+// SetInstance 设置当前进程在日志中的实例 id，默认为 主机名-进程号
+func SetInstance(id string) {
+	outputMutex.Lock()
+	instanceID = id
+	outputMutex.Unlock()
+}
+
+// Logger 分级的结构化日志，通过 With 附加字段
+type Logger struct {
+	fields Fields
+}
+
+var std = &Logger{}
+
+// With 返回附加了 fields 的 Logger，原 Logger 不受影响
+func With(fields Fields) *Logger {
+	return std.With(fields)
+}
+
+func (l *Logger) With(fields Fields) *Logger {
+	merged := make(Fields, len(l.fields)+len(fields))
+	for k, v := range l.fields {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+	return &Logger{fields: merged}
+}
+
+func (l *Logger) Debugf(ctx context.Context, format string, v ...interface{}) {
+	l.log(ctx, LevelDebug, fmt.Sprintf(format, v...))
+}
+
+func (l *Logger) Infof(ctx context.Context, format string, v ...interface{}) {
+	l.log(ctx, LevelInfo, fmt.Sprintf(format, v...))
+}
+
+func (l *Logger) Warnf(ctx context.Context, format string, v ...interface{}) {
+	l.log(ctx, LevelWarn, fmt.Sprintf(format, v...))
+}
+
+func (l *Logger) Errorf(ctx context.Context, format string, v ...interface{}) {
+	l.log(ctx, LevelError, fmt.Sprintf(format, v...))
+}
+
+func Debugf(ctx context.Context, format string, v ...interface{}) { std.Debugf(ctx, format, v...) }
+func Infof(ctx context.Context, format string, v ...interface{})  { std.Infof(ctx, format, v...) }
+func Warnf(ctx context.Context, format string, v ...interface{})  { std.Warnf(ctx, format, v...) }
+func Errorf(ctx context.Context, format string, v ...interface{}) { std.Errorf(ctx, format, v...) }
+
+/**
+ * log
+ * @Description: 生成记录并输出，ctx 处于调用链中时记录 trace id 与 span id
+ * @receiver l
+ * @param ctx
+ * @param level
+ * @param msg
+ */
+func (l *Logger) log(ctx context.Context, level Level, msg string) {
+	outputMutex.RLock()
+	out, service, instance, min := output, serviceName, instanceID, minLevel
+	outputMutex.RUnlock()
+	if level < min {
+		return
+	}
+	rec := Record{
+		Time:     time.Now(),
+		Level:    level,
+		Service:  service,
+		Instance: instance,
+		Message:  msg,
+	}
+	if len(l.fields) > 0 {
+		rec.Fields = make(Fields, len(l.fields)+1)
+		for k, v := range l.fields {
+			// error 直接序列化为 {}，转换为字符串保存
+			if err, ok := v.(error); ok {
+				v = err.Error()
+			}
+			rec.Fields[k] = v
+		}
+	}
+	if sc, ok := trace.FromContext(ctx); ok {
+		rec.TraceID = sc.TraceID
+		if rec.Fields == nil {
+			rec.Fields = make(Fields, 1)
+		}
+		rec.Fields["span_id"] = sc.SpanID
+	}
+	if err := out.WriteRecord(rec); err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to write log record: ", err)
+	}
+}
@@ -0,0 +1,196 @@
+package log
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Query 日志查询条件，未设置的条件不参与过滤
+type Query struct {
+	Service string
+	// 最低日志级别
+	Level    Level
+	HasLevel bool
+	Since    time.Time
+	Until    time.Time
+	// 消息中包含的子串，不区分大小写
+	Substring string
+	Regex     *regexp.Regexp
+	TraceID   string
+}
+
+/**
+ * ParseQuery
+ * @Description: 从请求参数中解析查询条件
+ *	service   服务名
+ *	level     最低日志级别
+ *	since     起始时间（包含），RFC 3339 格式
+ *	until     结束时间（不包含），RFC 3339 格式
+ *	q         消息中包含的子串
+ *	regex     消息需要匹配的正则表达式
+ *	trace_id  调用链 id
+ * @param values
+ * @return Query
+ * @return error
+ */
+func ParseQuery(values url.Values) (Query, error) {
+	var q Query
+	var err error
+	q.Service = values.Get("service")
+	q.TraceID = values.Get("trace_id")
+	q.Substring = values.Get("q")
+	if s := values.Get("level"); s != "" {
+		if q.Level, err = ParseLevel(s); err != nil {
+			return q, err
+		}
+		q.HasLevel = true
+	}
+	if s := values.Get("since"); s != "" {
+		if q.Since, err = time.Parse(time.RFC3339Nano, s); err != nil {
+			return q, fmt.Errorf("Invalid since: %s", err)
+		}
+	}
+	if s := values.Get("until"); s != "" {
+		if q.Until, err = time.Parse(time.RFC3339Nano, s); err != nil {
+			return q, fmt.Errorf("Invalid until: %s", err)
+		}
+	}
+	if s := values.Get("regex"); s != "" {
+		if q.Regex, err = regexp.Compile(s); err != nil {
+			return q, fmt.Errorf("Invalid regex: %s", err)
+		}
+	}
+	return q, nil
+}
+
+// Matches 判断记录是否满足所有查询条件
+func (q Query) Matches(rec Record) bool {
+	if q.Service != "" && rec.Service != q.Service {
+		return false
+	}
+	if q.HasLevel && rec.Level < q.Level {
+		return false
+	}
+	if q.TraceID != "" && rec.TraceID != q.TraceID {
+		return false
+	}
+	if !q.matchesTime(rec.Time) {
+		return false
+	}
+	if q.Substring != "" && !strings.Contains(strings.ToLower(rec.Message), strings.ToLower(q.Substring)) {
+		return false
+	}
+	if q.Regex != nil && !q.Regex.MatchString(rec.Message) {
+		return false
+	}
+	return true
+}
+
+func (q Query) matchesTime(t time.Time) bool {
+	if !q.Since.IsZero() && t.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && !t.Before(q.Until) {
+		return false
+	}
+	return true
+}
+
+// 时间范围 [min, max] 内是否可能有满足条件的记录
+func (q Query) overlaps(min, max time.Time) bool {
+	if !q.Since.IsZero() && max.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && !min.Before(q.Until) {
+		return false
+	}
+	return true
+}
+
+// Page 分页参数
+type Page struct {
+	Limit int
+	// 上一页返回的 NextCursor，为空表示从头开始
+	Cursor string
+	// 为 true 时按时间倒序返回
+	Desc bool
+}
+
+const (
+	defaultLimit = 100
+	maxLimit     = 1000
+)
+
+// ParsePage 从请求参数中解析分页参数：limit、cursor、order（asc 或 desc）
+func ParsePage(values url.Values) (Page, error) {
+	p := Page{Limit: defaultLimit, Cursor: values.Get("cursor")}
+	if s := values.Get("limit"); s != "" {
+		limit, err := strconv.Atoi(s)
+		if err != nil || limit <= 0 {
+			return p, fmt.Errorf("Invalid limit %q", s)
+		}
+		p.Limit = limit
+	}
+	if p.Limit > maxLimit {
+		p.Limit = maxLimit
+	}
+	switch values.Get("order") {
+	case "", "asc":
+	case "desc":
+		p.Desc = true
+	default:
+		return p, fmt.Errorf("Invalid order %q", values.Get("order"))
+	}
+	return p, nil
+}
+
+// QueryResult 查询结果，NextCursor 为空表示没有更多记录
+type QueryResult struct {
+	Records    []Record
+	NextCursor string `json:",omitempty"`
+	// 每条记录对应的游标，只在 scope=local 的查询中返回，用于合并多个实例的结果
+	Cursors []string `json:",omitempty"`
+	// 合并查询时无法访问的实例，结果中缺少这些实例的记录
+	Unavailable []string `json:",omitempty"`
+}
+
+// GET /logs 查询日志，参数见 ParseQuery 与 ParsePage
+// 存在多个日志服务实例时合并所有实例的结果，scope=local 时只查询本实例
+func queryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	q, err := ParseQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	page, err := ParsePage(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var result QueryResult
+	local := r.URL.Query().Get("scope") == scopeLocal
+	if instances := peers(); local || len(instances) == 0 {
+		result, err = queryLocal(q, page)
+		if !local {
+			result.Cursors = nil
+		}
+	} else {
+		result, err = queryCluster(r.Context(), r.URL.Query(), q, page, instances)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(result)
+}
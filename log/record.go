@@ -0,0 +1,116 @@
+package log
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Level 日志级别
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelError {
+		return fmt.Sprintf("level(%d)", int(l))
+	}
+	return levelNames[l]
+}
+
+// ParseLevel 解析日志级别，不区分大小写，warning 视为 warn
+func ParseLevel(s string) (Level, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s == "warning" {
+		s = "warn"
+	}
+	for i, name := range levelNames {
+		if s == name {
+			return Level(i), nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("Unknown log level %q", s)
+}
+
+func (l Level) MarshalJSON() ([]byte, error) {
+	if l < LevelDebug || l > LevelError {
+		return nil, fmt.Errorf("Invalid log level %d", int(l))
+	}
+	return json.Marshal(l.String())
+}
+
+func (l *Level) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("Log level must be a string")
+	}
+	level, err := ParseLevel(s)
+	if err != nil {
+		return err
+	}
+	*l = level
+	return nil
+}
+
+// Fields 日志附带的任意字段
+type Fields map[string]interface{}
+
+// Record 结构化日志记录，日志服务以 JSON Lines 格式保存
+type Record struct {
+	Time     time.Time
+	Level    Level
+	Service  string
+	Instance string `json:",omitempty"`
+	TraceID  string `json:",omitempty"`
+	Message  string
+	Fields   Fields `json:",omitempty"`
+	// 审计模式下由日志服务计算的哈希链，见 audit.go，必须是最后一个字段
+	Hash string `json:",omitempty"`
+}
+
+// 允许客户端时间比服务端超前的范围
+const maxClockSkew = 5 * time.Minute
+
+// Validate 检查日志记录是否合法，没有时间的记录使用当前时间
+func (rec *Record) Validate() error {
+	if strings.TrimSpace(rec.Message) == "" {
+		return fmt.Errorf("Message is required")
+	}
+	if rec.Level < LevelDebug || rec.Level > LevelError {
+		return fmt.Errorf("Invalid log level %d", int(rec.Level))
+	}
+	now := time.Now()
+	if rec.Time.IsZero() {
+		rec.Time = now
+	}
+	if rec.Time.After(now.Add(maxClockSkew)) {
+		return fmt.Errorf("Time %v is in the future", rec.Time)
+	}
+	return nil
+}
+
+// 旧版客户端发送的文本日志格式为 "[ServiceName] - message"
+var textPrefix = regexp.MustCompile(`^\[([^\]]+)\] - `)
+
+// 将纯文本日志转换为记录，兼容旧版客户端
+func recordFromText(text string) Record {
+	rec := Record{
+		Time:    time.Now(),
+		Level:   LevelInfo,
+		Message: strings.TrimRight(text, "\r\n"),
+	}
+	if m := textPrefix.FindStringSubmatch(rec.Message); m != nil {
+		rec.Service = m[1]
+		rec.Message = rec.Message[len(m[0]):]
+	}
+	return rec
+}
@@ -0,0 +1,626 @@
+package log
+
+import (
+	"Distribute/metrics"
+	"bufio"
+	"compress/gzip"
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"io"
+	stlog "log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Config 日志服务的存储配置
+type Config struct {
+	// 分段文件与 manifest.json 所在的目录
+	Dir string
+	// 当前分段超过该字节数后切换到新分段
+	MaxSegmentBytes int64
+	// 当前分段创建超过该时长后切换到新分段，0 表示不按时间切换
+	MaxSegmentAge time.Duration
+	// 删除封存超过该时长的分段，0 表示不按时间删除
+	RetentionAge time.Duration
+	// 分段在磁盘上的总字节数超过该值时从最旧的分段开始删除，0 表示不限制
+	RetentionBytes int64
+	// 使用 gzip 压缩封存的分段
+	Compress bool
+	// 旧版日志服务写入的单个日志文件，目录中还没有分段时作为第一个分段导入
+	Legacy string
+	// 本实例对外的地址，存在多个实例时用于合并查询
+	URL string
+	// 不为 nil 时启用审计模式，记录以哈希链保存并用该密钥签名检查点，见 audit.go
+	AuditKey ed25519.PrivateKey
+}
+
+var DefaultConfig = Config{
+	Dir:             "./logs",
+	MaxSegmentBytes: 64 << 20,
+	MaxSegmentAge:   24 * time.Hour,
+	RetentionAge:    7 * 24 * time.Hour,
+	RetentionBytes:  1 << 30,
+	Compress:        true,
+	Legacy:          "./distribute.log",
+}
+
+// Segment 日志分段的描述，保存在 manifest.json 中
+type Segment struct {
+	ID int
+	// 目录中的文件名，压缩后以 .gz 结尾
+	File       string
+	Compressed bool
+	// 第一条记录的序号，查询游标使用全局序号，删除旧分段后依然有效
+	FirstOrdinal int64
+	Records      int64
+	// 未压缩的字节数，索引中的偏移量均基于未压缩的内容
+	Size int64
+	// 磁盘上的字节数
+	StoredSize int64
+	// 压缩的分段由多个独立的 gzip 成员组成，读取时从偏移量所在的成员开始解压
+	// 旧版本压缩的分段只有一个成员，没有该字段
+	Blocks []Block `json:",omitempty"`
+	// 分段内记录时间的范围，查询时跳过时间范围不相交的分段
+	MinTime time.Time
+	MaxTime time.Time
+	Created time.Time
+	// 零值表示当前写入的分段
+	Sealed time.Time
+}
+
+// Block 压缩分段中一个 gzip 成员的起始位置
+type Block struct {
+	// 成员内容在未压缩分段中的偏移量
+	Offset int64
+	// 成员在压缩文件中的偏移量
+	Stored int64
+}
+
+// 压缩时每个 gzip 成员包含的未压缩字节数，读取一条记录最多需要解压这么多字节
+const compressBlockBytes = 256 << 10
+
+type manifest struct {
+	Segments []Segment
+	// 审计模式下已写入 checkpoints.ndjson 的检查点数，检查点文件缺失或被截断时校验失败
+	Checkpoints int `json:",omitempty"`
+}
+
+const manifestFile = "manifest.json"
+
+// 后台检查按时间切换分段与过期删除的间隔
+const maintenanceInterval = time.Minute
+
+var (
+	segmentRotations = metrics.NewCounter("log_segment_rotations_total",
+		"Log segments sealed by the log service, by reason.",
+		"reason")
+	segmentsDeleted = metrics.NewCounter("log_segments_deleted_total",
+		"Log segments removed by retention, by reason.",
+		"reason")
+)
+
+func init() {
+	metrics.NewGaugeFunc("log_segments",
+		"Log segments currently kept by the log service.",
+		func() float64 {
+			if logStore == nil {
+				return 0
+			}
+			logStore.mutex.RLock()
+			defer logStore.mutex.RUnlock()
+			return float64(len(logStore.segments))
+		})
+	metrics.NewGaugeFunc("log_storage_bytes",
+		"Bytes on disk used by log segments.",
+		func() float64 {
+			if logStore == nil {
+				return 0
+			}
+			logStore.mutex.RLock()
+			defer logStore.mutex.RUnlock()
+			return float64(logStore.storedBytes())
+		})
+}
+
+func segmentFileName(id int) string {
+	return fmt.Sprintf("segment-%06d.log", id)
+}
+
+/**
+ * openStore
+ * @Description: 读取 manifest 并扫描所有分段建立索引，打开最后一个未封存的分段继续写入
+ * @param cfg
+ * @return *store
+ * @return error
+ */
+func openStore(cfg Config) (*store, error) {
+	if err := os.MkdirAll(cfg.Dir, 0700); err != nil {
+		return nil, err
+	}
+	s := &store{
+		cfg:          cfg,
+		postings:     make(map[string][]int32),
+		checkpointed: -1,
+		mutex:        new(sync.RWMutex),
+	}
+	m, err := readManifest(filepath.Join(cfg.Dir, manifestFile))
+	if err != nil {
+		return nil, err
+	}
+	if len(m.Segments) == 0 && cfg.Legacy != "" {
+		if m.Segments, err = importLegacy(cfg); err != nil {
+			return nil, err
+		}
+	}
+	s.segments = checkSegments(cfg.Dir, m.Segments)
+	if cfg.AuditKey != nil {
+		checkpoints, err := readCheckpoints(cfg.Dir)
+		if err != nil {
+			return nil, err
+		}
+		if n := len(checkpoints); n > 0 {
+			s.checkpointed = checkpoints[n-1].Ordinal
+		}
+		// 旧版本的 manifest 没有记录检查点数
+		s.checkpoints = m.Checkpoints
+		if len(checkpoints) > s.checkpoints {
+			s.checkpoints = len(checkpoints)
+		}
+	}
+	if len(s.segments) > 0 {
+		s.first = int32(s.segments[0].FirstOrdinal)
+	}
+	partial := false
+	for i := range s.segments {
+		if partial, err = s.scan(&s.segments[i]); err != nil {
+			return nil, err
+		}
+		// 只有最后一个分段可以继续写入
+		if i < len(s.segments)-1 && s.segments[i].Sealed.IsZero() {
+			s.segments[i].Sealed = time.Now()
+		}
+	}
+	if n := len(s.segments); n == 0 || !s.segments[n-1].Sealed.IsZero() {
+		if err := s.startSegment(); err != nil {
+			return nil, err
+		}
+	} else if err := s.openActive(partial); err != nil {
+		return nil, err
+	}
+	if err := s.saveManifest(); err != nil {
+		return nil, err
+	}
+	if cfg.Compress {
+		for _, seg := range s.segments {
+			if !seg.Sealed.IsZero() && !seg.Compressed {
+				go s.compress(seg.ID)
+			}
+		}
+	}
+	s.mutex.Lock()
+	s.applyRetention()
+	s.mutex.Unlock()
+	go s.maintain()
+	return s, nil
+}
+
+func readManifest(path string) (manifest, error) {
+	var m manifest
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+	if err != nil {
+		return m, err
+	}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return m, fmt.Errorf("Invalid log manifest %s: %s", path, err)
+	}
+	return m, nil
+}
+
+// 将旧版的日志文件移动到目录中，作为已封存的第一个分段
+func importLegacy(cfg Config) ([]Segment, error) {
+	info, err := os.Stat(cfg.Legacy)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	name := segmentFileName(1)
+	if err := os.Rename(cfg.Legacy, filepath.Join(cfg.Dir, name)); err != nil {
+		return nil, fmt.Errorf("Failed to import legacy log %s: %s", cfg.Legacy, err)
+	}
+	return []Segment{{ID: 1, File: name, Created: info.ModTime(), Sealed: time.Now()}}, nil
+}
+
+// 检查分段文件是否存在：压缩中断时压缩文件不存在但原文件仍在，文件都不存在的分段被移除
+func checkSegments(dir string, segments []Segment) []Segment {
+	result := segments[:0]
+	for _, seg := range segments {
+		if _, err := os.Stat(filepath.Join(dir, seg.File)); err != nil {
+			plain := segmentFileName(seg.ID)
+			if _, err := os.Stat(filepath.Join(dir, plain)); !seg.Compressed || err != nil {
+				stlog.Printf("Log segment %s is missing, skipped\n", seg.File)
+				continue
+			}
+			seg.File, seg.Compressed = plain, false
+		}
+		result = append(result, seg)
+	}
+	return result
+}
+
+/**
+ * scan
+ * @Description: 读取分段中的所有记录建立索引，并更新分段的统计信息
+ * @receiver s
+ * @param seg
+ * @return partial 分段以不完整的行结尾
+ * @return err
+ */
+func (s *store) scan(seg *Segment) (partial bool, err error) {
+	f, err := os.Open(filepath.Join(s.cfg.Dir, seg.File))
+	if err != nil {
+		return false, err
+	}
+	defer func() { _ = f.Close() }()
+	info, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+	var src io.Reader = f
+	if seg.Compressed {
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			return false, fmt.Errorf("Corrupted log segment %s: %s", seg.File, err)
+		}
+		src = zr
+	}
+	seg.FirstOrdinal = int64(s.first) + int64(len(s.entries))
+	seg.Records, seg.MinTime, seg.MaxTime = 0, time.Time{}, time.Time{}
+	r := bufio.NewReaderSize(src, 64*1024)
+	var offset int64
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			partial = len(line) > 0
+			offset += int64(len(line))
+			break
+		}
+		if err != nil {
+			return false, err
+		}
+		if rec, ok := parseLine(line); ok {
+			s.index(seg, offset, rec)
+			if rec.Hash != "" {
+				s.lastHash = rec.Hash
+			}
+		}
+		offset += int64(len(line))
+	}
+	seg.Size, seg.StoredSize = offset, info.Size()
+	return partial, nil
+}
+
+// 打开最后一个分段继续写入
+func (s *store) openActive(partial bool) error {
+	seg := &s.segments[len(s.segments)-1]
+	f, err := os.OpenFile(filepath.Join(s.cfg.Dir, seg.File), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if partial {
+		// 上次写入中断留下的不完整行，补上换行，避免与新记录混在同一行
+		if _, err := f.Write([]byte{'\n'}); err != nil {
+			_ = f.Close()
+			return err
+		}
+		seg.Size++
+		seg.StoredSize++
+	}
+	s.active = f
+	return nil
+}
+
+// 创建新的分段作为当前写入的分段，调用方需持有写锁或处于初始化阶段
+func (s *store) startSegment() error {
+	seg := Segment{ID: 1, FirstOrdinal: int64(s.first), Created: time.Now()}
+	if n := len(s.segments); n > 0 {
+		last := s.segments[n-1]
+		seg.ID = last.ID + 1
+		seg.FirstOrdinal = last.FirstOrdinal + last.Records
+	}
+	seg.File = segmentFileName(seg.ID)
+	f, err := os.OpenFile(filepath.Join(s.cfg.Dir, seg.File), os.O_CREATE|os.O_EXCL|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	s.segments = append(s.segments, seg)
+	s.active = f
+	return nil
+}
+
+// 当前分段需要切换的原因，不需要切换时返回空字符串，调用方需持有锁
+func (s *store) rotateReason(size int) string {
+	seg := s.segments[len(s.segments)-1]
+	if seg.Size == 0 {
+		return ""
+	}
+	if s.cfg.MaxSegmentBytes > 0 && seg.Size+int64(size) > s.cfg.MaxSegmentBytes {
+		return "size"
+	}
+	if s.cfg.MaxSegmentAge > 0 && time.Since(seg.Created) >= s.cfg.MaxSegmentAge {
+		return "age"
+	}
+	return ""
+}
+
+/**
+ * rotate
+ * @Description: 封存当前分段并切换到新分段，之后在后台压缩封存的分段并按保留策略删除旧分段，调用方需持有写锁
+ * @receiver s
+ * @param reason
+ * @return error
+ */
+func (s *store) rotate(reason string) error {
+	if err := s.active.Close(); err != nil {
+		return err
+	}
+	sealed := &s.segments[len(s.segments)-1]
+	sealed.Sealed = time.Now()
+	id := sealed.ID
+	if err := s.startSegment(); err != nil {
+		// 无法创建新分段时继续写入原来的分段
+		s.segments[len(s.segments)-1].Sealed = time.Time{}
+		if f, openErr := os.OpenFile(filepath.Join(s.cfg.Dir, s.segments[len(s.segments)-1].File), os.O_APPEND|os.O_WRONLY, 0600); openErr == nil {
+			s.active = f
+		}
+		return err
+	}
+	segmentRotations.With(reason).Inc()
+	s.applyRetention()
+	if err := s.saveManifest(); err != nil {
+		stlog.Println("Failed to save log manifest: ", err)
+	}
+	if s.cfg.Compress {
+		go s.compress(id)
+	}
+	return nil
+}
+
+// 封存的分段压缩为 .gz 文件，完成后更新 manifest 并删除原文件
+func (s *store) compress(id int) {
+	s.mutex.RLock()
+	i := s.segmentIndex(id)
+	var seg Segment
+	if i >= 0 {
+		seg = s.segments[i]
+	}
+	s.mutex.RUnlock()
+	if i < 0 || seg.Compressed {
+		return
+	}
+	src := filepath.Join(s.cfg.Dir, seg.File)
+	dst := src + ".gz"
+	size, blocks, err := gzipFile(src, dst)
+	if err != nil {
+		stlog.Printf("Failed to compress log segment %s: %s\n", seg.File, err)
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	// 压缩期间分段可能已被保留策略删除
+	if i = s.segmentIndex(id); i < 0 {
+		_ = os.Remove(dst)
+		return
+	}
+	s.segments[i].File = filepath.Base(dst)
+	s.segments[i].Compressed = true
+	s.segments[i].StoredSize = size
+	s.segments[i].Blocks = blocks
+	if err := s.saveManifest(); err != nil {
+		stlog.Println("Failed to save log manifest: ", err)
+		return
+	}
+	// 已经打开原文件的查询不受影响
+	_ = os.Remove(src)
+}
+
+/**
+ * gzipFile
+ * @Description: 每 compressBlockBytes 字节压缩为一个 gzip 成员，返回压缩后的大小与每个成员的位置
+ * 先写入临时文件再重命名，中途失败不会留下不完整的压缩文件
+ * @param src
+ * @param dst
+ * @return int64
+ * @return []Block
+ * @return error
+ */
+func gzipFile(src, dst string) (int64, []Block, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer func() { _ = in.Close() }()
+	tmp := dst + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return 0, nil, err
+	}
+	var blocks []Block
+	counter := &countingWriter{w: out}
+	zw := gzip.NewWriter(counter)
+	for offset := int64(0); ; {
+		stored := counter.n
+		zw.Reset(counter)
+		var n int64
+		n, err = io.CopyN(zw, in, compressBlockBytes)
+		if err != nil && err != io.EOF {
+			break
+		}
+		// 空分段同样写入一个成员，保证文件是合法的 gzip
+		if n == 0 && len(blocks) > 0 {
+			err = nil
+			break
+		}
+		if err = zw.Close(); err != nil {
+			break
+		}
+		blocks = append(blocks, Block{Offset: offset, Stored: stored})
+		offset += n
+		if n < compressBlockBytes {
+			break
+		}
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	info, statErr := out.Stat()
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = statErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, dst)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return 0, nil, err
+	}
+	return info.Size(), blocks, nil
+}
+
+// 统计写入的字节数，用于记录每个 gzip 成员的起始位置
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// 按时间与总大小删除最旧的已封存分段，调用方需持有写锁
+func (s *store) applyRetention() {
+	if s.cfg.AuditKey != nil {
+		return
+	}
+	changed := false
+	for len(s.segments) > 1 {
+		oldest := s.segments[0]
+		reason := ""
+		switch {
+		case s.cfg.RetentionAge > 0 && time.Since(oldest.Sealed) > s.cfg.RetentionAge:
+			reason = "age"
+		case s.cfg.RetentionBytes > 0 && s.storedBytes() > s.cfg.RetentionBytes:
+			reason = "size"
+		}
+		if reason == "" {
+			break
+		}
+		if err := os.Remove(filepath.Join(s.cfg.Dir, oldest.File)); err != nil && !os.IsNotExist(err) {
+			stlog.Printf("Failed to remove log segment %s: %s\n", oldest.File, err)
+			break
+		}
+		s.segments = s.segments[1:]
+		s.dropBefore(int32(s.segments[0].FirstOrdinal))
+		segmentsDeleted.With(reason).Inc()
+		changed = true
+	}
+	if changed {
+		if err := s.saveManifest(); err != nil {
+			stlog.Println("Failed to save log manifest: ", err)
+		}
+	}
+}
+
+// 从索引中移除序号小于 ordinal 的记录
+func (s *store) dropBefore(ordinal int32) {
+	if ordinal <= s.first {
+		return
+	}
+	n := int(ordinal - s.first)
+	if n > len(s.entries) {
+		n = len(s.entries)
+	}
+	// 复制剩余部分，释放被删除记录占用的内存
+	s.entries = append([]entry(nil), s.entries[n:]...)
+	s.first = ordinal
+	for term, list := range s.postings {
+		i := sort.Search(len(list), func(i int) bool { return list[i] >= ordinal })
+		if i == len(list) {
+			delete(s.postings, term)
+		} else if i > 0 {
+			s.postings[term] = append([]int32(nil), list[i:]...)
+		}
+	}
+}
+
+// 定期检查是否需要按时间切换分段，以及删除过期的分段
+func (s *store) maintain() {
+	ticker := time.NewTicker(maintenanceInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.mutex.Lock()
+		if reason := s.rotateReason(0); reason == "age" {
+			if err := s.rotate(reason); err != nil {
+				stlog.Println("Failed to rotate log segment: ", err)
+			}
+		} else {
+			s.applyRetention()
+		}
+		if s.cfg.AuditKey != nil {
+			if err := s.checkpoint(); err != nil {
+				stlog.Println("Failed to write audit checkpoint: ", err)
+			}
+		}
+		s.mutex.Unlock()
+	}
+}
+
+func (s *store) storedBytes() int64 {
+	var total int64
+	for _, seg := range s.segments {
+		total += seg.StoredSize
+	}
+	return total
+}
+
+// 分段在 segments 中的下标，不存在时返回 -1
+func (s *store) segmentIndex(id int) int {
+	i := sort.Search(len(s.segments), func(i int) bool { return s.segments[i].ID >= id })
+	if i < len(s.segments) && s.segments[i].ID == id {
+		return i
+	}
+	return -1
+}
+
+// 先写入临时文件再重命名，保证 manifest 始终完整，调用方需持有锁
+func (s *store) saveManifest() error {
+	data, err := json.MarshalIndent(manifest{Segments: s.segments, Checkpoints: s.checkpoints}, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(s.cfg.Dir, manifestFile)
+	if err := os.WriteFile(path+".tmp", data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// 返回当前所有分段的副本
+func (s *store) manifest() []Segment {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return append([]Segment(nil), s.segments...)
+}
@@ -1,45 +1,126 @@
 package log
 
 import (
+	"Distribute/metrics"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
 	"io"
 	stlog "log"
+	"mime"
 	"net/http"
-	"os"
 )
 
-// 接收 post 请求，将其内容写入日志文件
+// 接收 post 请求，将其内容以 JSON Lines 格式写入日志分段
 
-var log *stlog.Logger
+var (
+	recordsIngested = metrics.NewCounter("log_records_ingested_total",
+		"Log records accepted by the log service, by service and level.",
+		"service", "level")
+	recordsRejected = metrics.NewCounter("log_records_rejected_total",
+		"Log records rejected by the log service because they failed validation.")
+	bytesWritten = metrics.NewCounter("log_bytes_written_total",
+		"Bytes appended to log segments by the log service.")
+)
 
-type fileLog string
+// Run 服务启动时按配置打开日志目录，并为已有日志建立索引
+func Run(cfg Config) error {
+	selfURL = cfg.URL
+	var err error
+	logStore, err = openStore(cfg)
+	return err
+}
 
-// fileLog 写入文件的路径, 该方法目的为实现 io.Writer接口
-func (fl fileLog) Write(data []byte) (int, error) {
-	f, err := os.OpenFile(string(fl), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
-	if err != nil {
-		return 0, err
+// CheckStorage 检查当前分段是否可写，作为日志服务的就绪检查
+func CheckStorage() error {
+	if logStore == nil {
+		return fmt.Errorf("Log storage is not open")
 	}
-	defer func() { _ = f.Close() }()
-	return f.Write(data)
+	return logStore.check()
+}
+
+// IngestResult POST /log 中有记录被拒绝或未能写入时的响应
+// 全部被拒绝时状态码为 400，有记录因存储错误未能写入时为 500，否则为 200
+type IngestResult struct {
+	Accepted int
+	Rejected []RecordError
+	// 因存储错误未能写入的记录在请求中的下标，客户端只需重发这些记录
+	Failed []int `json:",omitempty"`
 }
 
-// 服务启动时，指定固定地址写 log 文件
-func Run(dest string) {
-	// flag 定义日志属性
-	log = stlog.New(fileLog(dest), "[go] - ", stlog.LstdFlags)
+// RecordError 被拒绝的记录在请求中的下标及原因
+type RecordError struct {
+	Index int
+	Error string
 }
 
+// POST /log
+// Content-Type 为 application/json 时接收一条记录或记录数组，其余按纯文本处理，兼容旧版客户端
+// 不合法的记录被拒绝，其余记录照常写入，响应中列出被拒绝的记录
+// 写入中途出错时已经写入的记录不会撤销，响应中列出未写入的记录，避免客户端重发整批造成重复
+// GET /logs 查询日志
+// GET /logs/stream 与 GET /logs/ws 实时推送新日志
+// GET /logs/segments 返回日志分段列表
+// GET /alerts 与 POST /alerts/reload 查看告警与重新加载规则
 func RegisterHandlers() {
+	http.HandleFunc("/alerts", alertsHandler)
+	http.HandleFunc("/alerts/reload", alertsHandler)
+	http.HandleFunc("/audit/verify", auditHandler)
+	http.HandleFunc("/logs/segments", segmentsHandler)
+	http.HandleFunc("/logs", queryHandler)
+	http.HandleFunc("/logs/stream", streamHandler)
+	http.HandleFunc("/logs/ws", websocketHandler)
 	http.HandleFunc("/log", func(writer http.ResponseWriter, request *http.Request) {
 		switch request.Method {
 		case http.MethodPost:
-			msg, err := io.ReadAll(request.Body)
 			defer func() { _ = request.Body.Close() }()
+			msg, err := readBody(request)
 			if err != nil || len(msg) == 0 {
 				writer.WriteHeader(http.StatusBadRequest)
 				return
 			}
-			write(string(msg))
+			records, err := decodeRecords(request.Header.Get("Content-Type"), msg)
+			if err != nil {
+				recordsRejected.With().Inc()
+				http.Error(writer, err.Error(), http.StatusBadRequest)
+				return
+			}
+			var result IngestResult
+			// 合法记录在请求中的下标
+			valid := make([]int, 0, len(records))
+			for i := range records {
+				if err := records[i].Validate(); err != nil {
+					recordsRejected.With().Inc()
+					result.Rejected = append(result.Rejected, RecordError{Index: i, Error: err.Error()})
+					continue
+				}
+				valid = append(valid, i)
+			}
+			forwarded := request.Header.Get(ForwardedHeader) != ""
+			for n, i := range valid {
+				rec := records[i]
+				if err := write(rec, forwarded); err != nil {
+					stlog.Println("Failed to write log record: ", err)
+					result.Failed = valid[n:]
+					break
+				}
+				recordsIngested.With(rec.Service, rec.Level.String()).Inc()
+				result.Accepted++
+			}
+			if len(result.Rejected) == 0 && len(result.Failed) == 0 {
+				return
+			}
+			status := http.StatusOK
+			switch {
+			case len(result.Failed) > 0:
+				status = http.StatusInternalServerError
+			case result.Accepted == 0:
+				status = http.StatusBadRequest
+			}
+			writer.Header().Set("Content-Type", "application/json")
+			writer.WriteHeader(status)
+			_ = json.NewEncoder(writer).Encode(result)
 		default:
 			writer.WriteHeader(http.StatusMethodNotAllowed)
 			return
@@ -47,6 +128,67 @@ func RegisterHandlers() {
 	})
 }
 
-func write(msg string) {
-	log.Printf("%v\n", msg)
+func segmentsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(manifest{Segments: logStore.manifest()})
+}
+
+// 单次请求解压后允许的最大字节数
+const maxBodyBytes = 32 << 20
+
+// 读取请求体，客户端批量发送时使用 gzip 压缩
+func readBody(request *http.Request) ([]byte, error) {
+	var body io.Reader = request.Body
+	if request.Header.Get("Content-Encoding") == "gzip" {
+		zr, err := gzip.NewReader(request.Body)
+		if err != nil {
+			return nil, err
+		}
+		defer func() { _ = zr.Close() }()
+		body = zr
+	}
+	msg, err := io.ReadAll(io.LimitReader(body, maxBodyBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(msg) > maxBodyBytes {
+		return nil, fmt.Errorf("Request body exceeds %d bytes", maxBodyBytes)
+	}
+	return msg, nil
+}
+
+// 根据 Content-Type 解析请求体中的日志记录
+func decodeRecords(contentType string, body []byte) ([]Record, error) {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if mediaType != "application/json" {
+		return []Record{recordFromText(string(body))}, nil
+	}
+	body = bytes.TrimSpace(body)
+	if len(body) > 0 && body[0] == '[' {
+		var records []Record
+		if err := json.Unmarshal(body, &records); err != nil {
+			return nil, fmt.Errorf("Invalid log records: %s", err)
+		}
+		return records, nil
+	}
+	var rec Record
+	if err := json.Unmarshal(body, &rec); err != nil {
+		return nil, fmt.Errorf("Invalid log record: %s", err)
+	}
+	return []Record{rec}, nil
+}
+
+// 写入存储后推送给实时订阅者与 sink，forwarded 表示记录由其他日志服务转发而来
+func write(rec Record, forwarded bool) error {
+	if err := logStore.append(rec); err != nil {
+		return err
+	}
+	tail.publish(rec)
+	dispatch(rec, forwarded)
+	observeAlerts(rec)
+	return nil
 }
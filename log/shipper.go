@@ -0,0 +1,463 @@
+package log
+
+import (
+	"Distribute/metrics"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ClientOptions 日志客户端批量发送的配置
+type ClientOptions struct {
+	// 每批最多发送的记录数
+	BatchSize int
+	// 未攒满一批时，最长等待多久发送
+	FlushInterval time.Duration
+	// 内存中最多缓存的记录数，超出后丢弃新记录
+	QueueSize int
+	// 日志服务不可达时，记录暂存到该目录下的 spool 文件中
+	// 文件名包含服务名与服务地址，同一主机上的多个实例使用各自的文件，重启后继续补发
+	SpoolDir string
+	// spool 文件的最大字节数，超出后丢弃新记录
+	MaxSpoolBytes int64
+	// 没有可用的日志服务、发送失败或记录被拒绝时，记录同时以 JSON Lines 写入该 writer，为 nil 时不写入
+	Fallback io.Writer
+}
+
+// DefaultClientOptions SetClientLogger 使用的配置，需要在其之前修改
+var DefaultClientOptions = ClientOptions{
+	BatchSize:     100,
+	FlushInterval: time.Second,
+	QueueSize:     10000,
+	SpoolDir:      filepath.Join(os.TempDir(), "distribute-spool"),
+	MaxSpoolBytes: 64 << 20,
+	Fallback:      os.Stderr,
+}
+
+var (
+	clientDropped = metrics.NewCounter("log_client_records_dropped_total",
+		"Log records dropped by the client because the queue or spool was full.")
+	clientBatches = metrics.NewCounter("log_client_batches_sent_total",
+		"Batches shipped to the log service, by result.",
+		"result")
+	clientSpooled = metrics.NewCounter("log_client_records_spooled_total",
+		"Log records written to the local spool while the log service was unreachable.")
+	clientReplayed = metrics.NewCounter("log_client_records_replayed_total",
+		"Spooled log records shipped after the log service became reachable again.")
+	clientFallback = metrics.NewCounter("log_client_records_fallback_total",
+		"Log records written to the local fallback because no log service accepted them.")
+	clientRejected = metrics.NewCounter("log_client_records_rejected_total",
+		"Log records rejected by the log service as invalid, which are not retried.")
+)
+
+// 已丢弃的记录数
+var dropped uint64
+
+// Dropped 返回客户端因队列或 spool 已满而丢弃的记录数
+func Dropped() uint64 {
+	return atomic.LoadUint64(&dropped)
+}
+
+func drop(n int) {
+	atomic.AddUint64(&dropped, uint64(n))
+	clientDropped.With().Add(float64(n))
+}
+
+// 在后台批量发送记录，发送失败的批次写入 spool，之后再重新发送
+type shipper struct {
+	// 日志服务地址，可以在运行中切换，由 urlMutex 保护
+	url      string
+	urlMutex *sync.RWMutex
+	opts     ClientOptions
+	spool    string
+	queue    chan Record
+	flush    chan chan struct{}
+	done     chan struct{}
+	stopped  chan struct{}
+	client   *http.Client
+	// 附加到每个请求的请求头
+	header http.Header
+	// 最近一次发送失败的时间，失败后一段时间内不重放 spool
+	lastFailure time.Time
+	// 保护 spool 文件
+	mutex *sync.Mutex
+}
+
+// 发送失败后，等待该时间再尝试重放 spool
+const replayBackoff = 5 * time.Second
+
+// spoolName 为 spool 文件名，不含扩展名，同一目录中的每个发送者需要使用不同的文件
+func newShipper(url, spoolName string, opts ClientOptions, header http.Header) *shipper {
+	s := &shipper{
+		url:      url,
+		urlMutex: new(sync.RWMutex),
+		opts:     opts,
+		spool:    filepath.Join(opts.SpoolDir, spoolName+".ndjson"),
+		queue:    make(chan Record, opts.QueueSize),
+		flush:    make(chan chan struct{}),
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+		client:   &http.Client{Timeout: 5 * time.Second},
+		header:   header,
+		mutex:    new(sync.Mutex),
+	}
+	go s.run()
+	return s
+}
+
+func (s *shipper) target() string {
+	s.urlMutex.RLock()
+	defer s.urlMutex.RUnlock()
+	return s.url
+}
+
+// 切换日志服务地址，之后发送的批次与 spool 中的记录发送到新地址，url 为空表示没有可用的日志服务
+// 返回原来的地址
+func (s *shipper) retarget(url string) string {
+	s.urlMutex.Lock()
+	defer s.urlMutex.Unlock()
+	previous := s.url
+	s.url = url
+	return previous
+}
+
+// 放入发送队列，不会阻塞调用方
+func (s *shipper) enqueue(rec Record) {
+	select {
+	case s.queue <- rec:
+	default:
+		drop(1)
+	}
+}
+
+func (s *shipper) run() {
+	defer close(s.stopped)
+	ticker := time.NewTicker(s.opts.FlushInterval)
+	defer ticker.Stop()
+	batch := make([]Record, 0, s.opts.BatchSize)
+	send := func() {
+		if len(batch) > 0 {
+			s.ship(batch)
+			batch = make([]Record, 0, s.opts.BatchSize)
+		}
+	}
+	// 取出队列中已有的所有记录
+	drain := func() {
+		for {
+			select {
+			case rec := <-s.queue:
+				batch = append(batch, rec)
+				if len(batch) >= s.opts.BatchSize {
+					send()
+				}
+			default:
+				send()
+				return
+			}
+		}
+	}
+	for {
+		select {
+		case rec := <-s.queue:
+			batch = append(batch, rec)
+			if len(batch) >= s.opts.BatchSize {
+				send()
+			}
+		case <-ticker.C:
+			send()
+			if s.target() != "" && time.Since(s.lastFailure) > replayBackoff {
+				s.replay()
+			}
+		case ack := <-s.flush:
+			drain()
+			close(ack)
+		case <-s.done:
+			drain()
+			return
+		}
+	}
+}
+
+// 发送一批记录，失败时写入 spool
+// 被日志服务拒绝的记录重发也不会成功，不写入 spool，只写入 fallback
+// 日志服务只写入了部分记录时，只有未写入的记录写入 spool
+func (s *shipper) ship(batch []Record) {
+	body, err := json.Marshal(batch)
+	var result IngestResult
+	if err == nil {
+		result, err = s.post(body)
+	}
+	if errors.Is(err, errRejected) {
+		clientBatches.With("rejected").Inc()
+		clientRejected.With().Add(float64(len(batch)))
+		s.fallback(batch)
+		return
+	}
+	if len(result.Rejected) > 0 {
+		clientRejected.With().Add(float64(len(result.Rejected)))
+		indexes := make([]int, len(result.Rejected))
+		for i, r := range result.Rejected {
+			indexes[i] = r.Index
+		}
+		s.fallback(pick(batch, indexes))
+	}
+	if err != nil {
+		clientBatches.With("failure").Inc()
+		s.lastFailure = time.Now()
+		failed := batch
+		if result.Failed != nil {
+			failed = pick(batch, result.Failed)
+		}
+		s.spoolBatch(failed)
+		s.fallback(failed)
+		return
+	}
+	clientBatches.With("success").Inc()
+}
+
+// 按日志服务返回的下标取出记录，忽略越界的下标
+func pick(batch []Record, indexes []int) []Record {
+	records := make([]Record, 0, len(indexes))
+	for _, i := range indexes {
+		if i >= 0 && i < len(batch) {
+			records = append(records, batch[i])
+		}
+	}
+	return records
+}
+
+// 写入本地的 fallback，日志服务不可用时仍能在本地看到日志
+func (s *shipper) fallback(batch []Record) {
+	if s.opts.Fallback == nil {
+		return
+	}
+	var buf bytes.Buffer
+	for _, rec := range batch {
+		data, err := json.Marshal(rec)
+		if err != nil {
+			continue
+		}
+		buf.Write(data)
+		buf.WriteByte('\n')
+	}
+	if _, err := s.opts.Fallback.Write(buf.Bytes()); err == nil {
+		clientFallback.With().Add(float64(len(batch)))
+	}
+}
+
+var (
+	// 没有可用的日志服务
+	errNoLogService = errors.New("No log service available")
+	// 日志服务拒绝了整批记录，重发也不会成功
+	errRejected = errors.New("Log records rejected")
+)
+
+/**
+ * post
+ * @Description: 以 gzip 压缩发送 JSON 数组
+ * @receiver s
+ * @param body
+ * @return IngestResult 被日志服务拒绝的记录，以及出错时日志服务未能写入的记录
+ * @return error 整批被拒绝时为 errRejected，发送失败时 IngestResult.Failed 为 nil 说明整批都需要重发
+ */
+func (s *shipper) post(body []byte) (IngestResult, error) {
+	var result IngestResult
+	target := s.target()
+	if target == "" {
+		return result, errNoLogService
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(body); err != nil {
+		return result, err
+	}
+	if err := zw.Close(); err != nil {
+		return result, err
+	}
+	req, err := http.NewRequest(http.MethodPost, target+"/log", &buf)
+	if err != nil {
+		return result, err
+	}
+	for k, v := range s.header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", "gzip")
+	res, err := s.client.Do(req)
+	if err != nil {
+		return result, err
+	}
+	defer func() { _ = res.Body.Close() }()
+	switch {
+	case res.StatusCode == http.StatusOK:
+		// 没有记录被拒绝时响应体为空
+		_ = json.NewDecoder(res.Body).Decode(&result)
+		return result, nil
+	case res.StatusCode >= 400 && res.StatusCode < 500 &&
+		res.StatusCode != http.StatusRequestTimeout && res.StatusCode != http.StatusTooManyRequests:
+		return result, fmt.Errorf("%w, Service Responded with code %v", errRejected, res.StatusCode)
+	}
+	// 写入中途出错时响应中列出未写入的记录，其他错误没有响应体
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+		result = IngestResult{}
+	}
+	return result, fmt.Errorf("Failed to send log records , Service Responded with code %v", res.StatusCode)
+}
+
+// 追加到 spool 文件，每条记录一行
+func (s *shipper) spoolBatch(batch []Record) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := os.MkdirAll(filepath.Dir(s.spool), 0700); err != nil {
+		drop(len(batch))
+		return
+	}
+	var size int64
+	if info, err := os.Stat(s.spool); err == nil {
+		size = info.Size()
+	}
+	f, err := os.OpenFile(s.spool, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		drop(len(batch))
+		return
+	}
+	defer func() { _ = f.Close() }()
+	w := bufio.NewWriter(f)
+	for i, rec := range batch {
+		data, err := json.Marshal(rec)
+		if err != nil {
+			drop(1)
+			continue
+		}
+		if size+int64(len(data))+1 > s.opts.MaxSpoolBytes {
+			drop(len(batch) - i)
+			break
+		}
+		_, _ = w.Write(append(data, '\n'))
+		size += int64(len(data)) + 1
+		clientSpooled.With().Inc()
+	}
+	_ = w.Flush()
+}
+
+/**
+ * replay
+ * @Description: 逐批重新发送 spool 中的记录，全部发送成功后删除 spool 文件，失败时保留未发送的部分
+ * 被日志服务拒绝的记录直接丢弃，它们在写入 spool 时已经写入了 fallback
+ * @receiver s
+ */
+func (s *shipper) replay() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	f, err := os.Open(s.spool)
+	if err != nil {
+		return
+	}
+	defer func() { _ = f.Close() }()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+
+	// spool 中每行都是一条 JSON 记录，拼接成数组即可发送，无需解码
+	lines := make([][]byte, 0, s.opts.BatchSize)
+	// 发送失败时 lines 只保留需要重发的记录
+	send := func() bool {
+		body := append([]byte{'['}, bytes.Join(lines, []byte{','})...)
+		body = append(body, ']')
+		result, err := s.post(body)
+		switch {
+		case errors.Is(err, errRejected):
+			clientRejected.With().Add(float64(len(lines)))
+		case err != nil:
+			s.lastFailure = time.Now()
+			if result.Failed != nil {
+				clientRejected.With().Add(float64(len(result.Rejected)))
+				clientReplayed.With().Add(float64(result.Accepted))
+				failed := make([][]byte, 0, len(result.Failed))
+				for _, i := range result.Failed {
+					if i >= 0 && i < len(lines) {
+						failed = append(failed, lines[i])
+					}
+				}
+				lines = failed
+			}
+			return false
+		default:
+			clientRejected.With().Add(float64(len(result.Rejected)))
+			clientReplayed.With().Add(float64(result.Accepted))
+		}
+		lines = lines[:0]
+		return true
+	}
+	for scanner.Scan() {
+		lines = append(lines, append([]byte(nil), scanner.Bytes()...))
+		if len(lines) >= s.opts.BatchSize && !send() {
+			s.keep(lines, scanner)
+			return
+		}
+	}
+	if len(lines) > 0 && !send() {
+		s.keep(lines, scanner)
+		return
+	}
+	_ = os.Remove(s.spool)
+}
+
+// 重写 spool，只保留尚未发送的记录
+func (s *shipper) keep(lines [][]byte, rest *bufio.Scanner) {
+	tmp := s.spool + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return
+	}
+	w := bufio.NewWriter(out)
+	for _, line := range lines {
+		_, _ = w.Write(line)
+		_ = w.WriteByte('\n')
+	}
+	for rest.Scan() {
+		_, _ = w.Write(rest.Bytes())
+		_ = w.WriteByte('\n')
+	}
+	_ = w.Flush()
+	_ = out.Close()
+	_ = os.Rename(tmp, s.spool)
+}
+
+// 立即发送队列中的记录，最多等待 timeout
+func (s *shipper) Flush(timeout time.Duration) {
+	ack := make(chan struct{})
+	select {
+	case s.flush <- ack:
+	case <-s.stopped:
+		return
+	case <-time.After(timeout):
+		return
+	}
+	select {
+	case <-ack:
+	case <-time.After(timeout):
+	}
+}
+
+// 发送剩余记录后停止，无法发送的记录写入 spool
+func (s *shipper) Close(timeout time.Duration) {
+	select {
+	case <-s.done:
+	default:
+		close(s.done)
+	}
+	select {
+	case <-s.stopped:
+	case <-time.After(timeout):
+	}
+}
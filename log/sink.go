@@ -0,0 +1,368 @@
+package log
+
+import (
+	"Distribute/metrics"
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sink 日志服务保存记录之外的输出目标
+type Sink interface {
+	WriteRecord(rec Record) error
+	Close() error
+}
+
+// SinkFilter 按级别与服务过滤发送到 sink 的记录，零值接收全部记录
+type SinkFilter struct {
+	MinLevel Level
+	// 为空时接收所有服务
+	Services []string
+}
+
+// Matches 判断记录是否需要发送到 sink
+func (f SinkFilter) Matches(rec Record) bool {
+	if rec.Level < f.MinLevel {
+		return false
+	}
+	if len(f.Services) == 0 {
+		return true
+	}
+	for _, s := range f.Services {
+		if s == rec.Service {
+			return true
+		}
+	}
+	return false
+}
+
+// ForwardedHeader 转发到其他日志服务的请求带有该请求头，其中的记录不会被再次转发，避免循环
+const ForwardedHeader = "X-Log-Forwarded"
+
+// 每个 sink 最多缓存的记录数，超出后丢弃，避免较慢的 sink 阻塞写入
+const sinkQueueSize = 10000
+
+var sinkRecords = metrics.NewCounter("log_sink_records_total",
+	"Log records handed to sinks, by sink and result.",
+	"sink", "result")
+
+// 在后台依次将记录写入 sink
+type sinkRunner struct {
+	name    string
+	sink    Sink
+	filter  SinkFilter
+	forward bool
+	queue   chan Record
+	stopped chan struct{}
+}
+
+func (r *sinkRunner) run() {
+	defer close(r.stopped)
+	for rec := range r.queue {
+		if err := r.sink.WriteRecord(rec); err != nil {
+			sinkRecords.With(r.name, "failed").Inc()
+			continue
+		}
+		sinkRecords.With(r.name, "written").Inc()
+	}
+}
+
+var (
+	sinks      []*sinkRunner
+	sinksMutex = new(sync.RWMutex)
+)
+
+// AddSink 日志服务保存记录后，将满足 filter 的记录异步写入 sink，name 用于指标
+func AddSink(name string, sink Sink, filter SinkFilter) {
+	_, forward := sink.(*forwardSink)
+	r := &sinkRunner{
+		name:    name,
+		sink:    sink,
+		filter:  filter,
+		forward: forward,
+		queue:   make(chan Record, sinkQueueSize),
+		stopped: make(chan struct{}),
+	}
+	go r.run()
+	sinksMutex.Lock()
+	sinks = append(sinks, r)
+	sinksMutex.Unlock()
+}
+
+// CloseSinks 写完队列中的记录后关闭所有 sink，服务退出前调用
+func CloseSinks() {
+	sinksMutex.Lock()
+	closing := sinks
+	sinks = nil
+	sinksMutex.Unlock()
+	for _, r := range closing {
+		close(r.queue)
+		select {
+		case <-r.stopped:
+		case <-time.After(closeTimeout):
+		}
+		_ = r.sink.Close()
+	}
+}
+
+// 将记录交给所有匹配的 sink，forwarded 为 true 时跳过转发类的 sink
+func dispatch(rec Record, forwarded bool) {
+	sinksMutex.RLock()
+	defer sinksMutex.RUnlock()
+	for _, r := range sinks {
+		if (forwarded && r.forward) || !r.filter.Matches(rec) {
+			continue
+		}
+		select {
+		case r.queue <- rec:
+		default:
+			sinkRecords.With(r.name, "dropped").Inc()
+		}
+	}
+}
+
+/**
+ * ParseSink
+ * @Description: 按描述创建 sink，格式为 类型[:目标][?参数]
+ *	stdout                               输出到标准输出
+ *	file:/var/log/distribute.ndjson      追加到文件
+ *	syslog:udp://host:514                以 RFC 5424 格式发送到 syslog，支持 udp 与 tcp
+ *	forward:http://host:4000             转发到其他日志服务
+ *	参数 level 为最低级别，service 为逗号分隔的服务名，syslog 还支持 facility（0-23，默认 1）
+ *	例如 stdout?level=warn、syslog:tcp://localhost:514?service=Grades,Portal
+ * @param spec
+ * @return Sink
+ * @return SinkFilter
+ * @return error
+ */
+func ParseSink(spec string) (Sink, SinkFilter, error) {
+	var filter SinkFilter
+	target, rawQuery, _ := strings.Cut(spec, "?")
+	params, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return nil, filter, fmt.Errorf("Invalid sink %q: %s", spec, err)
+	}
+	if s := params.Get("level"); s != "" {
+		if filter.MinLevel, err = ParseLevel(s); err != nil {
+			return nil, filter, fmt.Errorf("Invalid sink %q: %s", spec, err)
+		}
+	}
+	if s := params.Get("service"); s != "" {
+		filter.Services = strings.Split(s, ",")
+	}
+	kind, dest, _ := strings.Cut(target, ":")
+	switch kind {
+	case "stdout":
+		return stdoutSink{mutex: new(sync.Mutex)}, filter, nil
+	case "file":
+		if dest == "" {
+			return nil, filter, fmt.Errorf("Invalid sink %q: missing file path", spec)
+		}
+		sink, err := newFileSink(dest)
+		return sink, filter, err
+	case "syslog":
+		facility := 1
+		if s := params.Get("facility"); s != "" {
+			if facility, err = strconv.Atoi(s); err != nil || facility < 0 || facility > 23 {
+				return nil, filter, fmt.Errorf("Invalid sink %q: facility must be 0-23", spec)
+			}
+		}
+		u, err := url.Parse(dest)
+		if err != nil || (u.Scheme != "udp" && u.Scheme != "tcp") || u.Host == "" {
+			return nil, filter, fmt.Errorf("Invalid sink %q: expected syslog:udp://host:port or syslog:tcp://host:port", spec)
+		}
+		return newSyslogSink(u.Scheme, u.Host, facility), filter, nil
+	case "forward":
+		u, err := url.Parse(dest)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, filter, fmt.Errorf("Invalid sink %q: expected forward:http://host:port", spec)
+		}
+		return newForwardSink(strings.TrimRight(dest, "/")), filter, nil
+	}
+	return nil, filter, fmt.Errorf("Unknown sink type %q", kind)
+}
+
+// 每条记录一行 JSON 输出到标准输出
+type stdoutSink struct {
+	mutex *sync.Mutex
+}
+
+func (s stdoutSink) WriteRecord(rec Record) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	_, err = os.Stdout.Write(append(data, '\n'))
+	return err
+}
+
+func (s stdoutSink) Close() error { return nil }
+
+// 每条记录一行 JSON 追加到文件，文件在 sink 的生命周期内保持打开
+type fileSink struct {
+	f *os.File
+	w *bufio.Writer
+}
+
+func newFileSink(path string) (*fileSink, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &fileSink{f: f, w: bufio.NewWriter(f)}, nil
+}
+
+// 只在 sinkRunner 中调用，不需要加锁
+func (s *fileSink) WriteRecord(rec Record) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if _, err := s.w.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	return s.w.Flush()
+}
+
+func (s *fileSink) Close() error {
+	err := s.w.Flush()
+	if closeErr := s.f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// RFC 5424 格式的 syslog，tcp 连接使用 RFC 6587 的 octet counting 分帧
+type syslogSink struct {
+	network  string
+	addr     string
+	facility int
+	hostname string
+	conn     net.Conn
+}
+
+func newSyslogSink(network, addr string, facility int) *syslogSink {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "-"
+	}
+	return &syslogSink{network: network, addr: addr, facility: facility, hostname: host}
+}
+
+// 日志级别对应的 syslog severity
+var severities = map[Level]int{
+	LevelDebug: 7,
+	LevelInfo:  6,
+	LevelWarn:  4,
+	LevelError: 3,
+}
+
+func (s *syslogSink) format(rec Record) []byte {
+	pri := s.facility*8 + severities[rec.Level]
+	sd := "-"
+	if rec.TraceID != "" {
+		sd = fmt.Sprintf(`[trace@32473 id="%s"]`, sdEscape(rec.TraceID))
+	}
+	msg := fmt.Sprintf("<%d>1 %s %s %s %s - %s \ufeff%s",
+		pri,
+		rec.Time.UTC().Format("2006-01-02T15:04:05.000000Z07:00"),
+		syslogField(s.hostname, 255),
+		syslogField(rec.Service, 48),
+		syslogField(rec.Instance, 128),
+		sd,
+		rec.Message)
+	return []byte(msg)
+}
+
+// syslog 头部字段只能包含可打印 ASCII 字符且不能为空
+func syslogField(value string, max int) string {
+	b := make([]byte, 0, len(value))
+	for i := 0; i < len(value) && len(b) < max; i++ {
+		if c := value[i]; c > 32 && c < 127 {
+			b = append(b, c)
+		}
+	}
+	if len(b) == 0 {
+		return "-"
+	}
+	return string(b)
+}
+
+var sdReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+
+func sdEscape(s string) string { return sdReplacer.Replace(s) }
+
+// 连接断开后重新连接一次
+func (s *syslogSink) WriteRecord(rec Record) error {
+	msg := s.format(rec)
+	if s.network == "tcp" {
+		msg = append([]byte(strconv.Itoa(len(msg))+" "), msg...)
+	}
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		if s.conn == nil {
+			if s.conn, err = net.DialTimeout(s.network, s.addr, 5*time.Second); err != nil {
+				return err
+			}
+		}
+		_ = s.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+		if _, err = s.conn.Write(msg); err == nil {
+			return nil
+		}
+		_ = s.conn.Close()
+		s.conn = nil
+	}
+	return err
+}
+
+func (s *syslogSink) Close() error {
+	if s.conn == nil {
+		return nil
+	}
+	return s.conn.Close()
+}
+
+// 转发到其他日志服务，与客户端一样批量发送，目标不可达时暂存到日志目录下的 spool
+// 不写入标准错误：日志服务自身的记录已经保存在存储中，暂存的记录之后会补发
+type forwardSink struct {
+	shipper *shipper
+}
+
+func newForwardSink(url string) *forwardSink {
+	name := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return '-'
+	}, strings.TrimPrefix(strings.TrimPrefix(url, "http://"), "https://"))
+	dir := DefaultConfig.Dir
+	if logStore != nil {
+		dir = logStore.cfg.Dir
+	}
+	opts := DefaultClientOptions
+	opts.SpoolDir = filepath.Join(dir, "spool")
+	opts.Fallback = nil
+	header := http.Header{ForwardedHeader: []string{instanceID}}
+	return &forwardSink{shipper: newShipper(url, "forward-"+name, opts, header)}
+}
+
+func (s *forwardSink) WriteRecord(rec Record) error {
+	s.shipper.enqueue(rec)
+	return nil
+}
+
+func (s *forwardSink) Close() error {
+	s.shipper.Close(closeTimeout)
+	return nil
+}
@@ -0,0 +1,503 @@
+package log
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	stlog "log"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// 单行日志的最大长度
+const maxLineBytes = 4 << 20
+
+// 每条记录在分段中的位置与时间，偏移量基于分段未压缩的内容
+type entry struct {
+	offset int64
+	time   int64
+}
+
+// 日志存储：按分段追加写入文件，并在内存中维护倒排索引
+// 索引的 key 为 service:、level:、trace:、word: 前缀加对应的值，value 为按序号递增的记录序号列表
+type store struct {
+	cfg Config
+	// 按 ID 递增，最后一个为当前写入的分段
+	segments []Segment
+	active   *os.File
+	// 最近一次写入的错误，写入成功后清除
+	writeErr error
+	// 第一条未被删除记录的序号，entries[i] 的序号为 first+i
+	first    int32
+	entries  []entry
+	postings map[string][]int32
+	// 审计模式下最后一条记录的 Hash、最后一个检查点的记录序号与已写入的检查点数
+	lastHash     string
+	checkpointed int64
+	checkpoints  int
+	mutex        *sync.RWMutex
+}
+
+var logStore *store
+
+// 旧版日志服务写入的文本格式：[go] - 2006/01/02 15:04:05 [Service] - message
+var legacyLine = regexp.MustCompile(`^\[go\] - (\d{4}/\d{2}/\d{2} \d{2}:\d{2}:\d{2}) (.*)$`)
+
+// 解析一行日志，兼容旧版的文本格式
+func parseLine(line []byte) (Record, bool) {
+	var rec Record
+	if err := json.Unmarshal(line, &rec); err == nil {
+		return rec, true
+	}
+	m := legacyLine.FindStringSubmatch(strings.TrimRight(string(line), "\r\n"))
+	if m == nil {
+		return rec, false
+	}
+	t, err := time.ParseInLocation("2006/01/02 15:04:05", m[1], time.Local)
+	if err != nil {
+		return rec, false
+	}
+	rec = recordFromText(m[2])
+	rec.Time = t
+	return rec, true
+}
+
+// 为分段中的记录建立索引，调用方需持有写锁或处于初始化阶段
+func (s *store) index(seg *Segment, offset int64, rec Record) {
+	ordinal := s.first + int32(len(s.entries))
+	s.entries = append(s.entries, entry{offset: offset, time: rec.Time.UnixNano()})
+	for _, term := range terms(rec) {
+		s.postings[term] = append(s.postings[term], ordinal)
+	}
+	seg.Records++
+	if seg.MinTime.IsZero() || rec.Time.Before(seg.MinTime) {
+		seg.MinTime = rec.Time
+	}
+	if rec.Time.After(seg.MaxTime) {
+		seg.MaxTime = rec.Time
+	}
+}
+
+// 记录对应的索引项，消息按非字母数字字符切分为小写单词
+func terms(rec Record) []string {
+	result := []string{
+		"service:" + rec.Service,
+		"level:" + rec.Level.String(),
+	}
+	if rec.TraceID != "" {
+		result = append(result, "trace:"+rec.TraceID)
+	}
+	seen := make(map[string]bool)
+	for _, word := range words(rec.Message) {
+		if !seen[word] {
+			seen[word] = true
+			result = append(result, "word:"+word)
+		}
+	}
+	return result
+}
+
+// 单词长度超出范围的不建立索引
+const (
+	minWordLen = 2
+	maxWordLen = 32
+)
+
+func words(text string) []string {
+	fields := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	result := fields[:0]
+	for _, f := range fields {
+		if len(f) >= minWordLen && len(f) <= maxWordLen {
+			result = append(result, f)
+		}
+	}
+	return result
+}
+
+// 追加一条记录并建立索引，当前分段达到大小或时间限制时先切换到新分段
+func (s *store) append(rec Record) error {
+	// Hash 只能由存储计算
+	rec.Hash = ""
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.cfg.AuditKey != nil {
+		rec.Hash = chainHash(s.lastHash, data)
+		data = sealLine(data, rec.Hash)
+	} else {
+		data = append(data, '\n')
+	}
+	if reason := s.rotateReason(len(data)); reason != "" {
+		if err := s.rotate(reason); err != nil {
+			stlog.Println("Failed to rotate log segment: ", err)
+		}
+	}
+	seg := &s.segments[len(s.segments)-1]
+	n, err := s.active.Write(data)
+	bytesWritten.With().Add(float64(n))
+	seg.Size += int64(n)
+	seg.StoredSize += int64(n)
+	if err != nil {
+		s.writeErr = err
+		return err
+	}
+	s.writeErr = nil
+	s.index(seg, seg.Size-int64(n), rec)
+	if rec.Hash != "" {
+		s.lastHash = rec.Hash
+		if int64(s.first)+int64(len(s.entries))-1-s.checkpointed >= checkpointEvery {
+			if err := s.checkpoint(); err != nil {
+				stlog.Println("Failed to write audit checkpoint: ", err)
+			}
+		}
+	}
+	return nil
+}
+
+// 检查当前分段是否可写，作为日志服务的就绪检查
+func (s *store) check() error {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if s.writeErr != nil {
+		return s.writeErr
+	}
+	_, err := s.active.Stat()
+	return err
+}
+
+// 查询时可以使用索引的单词：子串两端的单词可能不完整，只使用中间的完整单词
+func substringTerms(substring string) []string {
+	lower := strings.ToLower(substring)
+	all := strings.FieldsFunc(lower, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	isSep := func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) }
+	start, end := 0, len(all)
+	if len(lower) > 0 && !isSep([]rune(lower)[0]) {
+		start = 1
+	}
+	if runes := []rune(lower); len(runes) > 0 && !isSep(runes[len(runes)-1]) {
+		end--
+	}
+	var result []string
+	for i := start; i < end; i++ {
+		if len(all[i]) >= minWordLen && len(all[i]) <= maxWordLen {
+			result = append(result, "word:"+all[i])
+		}
+	}
+	return result
+}
+
+// 根据查询条件中可以使用索引的部分得到候选记录序号，返回 nil 表示需要扫描全部记录
+func (s *store) candidates(q Query) []int32 {
+	var lists [][]int32
+	if q.Service != "" {
+		lists = append(lists, s.postings["service:"+q.Service])
+	}
+	if q.TraceID != "" {
+		lists = append(lists, s.postings["trace:"+q.TraceID])
+	}
+	if q.HasLevel && q.Level > LevelDebug {
+		var merged []int32
+		for level := q.Level; level <= LevelError; level++ {
+			merged = union(merged, s.postings["level:"+level.String()])
+		}
+		lists = append(lists, merged)
+	}
+	if q.Substring != "" {
+		for _, term := range substringTerms(q.Substring) {
+			lists = append(lists, s.postings[term])
+		}
+	}
+	if len(lists) == 0 {
+		return nil
+	}
+	// 从最短的列表开始求交集
+	sort.Slice(lists, func(i, j int) bool { return len(lists[i]) < len(lists[j]) })
+	result := lists[0]
+	for _, list := range lists[1:] {
+		result = intersect(result, list)
+	}
+	if result == nil {
+		result = []int32{}
+	}
+	return result
+}
+
+func intersect(a, b []int32) []int32 {
+	result := make([]int32, 0)
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		switch {
+		case a[i] < b[j]:
+			i++
+		case a[i] > b[j]:
+			j++
+		default:
+			result = append(result, a[i])
+			i++
+			j++
+		}
+	}
+	return result
+}
+
+func union(a, b []int32) []int32 {
+	result := make([]int32, 0, len(a)+len(b))
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] < b[j]:
+			result = append(result, a[i])
+			i++
+		case a[i] > b[j]:
+			result = append(result, b[j])
+			j++
+		default:
+			result = append(result, a[i])
+			i++
+			j++
+		}
+	}
+	result = append(result, a[i:]...)
+	return append(result, b[j:]...)
+}
+
+// 每次从同一分段批量读取的记录数，同一 gzip 成员中的记录只需解压一次
+const readBatch = 64
+
+/**
+ * query
+ * @Description: 先通过索引得到候选记录，跳过时间范围不相交的分段并按时间过滤，最后读取分段验证子串与正则条件
+ * @receiver s
+ * @param q
+ * @param page
+ * @return QueryResult
+ * @return error
+ */
+func (s *store) query(q Query, page Page) (QueryResult, error) {
+	result := QueryResult{Records: make([]Record, 0)}
+	cursor := -1
+	if page.Cursor != "" {
+		c, err := strconv.Atoi(page.Cursor)
+		if err != nil || c < 0 {
+			return result, fmt.Errorf("Invalid cursor %q", page.Cursor)
+		}
+		cursor = c
+	}
+
+	s.mutex.RLock()
+	candidates := s.candidates(q)
+	first := int(s.first)
+	total := len(s.entries)
+	entries := s.entries[:total:total]
+	segments := append([]Segment(nil), s.segments...)
+	s.mutex.RUnlock()
+
+	// 依次访问候选记录，candidates 为 nil 时访问全部记录
+	n := total
+	if candidates != nil {
+		n = len(candidates)
+	}
+	ordinalAt := func(i int) int {
+		if candidates != nil {
+			return int(candidates[i])
+		}
+		return first + i
+	}
+	// 根据游标确定起始位置，正序从游标之后开始，倒序从游标之前开始
+	next, step := 0, 1
+	if page.Desc {
+		next, step = n-1, -1
+	}
+	if cursor >= 0 {
+		// 第一个序号大于游标的位置
+		pos := sort.Search(n, func(i int) bool { return ordinalAt(i) > cursor })
+		next = pos
+		if page.Desc {
+			next = pos - 1
+			if next >= 0 && ordinalAt(next) == cursor {
+				next--
+			}
+		}
+	}
+
+	last := -1
+	for next >= 0 && next < n && result.NextCursor == "" {
+		seg := segmentOf(segments, ordinalAt(next))
+		if seg == nil {
+			next += step
+			continue
+		}
+		segStart, segEnd := int(seg.FirstOrdinal), int(seg.FirstOrdinal+seg.Records)
+		if !q.overlaps(seg.MinTime, seg.MaxTime) {
+			if step > 0 {
+				next = sort.Search(n, func(i int) bool { return ordinalAt(i) >= segEnd })
+			} else {
+				next = sort.Search(n, func(i int) bool { return ordinalAt(i) >= segStart }) - 1
+			}
+			continue
+		}
+		// 收集同一分段中满足时间条件的一批记录
+		var batch []int
+		var offsets []int64
+		for ; next >= 0 && next < n && len(batch) < readBatch; next += step {
+			ordinal := ordinalAt(next)
+			if ordinal < segStart || ordinal >= segEnd {
+				break
+			}
+			e := entries[ordinal-first]
+			if q.matchesTime(time.Unix(0, e.time)) {
+				batch = append(batch, ordinal)
+				offsets = append(offsets, e.offset)
+			}
+		}
+		if len(batch) == 0 {
+			continue
+		}
+		records, err := s.readSegment(seg.ID, offsets)
+		if err != nil {
+			return result, err
+		}
+		// 分段在查询期间被保留策略删除
+		if records == nil {
+			continue
+		}
+		for i, rec := range records {
+			if !q.Matches(rec) {
+				continue
+			}
+			if len(result.Records) == page.Limit {
+				// 还有更多记录，游标为最后一条已返回记录的序号
+				result.NextCursor = strconv.Itoa(last)
+				break
+			}
+			result.Records = append(result.Records, rec)
+			result.Cursors = append(result.Cursors, strconv.Itoa(batch[i]))
+			last = batch[i]
+		}
+	}
+	return result, nil
+}
+
+// 包含序号 ordinal 的分段
+func segmentOf(segments []Segment, ordinal int) *Segment {
+	i := sort.Search(len(segments), func(i int) bool {
+		return segments[i].FirstOrdinal+segments[i].Records > int64(ordinal)
+	})
+	if i == len(segments) || segments[i].FirstOrdinal > int64(ordinal) {
+		return nil
+	}
+	return &segments[i]
+}
+
+/**
+ * readSegment
+ * @Description: 读取分段中 offsets 处的记录，返回的记录与 offsets 一一对应，分段已被删除时返回 nil
+ * @receiver s
+ * @param id
+ * @param offsets
+ * @return []Record
+ * @return error
+ */
+func (s *store) readSegment(id int, offsets []int64) ([]Record, error) {
+	// 持有读锁打开文件，避免与压缩完成后删除原文件冲突
+	s.mutex.RLock()
+	i := s.segmentIndex(id)
+	if i < 0 {
+		s.mutex.RUnlock()
+		return nil, nil
+	}
+	seg := s.segments[i]
+	f, err := os.Open(filepath.Join(s.cfg.Dir, seg.File))
+	s.mutex.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+
+	records := make([]Record, len(offsets))
+	if !seg.Compressed {
+		for i, offset := range offsets {
+			if records[i], err = readRecord(f, offset); err != nil {
+				return nil, err
+			}
+		}
+		return records, nil
+	}
+	// 压缩的分段按偏移量递增的顺序读取，每条记录从其所在的 gzip 成员开始解压
+	// 下一条记录在当前位置之后且不跨过下一个成员时继续读取，否则跳到其所在的成员
+	order := make([]int, len(offsets))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(a, b int) bool { return offsets[order[a]] < offsets[order[b]] })
+	blocks := seg.Blocks
+	if len(blocks) == 0 {
+		blocks = []Block{{}}
+	}
+	var zr *gzip.Reader
+	var r *bufio.Reader
+	pos := int64(-1)
+	for _, i := range order {
+		b := sort.Search(len(blocks), func(j int) bool { return blocks[j].Offset > offsets[i] }) - 1
+		if b < 0 {
+			return nil, fmt.Errorf("Corrupted log segment %s: offset %d precedes the first block", seg.File, offsets[i])
+		}
+		if pos < 0 || pos > offsets[i] || pos < blocks[b].Offset {
+			src := bufio.NewReaderSize(io.NewSectionReader(f, blocks[b].Stored, math.MaxInt64-blocks[b].Stored), 64*1024)
+			if zr == nil {
+				zr, err = gzip.NewReader(src)
+			} else {
+				err = zr.Reset(src)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("Corrupted log segment %s: %s", seg.File, err)
+			}
+			r = bufio.NewReaderSize(zr, 64*1024)
+			pos = blocks[b].Offset
+		}
+		if _, err := io.CopyN(io.Discard, r, offsets[i]-pos); err != nil {
+			return nil, fmt.Errorf("Corrupted log segment %s: %s", seg.File, err)
+		}
+		line, err := r.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		pos = offsets[i] + int64(len(line))
+		rec, ok := parseLine(line)
+		if !ok {
+			return nil, fmt.Errorf("Corrupted log record in %s at offset %d", seg.File, offsets[i])
+		}
+		records[i] = rec
+	}
+	return records, nil
+}
+
+// 读取 offset 处的一行日志
+func readRecord(f *os.File, offset int64) (Record, error) {
+	r := bufio.NewReader(io.NewSectionReader(f, offset, maxLineBytes))
+	line, err := r.ReadBytes('\n')
+	if err != nil && err != io.EOF {
+		return Record{}, err
+	}
+	rec, ok := parseLine(line)
+	if !ok {
+		return rec, fmt.Errorf("Corrupted log record at offset %d", offset)
+	}
+	return rec, nil
+}
@@ -0,0 +1,313 @@
+package log
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// 在临时目录中打开存储，分段只在测试中显式压缩
+func openTestStore(t *testing.T, cfg Config) *store {
+	t.Helper()
+	cfg.Dir = t.TempDir()
+	s, err := openStore(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		_ = s.active.Close()
+	})
+	return s
+}
+
+var testTime = time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// 第 i 条测试记录，消息长度相同，每条记录占用的字节数相同
+func testRecord(i int) Record {
+	return Record{
+		Time:    testTime.Add(time.Duration(i) * time.Second),
+		Level:   LevelInfo,
+		Service: "test",
+		Message: fmt.Sprintf("record %06d", i),
+	}
+}
+
+func appendRecords(t *testing.T, s *store, from, to int) {
+	t.Helper()
+	for i := from; i < to; i++ {
+		if err := s.append(testRecord(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// 每个分段的记录数
+func segmentRecords(s *store) []int64 {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	result := make([]int64, len(s.segments))
+	for i, seg := range s.segments {
+		result[i] = seg.Records
+	}
+	return result
+}
+
+// 按顺序逐页查询所有记录的消息
+func queryMessages(t *testing.T, s *store, limit int) []string {
+	t.Helper()
+	var result []string
+	page := Page{Limit: limit}
+	for {
+		r, err := s.query(Query{}, page)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, rec := range r.Records {
+			result = append(result, rec.Message)
+		}
+		if r.NextCursor == "" {
+			return result
+		}
+		page.Cursor = r.NextCursor
+	}
+}
+
+func TestStoreRotation(t *testing.T) {
+	line := int64(len(mustLine(t, testRecord(0))))
+	tests := []struct {
+		name string
+		cfg  Config
+		// 写入的记录数
+		records int
+		// 写入该数量的记录后，把当前分段的创建时间提前两小时，0 表示不修改
+		ageAfter int
+		want     []int64
+	}{
+		{
+			name:    "no limits keep one segment",
+			records: 10,
+			want:    []int64{10},
+		},
+		{
+			name:    "size limit seals full segments",
+			cfg:     Config{MaxSegmentBytes: 3 * line},
+			records: 10,
+			want:    []int64{3, 3, 3, 1},
+		},
+		{
+			name:    "a record larger than the limit still gets a segment",
+			cfg:     Config{MaxSegmentBytes: 1},
+			records: 3,
+			want:    []int64{1, 1, 1},
+		},
+		{
+			name:     "age limit seals an old segment",
+			cfg:      Config{MaxSegmentAge: time.Hour},
+			records:  5,
+			ageAfter: 2,
+			want:     []int64{2, 3},
+		},
+		{
+			name:     "age does not matter without an age limit",
+			records:  5,
+			ageAfter: 2,
+			want:     []int64{5},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := openTestStore(t, tt.cfg)
+			split := tt.records
+			if tt.ageAfter > 0 {
+				split = tt.ageAfter
+			}
+			appendRecords(t, s, 0, split)
+			s.mutex.Lock()
+			s.segments[len(s.segments)-1].Created = time.Now().Add(-2 * time.Hour)
+			s.mutex.Unlock()
+			appendRecords(t, s, split, tt.records)
+
+			if got := segmentRecords(s); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("segment records = %v, want %v", got, tt.want)
+			}
+			var ordinal int64
+			for i, seg := range s.manifest() {
+				if seg.FirstOrdinal != ordinal {
+					t.Errorf("segment %d starts at ordinal %d, want %d", seg.ID, seg.FirstOrdinal, ordinal)
+				}
+				ordinal += seg.Records
+				if sealed := !seg.Sealed.IsZero(); sealed != (i < len(tt.want)-1) {
+					t.Errorf("segment %d sealed = %v", seg.ID, sealed)
+				}
+			}
+			if got := queryMessages(t, s, 4); len(got) != tt.records {
+				t.Errorf("query returned %d records, want %d", len(got), tt.records)
+			}
+		})
+	}
+}
+
+func TestStoreRetention(t *testing.T) {
+	key := ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+	tests := []struct {
+		name string
+		cfg  Config
+		// 封存分段距今的时长，从最旧的开始，当前分段另外存在
+		sealedAgo []time.Duration
+		// 按大小保留时，保留最新的几个分段所需的字节数
+		keepBytesOf int
+		// 保留下来的分段的第一条记录
+		want []int
+	}{
+		{
+			name:      "nothing expired",
+			cfg:       Config{RetentionAge: time.Hour},
+			sealedAgo: []time.Duration{30 * time.Minute, 20 * time.Minute},
+			want:      []int{0, 1, 2},
+		},
+		{
+			name:      "age removes expired segments from the oldest",
+			cfg:       Config{RetentionAge: time.Hour},
+			sealedAgo: []time.Duration{3 * time.Hour, 2 * time.Hour, 10 * time.Minute},
+			want:      []int{2, 3},
+		},
+		{
+			name:      "the active segment is kept even when everything expired",
+			cfg:       Config{RetentionAge: time.Minute},
+			sealedAgo: []time.Duration{3 * time.Hour, 2 * time.Hour},
+			want:      []int{2},
+		},
+		{
+			name:        "size removes the oldest segments",
+			sealedAgo:   []time.Duration{time.Minute, time.Minute, time.Minute},
+			keepBytesOf: 2,
+			want:        []int{2, 3},
+		},
+		{
+			name:      "audit mode keeps every segment",
+			cfg:       Config{RetentionAge: time.Minute, AuditKey: key},
+			sealedAgo: []time.Duration{3 * time.Hour, 2 * time.Hour},
+			want:      []int{0, 1, 2},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// 每条记录一个分段
+			cfg := tt.cfg
+			cfg.MaxSegmentBytes = 1
+			s := openTestStore(t, cfg)
+			appendRecords(t, s, 0, len(tt.sealedAgo)+1)
+
+			s.mutex.Lock()
+			for i, ago := range tt.sealedAgo {
+				s.segments[i].Sealed = time.Now().Add(-ago)
+			}
+			if tt.keepBytesOf > 0 {
+				var keep int64
+				for _, seg := range s.segments[len(s.segments)-tt.keepBytesOf:] {
+					keep += seg.StoredSize
+				}
+				s.cfg.RetentionBytes = keep
+			}
+			s.applyRetention()
+			s.mutex.Unlock()
+
+			var got []int
+			for _, seg := range s.manifest() {
+				got = append(got, int(seg.FirstOrdinal))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("kept segments starting at %v, want %v", got, tt.want)
+			}
+			var want []string
+			for i := tt.want[0]; i <= len(tt.sealedAgo); i++ {
+				want = append(want, testRecord(i).Message)
+			}
+			if got := queryMessages(t, s, 100); !reflect.DeepEqual(got, want) {
+				t.Errorf("query returned %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestReadCompressedSegment(t *testing.T) {
+	s := openTestStore(t, Config{})
+	// 足够跨越多个 gzip 成员
+	const n = 6000
+	appendRecords(t, s, 0, n)
+	s.mutex.Lock()
+	id := s.segments[0].ID
+	err := s.rotate("size")
+	s.mutex.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.compress(id)
+	seg := s.manifest()[0]
+	if !seg.Compressed || len(seg.Blocks) < 3 {
+		t.Fatalf("segment compressed = %v with %d blocks, want at least 3", seg.Compressed, len(seg.Blocks))
+	}
+
+	tests := []struct {
+		name     string
+		ordinals []int
+	}{
+		{name: "first record", ordinals: []int{0}},
+		{name: "last record", ordinals: []int{n - 1}},
+		{name: "consecutive records", ordinals: []int{100, 101, 102}},
+		{name: "records in different blocks", ordinals: []int{5, n / 2, n - 2}},
+		{name: "out of order", ordinals: []int{n - 1, 3, n / 2, 4}},
+		{name: "same record twice", ordinals: []int{42, 42}},
+	}
+	// 旧版本压缩的分段没有成员位置，从头开始解压
+	for _, blocks := range []bool{true, false} {
+		for _, tt := range tests {
+			t.Run(fmt.Sprintf("%s/blocks=%v", tt.name, blocks), func(t *testing.T) {
+				if !blocks {
+					s.mutex.Lock()
+					saved := s.segments[0].Blocks
+					s.segments[0].Blocks = nil
+					s.mutex.Unlock()
+					defer func() {
+						s.mutex.Lock()
+						s.segments[0].Blocks = saved
+						s.mutex.Unlock()
+					}()
+				}
+				offsets := make([]int64, len(tt.ordinals))
+				for i, ordinal := range tt.ordinals {
+					offsets[i] = s.entries[ordinal].offset
+				}
+				records, err := s.readSegment(id, offsets)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for i, ordinal := range tt.ordinals {
+					if want := testRecord(ordinal).Message; records[i].Message != want {
+						t.Errorf("record %d = %q, want %q", ordinal, records[i].Message, want)
+					}
+				}
+			})
+		}
+	}
+
+	got := queryMessages(t, s, readBatch)
+	if len(got) != n || got[0] != testRecord(0).Message || got[n-1] != testRecord(n-1).Message {
+		t.Errorf("paging through the compressed segment returned %d records", len(got))
+	}
+}
+
+// 记录在分段中占用的一行
+func mustLine(t *testing.T, rec Record) []byte {
+	t.Helper()
+	data, err := json.Marshal(rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return append(data, '\n')
+}
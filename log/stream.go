@@ -0,0 +1,385 @@
+package log
+
+import (
+	"Distribute/metrics"
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// 每个订阅者最多缓存的记录数
+	subscriberBuffer = 256
+	// 订阅者连续丢弃的记录超过该值时断开连接，避免长期占用资源
+	maxSubscriberLag = 10000
+	// 没有新记录时发送心跳的间隔，防止代理断开空闲连接
+	streamKeepAlive = 15 * time.Second
+	// 单次写入的超时时间，客户端停止读取时写入失败，处理函数随之退出
+	streamWriteTimeout = 10 * time.Second
+)
+
+var (
+	streamSubscribers = metrics.NewGauge("log_stream_subscribers",
+		"Clients currently tailing logs, by transport.",
+		"transport")
+	streamDropped = metrics.NewCounter("log_stream_records_dropped_total",
+		"Records not delivered to a tailing client because it was too slow.")
+)
+
+// 实时日志的订阅者
+type subscriber struct {
+	query Query
+	ch    chan Record
+	// 自上次成功投递以来丢弃的记录数
+	dropped int
+	// 订阅者过慢被断开时关闭，isEvicted 保证只关闭一次，不随丢弃计数清零
+	evicted   chan struct{}
+	isEvicted bool
+	mutex     *sync.Mutex
+}
+
+// 取出并清零丢弃计数
+func (s *subscriber) takeDropped() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	n := s.dropped
+	s.dropped = 0
+	return n
+}
+
+type hub struct {
+	subscribers map[*subscriber]bool
+	mutex       *sync.RWMutex
+}
+
+var tail = hub{
+	subscribers: make(map[*subscriber]bool),
+	mutex:       new(sync.RWMutex),
+}
+
+func (h *hub) subscribe(q Query) *subscriber {
+	s := &subscriber{
+		query:   q,
+		ch:      make(chan Record, subscriberBuffer),
+		evicted: make(chan struct{}),
+		mutex:   new(sync.Mutex),
+	}
+	h.mutex.Lock()
+	h.subscribers[s] = true
+	h.mutex.Unlock()
+	return s
+}
+
+func (h *hub) unsubscribe(s *subscriber) {
+	h.mutex.Lock()
+	delete(h.subscribers, s)
+	h.mutex.Unlock()
+}
+
+// 记录一次丢弃，丢弃数达到上限时断开订阅者，返回本次是否断开
+func (s *subscriber) drop() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.dropped++
+	if s.isEvicted || s.dropped < maxSubscriberLag {
+		return false
+	}
+	s.isEvicted = true
+	close(s.evicted)
+	return true
+}
+
+/**
+ * publish
+ * @Description: 将新写入的记录推送给条件匹配的订阅者，订阅者缓存已满时丢弃并计数，不阻塞写入
+ * 丢弃过多的订阅者被断开并移出 hub
+ * @receiver h
+ * @param rec
+ */
+func (h *hub) publish(rec Record) {
+	var evicted []*subscriber
+	h.mutex.RLock()
+	for s := range h.subscribers {
+		if !s.query.Matches(rec) {
+			continue
+		}
+		select {
+		case s.ch <- rec:
+		default:
+			streamDropped.With().Inc()
+			if s.drop() {
+				evicted = append(evicted, s)
+			}
+		}
+	}
+	h.mutex.RUnlock()
+	for _, s := range evicted {
+		h.unsubscribe(s)
+	}
+}
+
+// GET /logs/stream 以 Server-Sent Events 推送新日志，过滤参数与 /logs 相同
+func streamHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	q, err := ParseQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, ok := w.(http.Flusher); !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	// 每次写入前设置截止时间，停止读取的客户端不会让处理函数一直阻塞在写入上
+	rc := http.NewResponseController(w)
+	send := func(event string) bool {
+		_ = rc.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+		if _, err := io.WriteString(w, event); err != nil {
+			return false
+		}
+		return rc.Flush() == nil
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	if !send("") {
+		return
+	}
+
+	sub := tail.subscribe(q)
+	defer tail.unsubscribe(sub)
+	streamSubscribers.With("sse").Inc()
+	defer streamSubscribers.With("sse").Dec()
+
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case rec := <-sub.ch:
+			var event string
+			if n := sub.takeDropped(); n > 0 {
+				event = fmt.Sprintf("event: dropped\ndata: {\"Dropped\":%d}\n\n", n)
+			}
+			data, err := json.Marshal(rec)
+			if err != nil {
+				continue
+			}
+			if !send(event + fmt.Sprintf("event: record\ndata: %s\n\n", data)) {
+				return
+			}
+		case <-keepAlive.C:
+			if !send(": keep-alive\n\n") {
+				return
+			}
+		case <-sub.evicted:
+			send("event: evicted\ndata: {\"Reason\":\"client too slow\"}\n\n")
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// RFC 6455 中用于计算 Sec-WebSocket-Accept 的固定 GUID
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// WebSocket 帧类型
+const (
+	opText  = 0x1
+	opClose = 0x8
+	opPing  = 0x9
+	opPong  = 0xA
+)
+
+// GET /logs/ws 以 WebSocket 文本消息推送新日志，过滤参数与 /logs 相同
+func websocketHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !headerContains(r.Header, "Connection", "upgrade") || !headerContains(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "WebSocket upgrade required", http.StatusUpgradeRequired)
+		return
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" || r.Header.Get("Sec-WebSocket-Version") != "13" {
+		http.Error(w, "Unsupported WebSocket handshake", http.StatusBadRequest)
+		return
+	}
+	q, err := ParseQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "WebSocket not supported", http.StatusInternalServerError)
+		return
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return
+	}
+	defer func() { _ = conn.Close() }()
+
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	accept := base64.StdEncoding.EncodeToString(sum[:])
+	_, _ = rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + accept + "\r\n\r\n")
+	if err := rw.Flush(); err != nil {
+		return
+	}
+
+	sub := tail.subscribe(q)
+	defer tail.unsubscribe(sub)
+	streamSubscribers.With("websocket").Inc()
+	defer streamSubscribers.With("websocket").Dec()
+
+	ws := &wsConn{conn: conn, rw: rw, mutex: new(sync.Mutex)}
+	// 读取客户端发送的控制帧，客户端关闭连接时结束推送
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		ws.readLoop()
+	}()
+
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case rec := <-sub.ch:
+			if n := sub.takeDropped(); n > 0 {
+				_ = ws.writeFrame(opText, []byte(fmt.Sprintf(`{"Dropped":%d}`, n)))
+			}
+			data, err := json.Marshal(rec)
+			if err != nil {
+				continue
+			}
+			if err := ws.writeFrame(opText, data); err != nil {
+				return
+			}
+		case <-keepAlive.C:
+			if err := ws.writeFrame(opPing, nil); err != nil {
+				return
+			}
+		case <-sub.evicted:
+			_ = ws.writeClose(1008, "client too slow")
+			return
+		case <-closed:
+			return
+		}
+	}
+}
+
+func headerContains(h http.Header, name, token string) bool {
+	for _, value := range h.Values(name) {
+		for _, part := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// 服务端一侧的 WebSocket 连接，只实现推送日志所需的部分
+type wsConn struct {
+	conn  net.Conn
+	rw    *bufio.ReadWriter
+	mutex *sync.Mutex
+}
+
+// 服务端发送的帧不需要掩码
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	header := []byte{0x80 | opcode}
+	switch n := len(payload); {
+	case n < 126:
+		header = append(header, byte(n))
+	case n <= 0xFFFF:
+		header = append(header, 126, byte(n>>8), byte(n))
+	default:
+		header = append(header, 127)
+		header = append(header, make([]byte, 8)...)
+		binary.BigEndian.PutUint64(header[2:], uint64(n))
+	}
+	_ = c.conn.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+	if _, err := c.rw.Write(header); err != nil {
+		return err
+	}
+	if _, err := c.rw.Write(payload); err != nil {
+		return err
+	}
+	return c.rw.Flush()
+}
+
+func (c *wsConn) writeClose(code uint16, reason string) error {
+	payload := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, code)
+	return c.writeFrame(opClose, append(payload, reason...))
+}
+
+// 客户端发送的帧必须带掩码，收到 close 时回复 close 并返回
+func (c *wsConn) readLoop() {
+	for {
+		var head [2]byte
+		if _, err := io.ReadFull(c.rw, head[:]); err != nil {
+			return
+		}
+		opcode := head[0] & 0x0F
+		masked := head[1]&0x80 != 0
+		length := uint64(head[1] & 0x7F)
+		switch length {
+		case 126:
+			var ext [2]byte
+			if _, err := io.ReadFull(c.rw, ext[:]); err != nil {
+				return
+			}
+			length = uint64(binary.BigEndian.Uint16(ext[:]))
+		case 127:
+			var ext [8]byte
+			if _, err := io.ReadFull(c.rw, ext[:]); err != nil {
+				return
+			}
+			length = binary.BigEndian.Uint64(ext[:])
+		}
+		// 只推送不接收数据，拒绝过大的帧
+		if !masked || length > 64*1024 {
+			_ = c.writeClose(1002, "protocol error")
+			return
+		}
+		var mask [4]byte
+		if _, err := io.ReadFull(c.rw, mask[:]); err != nil {
+			return
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(c.rw, payload); err != nil {
+			return
+		}
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+		switch opcode {
+		case opClose:
+			_ = c.writeFrame(opClose, payload)
+			return
+		case opPing:
+			_ = c.writeFrame(opPong, payload)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package metrics
+
+import (
+	"Distribute/internal/httputil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var (
+	requestsTotal = NewCounter("http_requests_total",
+		"Number of HTTP requests handled, by route, method and status code.",
+		"route", "method", "code")
+	requestDuration = NewHistogram("http_request_duration_seconds",
+		"Latency of HTTP requests, by route and method.",
+		DefBuckets, "route", "method")
+)
+
+// Handler 以 Prometheus 文本格式暴露所有指标，挂载到 /metrics
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		_ = Write(w)
+	})
+}
+
+/**
+ * InstrumentHandler
+ * @Description: 统计 mux 处理的每个请求，路由使用 mux 匹配到的 pattern，避免 id 等路径参数造成标签过多
+ * @param mux
+ * @return http.Handler
+ */
+func InstrumentHandler(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, route := mux.Handler(r)
+		if route == "" {
+			route = "unmatched"
+		}
+		start := time.Now()
+		rec := httputil.NewStatusRecorder(w)
+		mux.ServeHTTP(rec, r)
+		requestsTotal.With(route, r.Method, strconv.Itoa(rec.Status)).Inc()
+		requestDuration.With(route, r.Method).Observe(time.Since(start).Seconds())
+	})
+}
@@ -0,0 +1,117 @@
+package metrics
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandler(t *testing.T) {
+	unregister(t, "test_handler_total")
+	NewCounter("test_handler_total", "Scraped over HTTP.").With().Inc()
+	server := httptest.NewServer(Handler())
+	defer server.Close()
+
+	res, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = res.Body.Close() }()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d, want 200", res.StatusCode)
+	}
+	if ct := res.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("got Content-Type %q", ct)
+	}
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(body), "\ntest_handler_total 1\n") {
+		t.Errorf("test_handler_total is missing from\n%s", body)
+	}
+
+	res, err = http.Post(server.URL, "text/plain", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = res.Body.Close()
+	if res.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("POST: got status %d, want 405", res.StatusCode)
+	}
+}
+
+func TestInstrumentHandler(t *testing.T) {
+	for _, f := range []*family{requestsTotal.f, requestDuration.f} {
+		f.mutex.Lock()
+		f.children = make(map[string]*child)
+		f.mutex.Unlock()
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/instrumented/", func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/missing") {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write([]byte("ok"))
+	})
+	mux.HandleFunc("/instrumented-slow", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(30 * time.Millisecond)
+		w.WriteHeader(http.StatusAccepted)
+	})
+	server := httptest.NewServer(InstrumentHandler(mux))
+	defer server.Close()
+
+	requests := []struct {
+		method string
+		path   string
+	}{
+		{http.MethodGet, "/instrumented/1"},
+		{http.MethodGet, "/instrumented/2"},
+		{http.MethodGet, "/instrumented/missing"},
+		{http.MethodPost, "/instrumented/3"},
+		{http.MethodPut, "/instrumented-slow"},
+		{http.MethodGet, "/not-routed"},
+	}
+	for _, req := range requests {
+		r, _ := http.NewRequest(req.method, server.URL+req.path, nil)
+		res, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = res.Body.Close()
+	}
+
+	// 路由使用 mux 的 pattern，而不是请求的路径
+	counts := map[string]string{
+		`http_requests_total{route="/instrumented/",method="GET",code="200"}`:       "2",
+		`http_requests_total{route="/instrumented/",method="GET",code="404"}`:       "1",
+		`http_requests_total{route="/instrumented/",method="POST",code="200"}`:      "1",
+		`http_requests_total{route="/instrumented-slow",method="PUT",code="202"}`:   "1",
+		`http_requests_total{route="unmatched",method="GET",code="404"}`:            "1",
+		`http_request_duration_seconds_count{route="/instrumented/",method="GET"}`:  "3",
+		`http_request_duration_seconds_count{route="/instrumented/",method="POST"}`: "1",
+	}
+	for series, want := range counts {
+		if got := value(t, series); got != want {
+			t.Errorf("%s: got %s, want %s", series, got, want)
+		}
+	}
+
+	// 耗时至少 30ms，不会落入 0.025 及之前的分桶
+	slow := `{route="/instrumented-slow",method="PUT"`
+	if got := value(t, "http_request_duration_seconds_bucket"+slow+`,le="0.025"}`); got != "0" {
+		t.Errorf("le=0.025: got %s, want 0", got)
+	}
+	if got := value(t, "http_request_duration_seconds_bucket"+slow+`,le="+Inf"}`); got != "1" {
+		t.Errorf("le=+Inf: got %s, want 1", got)
+	}
+	sum, err := strconv.ParseFloat(value(t, "http_request_duration_seconds_sum"+slow+"}"), 64)
+	if err != nil || sum < 0.03 {
+		t.Errorf("got sum %v, want at least 0.03", sum)
+	}
+}
@@ -0,0 +1,281 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// 指标类型，对应 Prometheus 文本格式中的 # TYPE
+const (
+	typeCounter   = "counter"
+	typeGauge     = "gauge"
+	typeHistogram = "histogram"
+)
+
+// DefBuckets 默认的直方图分桶，单位为秒，适用于请求耗时
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// 一个指标族，同名指标按标签值区分
+type family struct {
+	name       string
+	help       string
+	kind       string
+	labelNames []string
+	buckets    []float64
+	// 在抓取时计算数值的指标，不保存状态
+	fn       func() float64
+	children map[string]*child
+	mutex    *sync.Mutex
+}
+
+// 指标族下某一组标签值对应的具体数值
+type child struct {
+	labelValues []string
+	value       float64
+	// 直方图使用，bounds 为分桶上界，counts[i] 为落入第 i 个分桶的次数（非累计）
+	bounds []float64
+	counts []uint64
+	sum    float64
+	count  uint64
+	mutex  *sync.Mutex
+}
+
+type registry struct {
+	families map[string]*family
+	mutex    *sync.RWMutex
+}
+
+// 包内 全局指标注册表
+var std = registry{
+	families: make(map[string]*family),
+	mutex:    new(sync.RWMutex),
+}
+
+func (r *registry) register(f *family) *family {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if _, ok := r.families[f.name]; ok {
+		panic(fmt.Sprintf("metrics: duplicate metric %q", f.name))
+	}
+	f.children = make(map[string]*child)
+	f.mutex = new(sync.Mutex)
+	r.families[f.name] = f
+	return f
+}
+
+func (f *family) with(labelValues []string) *child {
+	if len(labelValues) != len(f.labelNames) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d",
+			f.name, len(f.labelNames), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	c, ok := f.children[key]
+	if !ok {
+		c = &child{
+			labelValues: append([]string(nil), labelValues...),
+			bounds:      f.buckets,
+			counts:      make([]uint64, len(f.buckets)),
+			mutex:       new(sync.Mutex),
+		}
+		f.children[key] = c
+	}
+	return c
+}
+
+func (c *child) add(v float64) {
+	c.mutex.Lock()
+	c.value += v
+	c.mutex.Unlock()
+}
+
+func (c *child) set(v float64) {
+	c.mutex.Lock()
+	c.value = v
+	c.mutex.Unlock()
+}
+
+// CounterVec 只增不减的计数器
+type CounterVec struct{ f *family }
+
+// Counter 某一组标签值对应的计数器
+type Counter struct{ c *child }
+
+func NewCounter(name, help string, labelNames ...string) *CounterVec {
+	return &CounterVec{f: std.register(&family{name: name, help: help, kind: typeCounter, labelNames: labelNames})}
+}
+
+func (cv *CounterVec) With(labelValues ...string) Counter {
+	return Counter{c: cv.f.with(labelValues)}
+}
+
+func (c Counter) Inc() { c.c.add(1) }
+
+func (c Counter) Add(v float64) {
+	if v < 0 {
+		panic("metrics: counter cannot decrease")
+	}
+	c.c.add(v)
+}
+
+// GaugeVec 可增可减的瞬时值
+type GaugeVec struct{ f *family }
+
+// Gauge 某一组标签值对应的瞬时值
+type Gauge struct{ c *child }
+
+func NewGauge(name, help string, labelNames ...string) *GaugeVec {
+	return &GaugeVec{f: std.register(&family{name: name, help: help, kind: typeGauge, labelNames: labelNames})}
+}
+
+func (gv *GaugeVec) With(labelValues ...string) Gauge {
+	return Gauge{c: gv.f.with(labelValues)}
+}
+
+func (g Gauge) Set(v float64) { g.c.set(v) }
+func (g Gauge) Inc()          { g.c.add(1) }
+func (g Gauge) Dec()          { g.c.add(-1) }
+func (g Gauge) Add(v float64) { g.c.add(v) }
+
+// NewGaugeFunc 注册一个在每次抓取时调用 fn 计算数值的瞬时值，适合统计集合大小
+func NewGaugeFunc(name, help string, fn func() float64) {
+	std.register(&family{name: name, help: help, kind: typeGauge, fn: fn})
+}
+
+// HistogramVec 按分桶统计观测值的分布
+type HistogramVec struct{ f *family }
+
+// Histogram 某一组标签值对应的直方图
+type Histogram struct{ c *child }
+
+func NewHistogram(name, help string, buckets []float64, labelNames ...string) *HistogramVec {
+	if buckets == nil {
+		buckets = DefBuckets
+	}
+	b := append([]float64(nil), buckets...)
+	sort.Float64s(b)
+	return &HistogramVec{f: std.register(&family{name: name, help: help, kind: typeHistogram, labelNames: labelNames, buckets: b})}
+}
+
+func (hv *HistogramVec) With(labelValues ...string) Histogram {
+	return Histogram{c: hv.f.with(labelValues)}
+}
+
+func (h Histogram) Observe(v float64) {
+	h.c.mutex.Lock()
+	defer h.c.mutex.Unlock()
+	for i, upper := range h.c.bounds {
+		if v <= upper {
+			h.c.counts[i]++
+			break
+		}
+	}
+	h.c.sum += v
+	h.c.count++
+}
+
+/**
+ * Write
+ * @Description: 以 Prometheus 文本格式输出所有指标
+ * @param w
+ * @return error
+ */
+func Write(w io.Writer) error {
+	std.mutex.RLock()
+	names := make([]string, 0, len(std.families))
+	for name := range std.families {
+		names = append(names, name)
+	}
+	std.mutex.RUnlock()
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		std.mutex.RLock()
+		f := std.families[name]
+		std.mutex.RUnlock()
+		f.write(&b)
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func (f *family) write(b *strings.Builder) {
+	fmt.Fprintf(b, "# HELP %s %s\n", f.name, escapeHelp(f.help))
+	fmt.Fprintf(b, "# TYPE %s %s\n", f.name, f.kind)
+	if f.fn != nil {
+		fmt.Fprintf(b, "%s %s\n", f.name, formatFloat(f.fn()))
+		return
+	}
+
+	f.mutex.Lock()
+	keys := make([]string, 0, len(f.children))
+	for key := range f.children {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	children := make([]*child, 0, len(keys))
+	for _, key := range keys {
+		children = append(children, f.children[key])
+	}
+	f.mutex.Unlock()
+
+	for _, c := range children {
+		c.mutex.Lock()
+		if f.kind != typeHistogram {
+			fmt.Fprintf(b, "%s%s %s\n", f.name, labels(f.labelNames, c.labelValues, "", ""), formatFloat(c.value))
+			c.mutex.Unlock()
+			continue
+		}
+		var cumulative uint64
+		for i, upper := range f.buckets {
+			cumulative += c.counts[i]
+			fmt.Fprintf(b, "%s_bucket%s %d\n", f.name, labels(f.labelNames, c.labelValues, "le", formatFloat(upper)), cumulative)
+		}
+		fmt.Fprintf(b, "%s_bucket%s %d\n", f.name, labels(f.labelNames, c.labelValues, "le", "+Inf"), c.count)
+		fmt.Fprintf(b, "%s_sum%s %s\n", f.name, labels(f.labelNames, c.labelValues, "", ""), formatFloat(c.sum))
+		fmt.Fprintf(b, "%s_count%s %d\n", f.name, labels(f.labelNames, c.labelValues, "", ""), c.count)
+		c.mutex.Unlock()
+	}
+}
+
+// 拼接标签，extraName 不为空时追加一个额外标签（直方图的 le）
+func labels(names, values []string, extraName, extraValue string) string {
+	if len(names) == 0 && extraName == "" {
+		return ""
+	}
+	pairs := make([]string, 0, len(names)+1)
+	for i := range names {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", names[i], escapeLabel(values[i])))
+	}
+	if extraName != "" {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", extraName, extraValue))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	helpReplacer  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string  { return helpReplacer.Replace(s) }
+func escapeLabel(s string) string { return labelReplacer.Replace(s) }
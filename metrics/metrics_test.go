@@ -0,0 +1,174 @@
+package metrics
+
+import (
+	"bytes"
+	"math"
+	"strings"
+	"testing"
+)
+
+// 测试结束时从注册表中删除指标，使测试可以重复运行
+func unregister(t *testing.T, names ...string) {
+	t.Cleanup(func() {
+		std.mutex.Lock()
+		defer std.mutex.Unlock()
+		for _, name := range names {
+			delete(std.families, name)
+		}
+	})
+}
+
+// 以文本格式输出所有指标，返回以 prefix 开头的行
+func scrape(t *testing.T, prefix string) []string {
+	t.Helper()
+	var b bytes.Buffer
+	if err := Write(&b); err != nil {
+		t.Fatalf("Write: %s", err)
+	}
+	var lines []string
+	for _, line := range strings.Split(b.String(), "\n") {
+		if strings.HasPrefix(line, prefix) {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// 指标族的所有行，包括 # HELP 与 # TYPE
+func familyLines(t *testing.T, name string) []string {
+	t.Helper()
+	var lines []string
+	for _, line := range scrape(t, "") {
+		for _, prefix := range []string{"# HELP " + name + " ", "# TYPE " + name + " ", name + "{", name + " ", name + "_"} {
+			if strings.HasPrefix(line, prefix) {
+				lines = append(lines, line)
+				break
+			}
+		}
+	}
+	return lines
+}
+
+// 指标的一行样本，名称包括标签
+func value(t *testing.T, series string) string {
+	t.Helper()
+	lines := scrape(t, series+" ")
+	if len(lines) != 1 {
+		t.Fatalf("series %s not found", series)
+	}
+	return strings.TrimPrefix(lines[0], series+" ")
+}
+
+func TestWriteCounter(t *testing.T) {
+	unregister(t, "test_counter_total")
+	c := NewCounter("test_counter_total", "A counter.\nWith \\ in help.", "path", "code")
+	c.With("/a", "200").Inc()
+	c.With("/a", "200").Add(2)
+	c.With("/b", "500").Inc()
+
+	want := []string{
+		`# HELP test_counter_total A counter.\nWith \\ in help.`,
+		`# TYPE test_counter_total counter`,
+		`test_counter_total{path="/a",code="200"} 3`,
+		`test_counter_total{path="/b",code="500"} 1`,
+	}
+	if got := familyLines(t, "test_counter_total"); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestWriteEscapesLabelValues(t *testing.T) {
+	unregister(t, "test_escape")
+	g := NewGauge("test_escape", "Escaping.", "value")
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{`plain`, `test_escape{value="plain"}`},
+		{`quote"d`, `test_escape{value="quote\"d"}`},
+		{`back\slash`, `test_escape{value="back\\slash"}`},
+		{"new\nline", `test_escape{value="new\nline"}`},
+	}
+	for i, tt := range tests {
+		g.With(tt.value).Set(float64(i))
+	}
+	for i, tt := range tests {
+		if got, want := value(t, tt.want), formatFloat(float64(i)); got != want {
+			t.Errorf("%q: got %s, want %s", tt.value, got, want)
+		}
+	}
+}
+
+func TestWriteGauge(t *testing.T) {
+	unregister(t, "test_gauge")
+	g := NewGauge("test_gauge", "A gauge.").With()
+	g.Set(10)
+	g.Inc()
+	g.Dec()
+	g.Dec()
+	g.Add(0.5)
+	if got := value(t, "test_gauge"); got != "9.5" {
+		t.Errorf("got %s, want 9.5", got)
+	}
+
+	unregister(t, "test_gauge_func")
+	n := 0
+	NewGaugeFunc("test_gauge_func", "A gauge func.", func() float64 { n++; return float64(n) })
+	if got := value(t, "test_gauge_func"); got != "1" {
+		t.Errorf("got %s, want 1", got)
+	}
+	if got := value(t, "test_gauge_func"); got != "2" {
+		t.Errorf("gauge func is not called on every scrape: got %s, want 2", got)
+	}
+}
+
+func TestWriteHistogram(t *testing.T) {
+	unregister(t, "test_histogram")
+	h := NewHistogram("test_histogram", "A histogram.", []float64{1, 0.5, 2}, "op")
+	for _, v := range []float64{0.25, 0.5, 1.5, 3} {
+		h.With("read").Observe(v)
+	}
+
+	want := []string{
+		`# HELP test_histogram A histogram.`,
+		`# TYPE test_histogram histogram`,
+		`test_histogram_bucket{op="read",le="0.5"} 2`,
+		`test_histogram_bucket{op="read",le="1"} 2`,
+		`test_histogram_bucket{op="read",le="2"} 3`,
+		`test_histogram_bucket{op="read",le="+Inf"} 4`,
+		`test_histogram_sum{op="read"} 5.25`,
+		`test_histogram_count{op="read"} 4`,
+	}
+	if got := familyLines(t, "test_histogram"); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestFormatFloat(t *testing.T) {
+	tests := []struct {
+		v    float64
+		want string
+	}{
+		{0, "0"},
+		{0.005, "0.005"},
+		{1e21, "1e+21"},
+		{math.Inf(1), "+Inf"},
+		{math.Inf(-1), "-Inf"},
+	}
+	for _, tt := range tests {
+		if got := formatFloat(tt.v); got != tt.want {
+			t.Errorf("formatFloat(%v) = %s, want %s", tt.v, got, tt.want)
+		}
+	}
+}
+
+func TestDuplicateMetricPanics(t *testing.T) {
+	unregister(t, "test_duplicate")
+	NewCounter("test_duplicate", "First.")
+	defer func() {
+		if recover() == nil {
+			t.Error("registering a metric twice does not panic")
+		}
+	}()
+	NewGauge("test_duplicate", "Second.")
+}
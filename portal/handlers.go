@@ -2,12 +2,16 @@ package portal
 
 import (
 	"Distribute/grades"
+	"Distribute/log"
 	"Distribute/registry"
+	"Distribute/trace"
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
-	"log"
+	"io"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 )
@@ -16,8 +20,77 @@ func RegisterHandlers() {
 	http.Handle("/", http.RedirectHandler("/students", http.StatusPermanentRedirect))
 
 	//h := new(studentsHandler)
-	http.Handle("/students", studentsHandler{})
-	http.Handle("/students/", studentsHandler{})
+	// 调用链从门户开始，访问成绩服务时继续传递
+	http.Handle("/students", trace.Handler(studentsHandler{}))
+	http.Handle("/students/", trace.Handler(studentsHandler{}))
+}
+
+// 调用其他服务统一使用 trace.Client，请求会携带 traceparent
+func get(ctx context.Context, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return trace.Client.Do(req)
+}
+
+func post(ctx context.Context, url, contentType string, body io.Reader) (*http.Response, error) {
+	return send(ctx, http.MethodPost, url, contentType, body)
+}
+
+func send(ctx context.Context, method, url, contentType string, body io.Reader) (*http.Response, error) {
+	return sendIfMatch(ctx, method, url, contentType, "", body)
+}
+
+// version 为页面上显示的版本，不为空时成绩服务只在版本没有变化时执行修改，否则返回 412
+func sendIfMatch(ctx context.Context, method, url, contentType, version string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if version != "" {
+		req.Header.Set("If-Match", strconv.Quote(version))
+	}
+	// 门户没有用户登录，成绩服务的事件中记录修改来自门户
+	req.Header.Set(grades.ActorHeader, "portal")
+	return trace.Client.Do(req)
+}
+
+// 学生页面的数据，Notice 为上一次操作失败时给用户的提示
+type studentPage struct {
+	grades.Student
+	Notice string
+}
+
+// 修改或删除成绩失败后回到学生页面时的提示，notice 参数为失败的原因
+func gradeNotice(q url.Values) string {
+	switch q.Get("notice") {
+	case "conflict":
+		return fmt.Sprintf("Grade %s was changed by someone else in the meantime, so your change was not saved. "+
+			"The current values are shown below; please review them and try again.", q.Get("grade"))
+	case "deleted":
+		return fmt.Sprintf("Grade %s was deleted by someone else in the meantime.", q.Get("grade"))
+	case "failed":
+		return fmt.Sprintf("Grade %s could not be saved, please try again.", q.Get("grade"))
+	}
+	return ""
+}
+
+// 修改或删除成绩后回到学生页面的地址，失败时带上提示
+func gradeRedirect(id, gradeID, status int, ok bool) string {
+	target := fmt.Sprintf("/students/%v", id)
+	switch {
+	case ok:
+		return target
+	case status == http.StatusPreconditionFailed:
+		return fmt.Sprintf("%s?notice=conflict&grade=%d", target, gradeID)
+	case status == http.StatusNotFound:
+		return fmt.Sprintf("%s?notice=deleted&grade=%d", target, gradeID)
+	}
+	return fmt.Sprintf("%s?notice=failed&grade=%d", target, gradeID)
 }
 
 type studentsHandler struct{}
@@ -45,6 +118,26 @@ func (sh studentsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		sh.renderGrades(w, r, id)
+	case 5, 6: // /students/{:id}/grades/{:gradeId}[/delete]
+		id, err := strconv.Atoi(pathSegments[2])
+		if err != nil || strings.ToLower(pathSegments[3]) != "grades" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		gradeID, err := strconv.Atoi(pathSegments[4])
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if len(pathSegments) == 6 {
+			if pathSegments[5] != "delete" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			sh.deleteGrade(w, r, id, gradeID)
+			return
+		}
+		sh.editGrade(w, r, id, gradeID)
 
 	default:
 		w.WriteHeader(http.StatusNotFound)
@@ -56,7 +149,7 @@ func (studentsHandler) renderStudents(w http.ResponseWriter, r *http.Request) {
 	defer func() {
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
-			log.Println("Error retrieving students: ", err)
+			log.Errorf(r.Context(), "Error retrieving students: %s", err)
 		}
 	}()
 
@@ -66,19 +159,89 @@ func (studentsHandler) renderStudents(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	res, err := http.Get(serviceURL + "/students")
+	// 过滤、排序与游标原样传给成绩服务，列表页只需要姓名与平均分
+	in := r.URL.Query()
+	query := url.Values{}
+	for _, name := range listParams {
+		if v := strings.TrimSpace(in.Get(name)); v != "" {
+			query.Set(name, v)
+		}
+	}
+	page := studentsPage{Query: query}
+	query.Set("limit", strconv.Itoa(studentsPerPage))
+	query.Set("fields", "ID,FirstName,LastName,Average")
+	res, err := get(r.Context(), serviceURL+"/students?"+query.Encode())
 	if err != nil {
 		fmt.Println(err)
 		return
 	}
-	//fmt.Println("res = ", res)
-	var s grades.Students
-	err = json.NewDecoder(res.Body).Decode(&s)
+	defer func() { _ = res.Body.Close() }()
+	switch res.StatusCode {
+	case http.StatusOK:
+	case http.StatusBadRequest:
+		// 参数不正确时显示成绩服务给出的原因，并列出所有学生
+		var p grades.Problem
+		_ = json.NewDecoder(res.Body).Decode(&p)
+		http.Redirect(w, r, "/students?notice="+url.QueryEscape(p.Detail), http.StatusSeeOther)
+		return
+	default:
+		err = fmt.Errorf("Grading service responded with code %v", res.StatusCode)
+		return
+	}
+	err = json.NewDecoder(res.Body).Decode(&page)
 	if err != nil {
 		return
 	}
+	page.Notice = in.Get("notice")
+	page.Query.Del("limit")
+	page.Query.Del("fields")
+	page.Query.Del("cursor")
+
+	rootTemplate.Lookup("students.html").Execute(w, page)
+}
+
+// 列表页传给成绩服务的查询参数
+var listParams = []string{"name", "course", "min_average", "max_average", "sort", "cursor"}
+
+// 列表页每页显示的学生数
+const studentsPerPage = 20
+
+// 学生列表页的数据
+type studentsPage struct {
+	Students []struct {
+		ID        int
+		FirstName string
+		LastName  string
+		Average   float32
+	}
+	Total      int
+	NextCursor string
+	// 当前的过滤与排序条件，不含游标
+	Query  url.Values
+	Notice string
+}
+
+// 当前条件下按 field 排序的链接，已按该字段升序时改为降序
+func (p studentsPage) SortLink(field string) string {
+	q := url.Values{}
+	for k, v := range p.Query {
+		q[k] = v
+	}
+	if q.Get("sort") == field {
+		field = "-" + field
+	}
+	q.Set("sort", field)
+	return "/students?" + q.Encode()
+}
 
-	rootTemplate.Lookup("students.html").Execute(w, s)
+// 下一页的链接
+func (p studentsPage) NextLink() string {
+	q := url.Values{}
+	for k, v := range p.Query {
+		q[k] = v
+	}
+	q.Set("cursor", p.NextCursor)
+	return "/students?" + q.Encode()
 }
 
 func (studentsHandler) renderStudent(w http.ResponseWriter, r *http.Request, id int) {
@@ -87,7 +250,7 @@ func (studentsHandler) renderStudent(w http.ResponseWriter, r *http.Request, id
 	defer func() {
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
-			log.Println("Error retrieving students: ", err)
+			log.Errorf(r.Context(), "Error retrieving students: %s", err)
 			return
 		}
 	}()
@@ -97,18 +260,23 @@ func (studentsHandler) renderStudent(w http.ResponseWriter, r *http.Request, id
 		return
 	}
 
-	res, err := http.Get(fmt.Sprintf("%v/students/%v", serviceURL, id))
+	res, err := get(r.Context(), fmt.Sprintf("%v/students/%v", serviceURL, id))
 	if err != nil {
 		return
 	}
+	defer func() { _ = res.Body.Close() }()
+	if res.StatusCode != http.StatusOK {
+		err = fmt.Errorf("Grading service responded with code %v", res.StatusCode)
+		return
+	}
 
-	var s grades.Student
-	err = json.NewDecoder(res.Body).Decode(&s)
+	page := studentPage{Notice: gradeNotice(r.URL.Query())}
+	err = json.NewDecoder(res.Body).Decode(&page.Student)
 	if err != nil {
 		return
 	}
 
-	rootTemplate.Lookup("student.html").Execute(w, s)
+	rootTemplate.Lookup("student.html").Execute(w, page)
 }
 
 func (studentsHandler) renderGrades(w http.ResponseWriter, r *http.Request, id int) {
@@ -124,7 +292,7 @@ func (studentsHandler) renderGrades(w http.ResponseWriter, r *http.Request, id i
 	gradeType := r.FormValue("Type")
 	score, err := strconv.ParseFloat(r.FormValue("Score"), 32)
 	if err != nil {
-		log.Println("Failed to parse score: ", err)
+		log.Warnf(r.Context(), "Failed to parse score: %s", err)
 		return
 	}
 	g := grades.Grade{
@@ -134,21 +302,97 @@ func (studentsHandler) renderGrades(w http.ResponseWriter, r *http.Request, id i
 	}
 	data, err := json.Marshal(g)
 	if err != nil {
-		log.Println("Failed to convert grade to JSON: ", g, err)
+		log.Errorf(r.Context(), "Failed to convert grade to JSON: %v %s", g, err)
 	}
 
 	serviceURL, err := registry.GetProvider(registry.GradingService)
 	if err != nil {
-		log.Println("Failed to retrieve instance of Grading Service", err)
+		log.Errorf(r.Context(), "Failed to retrieve instance of Grading Service: %s", err)
 		return
 	}
-	res, err := http.Post(fmt.Sprintf("%v/students/%v/grades", serviceURL, id), "application/json", bytes.NewBuffer(data))
+	res, err := post(r.Context(), fmt.Sprintf("%v/students/%v/grades", serviceURL, id), "application/json", bytes.NewBuffer(data))
 	if err != nil {
-		log.Println("Failed to save grade to Grading Service", err)
+		log.Errorf(r.Context(), "Failed to save grade to Grading Service: %s", err)
 		return
 	}
+	_ = res.Body.Close()
 	if res.StatusCode != http.StatusCreated {
-		log.Println("Failed to save grade to Grading Service. Status: ", res.StatusCode)
+		log.Errorf(r.Context(), "Failed to save grade to Grading Service. Status: %d", res.StatusCode)
+		return
+	}
+}
+
+// 表单中的成绩
+func gradeFromForm(r *http.Request) (grades.Grade, error) {
+	score, err := strconv.ParseFloat(r.FormValue("Score"), 32)
+	if err != nil {
+		return grades.Grade{}, err
+	}
+	return grades.Grade{
+		Title: r.FormValue("Title"),
+		Type:  grades.GradeType(r.FormValue("Type")),
+		Score: float32(score),
+	}, nil
+}
+
+// 表单只能使用 POST，修改后回到学生页面
+func (studentsHandler) editGrade(w http.ResponseWriter, r *http.Request, id, gradeID int) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	status, ok := 0, false
+	defer func() { http.Redirect(w, r, gradeRedirect(id, gradeID, status, ok), http.StatusSeeOther) }()
+	g, err := gradeFromForm(r)
+	if err != nil {
+		log.Warnf(r.Context(), "Failed to parse score: %s", err)
+		return
+	}
+	// 使用 PATCH，只修改表单中的字段，成绩关联的选课记录保持不变
+	data, err := json.Marshal(map[string]interface{}{"Title": g.Title, "Type": g.Type, "Score": g.Score})
+	if err != nil {
+		log.Errorf(r.Context(), "Failed to convert grade to JSON: %v %s", g, err)
+		return
+	}
+	serviceURL, err := registry.GetProvider(registry.GradingService)
+	if err != nil {
+		log.Errorf(r.Context(), "Failed to retrieve instance of Grading Service: %s", err)
+		return
+	}
+	res, err := sendIfMatch(r.Context(), http.MethodPatch, fmt.Sprintf("%v/students/%v/grades/%v", serviceURL, id, gradeID),
+		"application/json", r.FormValue("Version"), bytes.NewBuffer(data))
+	if err != nil {
+		log.Errorf(r.Context(), "Failed to update grade in Grading Service: %s", err)
 		return
 	}
+	_ = res.Body.Close()
+	status, ok = res.StatusCode, res.StatusCode == http.StatusOK
+	if !ok {
+		log.Errorf(r.Context(), "Failed to update grade in Grading Service. Status: %d", res.StatusCode)
+	}
+}
+
+func (studentsHandler) deleteGrade(w http.ResponseWriter, r *http.Request, id, gradeID int) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	status, ok := 0, false
+	defer func() { http.Redirect(w, r, gradeRedirect(id, gradeID, status, ok), http.StatusSeeOther) }()
+	serviceURL, err := registry.GetProvider(registry.GradingService)
+	if err != nil {
+		log.Errorf(r.Context(), "Failed to retrieve instance of Grading Service: %s", err)
+		return
+	}
+	res, err := sendIfMatch(r.Context(), http.MethodDelete, fmt.Sprintf("%v/students/%v/grades/%v", serviceURL, id, gradeID),
+		"", r.FormValue("Version"), nil)
+	if err != nil {
+		log.Errorf(r.Context(), "Failed to delete grade from Grading Service: %s", err)
+		return
+	}
+	_ = res.Body.Close()
+	status, ok = res.StatusCode, res.StatusCode == http.StatusNoContent
+	if !ok {
+		log.Errorf(r.Context(), "Failed to delete grade from Grading Service. Status: %d", res.StatusCode)
+	}
 }
@@ -1,16 +1,24 @@
 package portal
 
 import (
+	"fmt"
 	"html/template"
+	"path/filepath"
 )
 
 var rootTemplate *template.Template
 
-func ImportTemplates() error {
+// 门户页面使用的模板文件
+var templateNames = []string{"students.html", "student.html"}
+
+// 从 dir 目录加载模板文件
+func ImportTemplates(dir string) error {
 	var err error
-	rootTemplate, err = template.ParseFiles(
-		"E:\\Go_Code\\Distribute\\portal\\students.html",
-		"E:\\Go_Code\\Distribute\\portal\\student.html")
+	files := make([]string, 0, len(templateNames))
+	for _, name := range templateNames {
+		files = append(files, filepath.Join(dir, name))
+	}
+	rootTemplate, err = template.ParseFiles(files...)
 
 	if err != nil {
 		return err
@@ -18,3 +26,16 @@ func ImportTemplates() error {
 
 	return nil
 }
+
+// CheckTemplates 检查模板是否全部加载，作为门户的就绪检查
+func CheckTemplates() error {
+	if rootTemplate == nil {
+		return fmt.Errorf("Templates not loaded")
+	}
+	for _, name := range templateNames {
+		if rootTemplate.Lookup(name) == nil {
+			return fmt.Errorf("Template %s not loaded", name)
+		}
+	}
+	return nil
+}
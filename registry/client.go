@@ -1,6 +1,7 @@
 package registry
 
 import (
+	"Distribute/metrics"
 	"bytes"
 	"encoding/json"
 	"fmt"
@@ -8,7 +9,32 @@ import (
 	"math/rand"
 	"net/http"
 	"net/url"
+	"strings"
 	"sync"
+	"time"
+)
+
+const (
+	// 续约间隔，服务定期向注册中心确认自己仍然处于注册状态
+	renewInterval = 5 * time.Second
+	// 超过该时间没有收到注册中心的心跳检测，认为注册已经丢失
+	heartbeatTimeout = 20 * time.Second
+	// 重新注册时的退避时间范围
+	minBackoff = 500 * time.Millisecond
+	maxBackoff = 30 * time.Second
+)
+
+var (
+	heartbeatsReceived = metrics.NewCounter("registry_heartbeats_received_total",
+		"Heartbeat checks received from the registry.")
+	reregistrations = metrics.NewCounter("registry_reregistrations_total",
+		"Times this service registered again after losing its registration.")
+	patchLag = metrics.NewHistogram("registry_patch_delivery_lag_seconds",
+		"Delay between the registry sending a service update and this service receiving it.",
+		metrics.DefBuckets)
+	providerCount = metrics.NewGauge("registry_providers",
+		"Number of known provider URLs, by service.",
+		"service")
 )
 
 func RegisterService(r Registration) error {
@@ -17,6 +43,8 @@ func RegisterService(r Registration) error {
 		return err
 	}
 	http.HandleFunc(heartbeatURL.Path, func(writer http.ResponseWriter, request *http.Request) {
+		sess.touch()
+		heartbeatsReceived.With().Inc()
 		writer.WriteHeader(http.StatusOK)
 	})
 	serviceUpdateURL, err := url.Parse(r.ServiceUpdateURL)
@@ -24,9 +52,19 @@ func RegisterService(r Registration) error {
 		return err
 	}
 	http.Handle(serviceUpdateURL.Path, serviceUpdateHandler{})
+	err = register(r)
+	if err != nil {
+		return err
+	}
+	sess.start(r)
+	return nil
+}
+
+// 向注册中心发送注册请求，并记录注册中心当前的 epoch
+func register(r Registration) error {
 	buf := new(bytes.Buffer)
 	enc := json.NewEncoder(buf)
-	err = enc.Encode(r)
+	err := enc.Encode(r)
 	if err != nil {
 		return err
 	}
@@ -34,10 +72,13 @@ func RegisterService(r Registration) error {
 	if err != nil {
 		return err
 	}
+	defer func() { _ = res.Body.Close() }()
 	if res.StatusCode != http.StatusOK {
 		return fmt.Errorf("Failed to register service. "+
 			"Registry service responsed with code %v", res.StatusCode)
 	}
+	sess.setEpoch(res.Header.Get(EpochHeader))
+	sess.touch()
 	return nil
 }
 
@@ -56,11 +97,16 @@ func (suh serviceUpdateHandler) ServeHTTP(w http.ResponseWriter, r *http.Request
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
+	if !p.SentAt.IsZero() {
+		patchLag.With().Observe(time.Since(p.SentAt).Seconds())
+	}
 	fmt.Printf("Updated receied [Add : %v] [Remove : %v]\n", p.Added, p.Removed)
 	prov.Update(p)
 }
 
 func ShutDownService(url string) error {
+	// 主动取消注册后不再续约，否则会被重新注册
+	sess.stop()
 	// http包没有提供 delete 方法，可以自己构建请求
 	request, err := http.NewRequest(http.MethodDelete, ServicesURL, bytes.NewBuffer([]byte(url)))
 	if err != nil {
@@ -72,6 +118,7 @@ func ShutDownService(url string) error {
 	if err != nil {
 		return err
 	}
+	defer func() { _ = res.Body.Close() }()
 	if res.StatusCode != http.StatusOK {
 		return fmt.Errorf("Failed to deregister service. "+
 			"Registry service responded with code %v", res.StatusCode)
@@ -79,6 +126,145 @@ func ShutDownService(url string) error {
 	return nil
 }
 
+// 服务端的注册会话，负责续约以及注册丢失后的重新注册
+type session struct {
+	registration  Registration
+	epoch         string
+	lastHeartbeat time.Time
+	started       bool
+	done          chan struct{}
+	mutex         *sync.Mutex
+}
+
+var sess = session{
+	done:  make(chan struct{}),
+	mutex: new(sync.Mutex),
+}
+
+func (s *session) touch() {
+	s.mutex.Lock()
+	s.lastHeartbeat = time.Now()
+	s.mutex.Unlock()
+}
+
+func (s *session) setEpoch(epoch string) {
+	s.mutex.Lock()
+	s.epoch = epoch
+	s.mutex.Unlock()
+}
+
+func (s *session) start(r Registration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.registration = r
+	if s.started {
+		return
+	}
+	s.started = true
+	go s.keepAlive()
+}
+
+func (s *session) stop() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	select {
+	case <-s.done:
+	default:
+		close(s.done)
+	}
+}
+
+/**
+ * keepAlive
+ * @Description: 定期续约，检测到注册丢失（续约返回 404、注册中心 epoch 变化、长时间未收到心跳）时重新注册
+ * @receiver s
+ */
+func (s *session) keepAlive() {
+	ticker := time.NewTicker(renewInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+		reason, err := s.check()
+		if err != nil {
+			// 注册中心暂时不可达，等待下一次续约
+			log.Println(err)
+			continue
+		}
+		if reason == "" {
+			continue
+		}
+		log.Printf("Registration lost (%s), registering again\n", reason)
+		s.reregister()
+	}
+}
+
+// 返回注册丢失的原因，为空说明注册仍然有效
+func (s *session) check() (string, error) {
+	s.mutex.Lock()
+	r := s.registration
+	epoch := s.epoch
+	last := s.lastHeartbeat
+	s.mutex.Unlock()
+
+	request, err := http.NewRequest(http.MethodPut, ServicesURL, strings.NewReader(r.ServiceURL))
+	if err != nil {
+		return "", err
+	}
+	request.Header.Add("Content-Type", "text/plain")
+	res, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return "", err
+	}
+	_ = res.Body.Close()
+	switch {
+	case res.StatusCode == http.StatusNotFound:
+		return "registry does not know this instance", nil
+	case res.StatusCode != http.StatusOK:
+		return "", fmt.Errorf("Failed to renew registration. "+
+			"Registry service responded with code %v", res.StatusCode)
+	}
+	if current := res.Header.Get(EpochHeader); current != "" && current != epoch {
+		return fmt.Sprintf("registry epoch changed from %q to %q", epoch, current), nil
+	}
+	if time.Since(last) > heartbeatTimeout {
+		return fmt.Sprintf("no heartbeat for %v", time.Since(last).Round(time.Second)), nil
+	}
+	return "", nil
+}
+
+// 带退避的重新注册，注册成功后注册中心会重新发送所需服务的完整列表，替换原有的服务提供方
+// 注册失败期间保留原有的服务提供方，仍然存活的依赖可以继续调用
+func (s *session) reregister() {
+	backoff := minBackoff
+	for {
+		s.mutex.Lock()
+		r := s.registration
+		s.mutex.Unlock()
+		err := register(r)
+		if err == nil {
+			reregistrations.With().Inc()
+			log.Printf("Service %v registered again\n", r.ServiceName)
+			return
+		}
+		log.Println(err)
+		// 加入随机抖动，避免注册中心重启后所有服务同时注册
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff)))
+		select {
+		case <-s.done:
+			return
+		case <-time.After(wait):
+		}
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
 // 服务提供方
 type providers struct {
 	// 每个服务可能有多个 url
@@ -92,35 +278,122 @@ var prov = providers{
 	mutex:    new(sync.RWMutex),
 }
 
+// Update 应用注册中心发来的变化，并在锁外通知监听者
 func (p *providers) Update(pat patch) {
+	names := p.update(pat)
+	for _, entries := range [][]patchEntry{pat.Added, pat.Removed} {
+		for _, entry := range entries {
+			if !containsName(names, entry.Name) {
+				names = append(names, entry.Name)
+			}
+		}
+	}
+	p.changed(names)
+}
+
+// 返回完整列表替换掉的服务
+func (p *providers) update(pat patch) []ServiceName {
 	p.mutex.Lock()
 	defer p.mutex.Unlock()
 
-	// 增加服务提供方
+	defer p.observe()
+
+	var replaced []ServiceName
+	if pat.Full {
+		for name := range p.services {
+			providerCount.With(string(name)).Set(0)
+			replaced = append(replaced, name)
+		}
+		p.services = make(map[ServiceName][]string)
+	}
+
+	// 增加服务提供方，重复通知的 url 不再重复添加
 	for _, patchEntry := range pat.Added {
 		if _, ok := p.services[patchEntry.Name]; !ok {
 			p.services[patchEntry.Name] = make([]string, 0)
 		}
-		p.services[patchEntry.Name] = append(p.services[patchEntry.Name], patchEntry.URL)
+		if indexOf(p.services[patchEntry.Name], patchEntry.URL) < 0 {
+			p.services[patchEntry.Name] = append(p.services[patchEntry.Name], patchEntry.URL)
+		}
 	}
 
 	// 删除服务提供方
 	for _, patchEntry := range pat.Removed {
 		if provideUrls, ok := p.services[patchEntry.Name]; ok {
-			for i := range provideUrls {
-				if provideUrls[i] == patchEntry.URL {
-					p.services[patchEntry.Name] = append(provideUrls[:i], provideUrls[i+1:]...)
-				}
+			if i := indexOf(provideUrls, patchEntry.URL); i >= 0 {
+				p.services[patchEntry.Name] = append(provideUrls[:i], provideUrls[i+1:]...)
 			}
+			if len(p.services[patchEntry.Name]) == 0 {
+				delete(p.services, patchEntry.Name)
+				providerCount.With(string(patchEntry.Name)).Set(0)
+			}
+		}
+	}
+	return replaced
+}
+
+// ProviderListener 服务提供方变化时的回调，urls 为该服务当前所有的 url，为空表示没有可用的提供方
+type ProviderListener func(name ServiceName, urls []string)
+
+var (
+	listeners      []ProviderListener
+	listenersMutex = new(sync.RWMutex)
+)
+
+// AddProviderListener 注册服务提供方变化时的回调，回调在接收注册中心通知的 goroutine 中执行，不应阻塞
+func AddProviderListener(l ProviderListener) {
+	listenersMutex.Lock()
+	listeners = append(listeners, l)
+	listenersMutex.Unlock()
+}
+
+// 通知监听者 names 中的服务发生了变化
+func (p *providers) changed(names []ServiceName) {
+	listenersMutex.RLock()
+	defer listenersMutex.RUnlock()
+	if len(listeners) == 0 {
+		return
+	}
+	for _, name := range names {
+		urls := ProvidersOf(name)
+		for _, l := range listeners {
+			l(name, urls)
+		}
+	}
+}
+
+func containsName(names []ServiceName, name ServiceName) bool {
+	for _, n := range names {
+		if n == name {
+			return true
 		}
 	}
+	return false
+}
+
+// 更新服务提供方数量指标，调用方需持有锁
+func (p *providers) observe() {
+	for name, urls := range p.services {
+		providerCount.With(string(name)).Set(float64(len(urls)))
+	}
+}
+
+func indexOf(urls []string, url string) int {
+	for i := range urls {
+		if urls[i] == url {
+			return i
+		}
+	}
+	return -1
 }
 
 // 代码较简单，每个服务只对应一个 url，所以此处只返回一个，而不是[]string
 // 根据服务名称获取其对应的 url
-func (p providers) get(name ServiceName) (string, error) {
+func (p *providers) get(name ServiceName) (string, error) {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
 	providerURLs, ok := p.services[name]
-	if !ok {
+	if !ok || len(providerURLs) == 0 {
 		return "", fmt.Errorf("No providers available for service %v", name)
 	}
 	index := int(rand.Float32() * float32(len(providerURLs)))
@@ -137,3 +410,21 @@ func (p providers) get(name ServiceName) (string, error) {
 func GetProvider(name ServiceName) (string, error) {
 	return prov.get(name)
 }
+
+// ProvidersOf 返回服务当前所有的提供方
+func ProvidersOf(name ServiceName) []string {
+	prov.mutex.RLock()
+	defer prov.mutex.RUnlock()
+	return append([]string(nil), prov.services[name]...)
+}
+
+// Providers 返回当前已知的所有服务提供方的副本
+func Providers() map[ServiceName][]string {
+	prov.mutex.RLock()
+	defer prov.mutex.RUnlock()
+	result := make(map[ServiceName][]string, len(prov.services))
+	for name, urls := range prov.services {
+		result[name] = append([]string(nil), urls...)
+	}
+	return result
+}
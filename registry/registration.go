@@ -1,5 +1,7 @@
 package registry
 
+import "time"
+
 type ServiceName string
 
 type Registration struct {
@@ -11,6 +13,8 @@ type Registration struct {
 	ServiceUpdateURL string
 	// 用于心跳检测的URL
 	HeartbeatURL string
+	// 用于就绪检查的URL，存活但未就绪的服务不会提供给依赖方，为空时只做心跳检测
+	ReadinessURL string
 }
 
 // 目前存在的服务类型
@@ -29,4 +33,8 @@ type patchEntry struct {
 type patch struct {
 	Added   []patchEntry
 	Removed []patchEntry
+	// 注册中心发送的时间，用于统计通知的延迟
+	SentAt time.Time
+	// 为 true 时 Added 是所需服务当前所有的提供方，替换服务已知的全部提供方
+	Full bool `json:",omitempty"`
 }
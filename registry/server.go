@@ -1,12 +1,14 @@
 package registry
 
 import (
+	"Distribute/metrics"
 	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"strconv"
 	"sync"
 	"time"
 )
@@ -15,25 +17,73 @@ const (
 	ServerPort = ":3000"
 	// 通过该地址可以查看哪些服务已经在此注册
 	ServicesURL = "http://localhost" + ServerPort + "/services"
+	// 注册中心在每个响应中携带的 epoch，重启后会变化，服务据此判断是否需要重新注册
+	EpochHeader = "X-Registry-Epoch"
 )
 
+// 注册中心本次启动的 epoch
+var epoch = strconv.FormatInt(time.Now().UnixNano(), 36)
+
+var (
+	heartbeatChecks = metrics.NewCounter("registry_heartbeat_checks_total",
+		"Heartbeat checks performed by the registry, by service and result.",
+		"service", "result")
+	patchesSent = metrics.NewCounter("registry_patches_sent_total",
+		"Service update patches sent by the registry, by result.",
+		"result")
+	readinessChecks = metrics.NewCounter("registry_readiness_checks_total",
+		"Readiness checks performed by the registry, by service and result.",
+		"service", "result")
+)
+
+func init() {
+	metrics.NewGaugeFunc("registry_registrations",
+		"Number of service instances currently registered in the registry.",
+		func() float64 {
+			reg.mutex.RLock()
+			defer reg.mutex.RUnlock()
+			return float64(len(reg.registrations))
+		})
+}
+
 type registry struct {
 	// 保存已经注册的服务
 	registrations []Registration
-	mutex         *sync.RWMutex
+	// 存活但未就绪的服务，以 ServiceURL 为 key，这些服务不会提供给依赖方
+	unready map[string]bool
+	mutex   *sync.RWMutex
 }
 
 // 全局 registry 实例,用于管理所有注册的服务
 var reg = registry{
 	registrations: make([]Registration, 0),
+	unready:       make(map[string]bool),
 	mutex:         new(sync.RWMutex),
 }
 
 // 添加服务，在添加该服务时直接将该服务所依赖的服务给他
+// 同一个 ServiceURL 重复注册时替换原有的注册信息，不会重复通知
+// 提供了 ReadinessURL 的服务在第一次就绪检查通过之前视为未就绪，由 probeReadiness 通知依赖方
 func (r *registry) add(reg Registration) error {
 	r.mutex.Lock()
-	r.registrations = append(r.registrations, reg)
+	exists := false
+	for i := range r.registrations {
+		if r.registrations[i].ServiceURL == reg.ServiceURL {
+			r.registrations[i] = reg
+			exists = true
+			break
+		}
+	}
+	if !exists {
+		r.registrations = append(r.registrations, reg)
+		if reg.ReadinessURL != "" {
+			r.unready[reg.ServiceURL] = true
+		}
+	}
 	r.mutex.Unlock()
+	if exists || reg.ReadinessURL != "" {
+		return r.sendRequiredServices(reg)
+	}
 	// 在注册服务时，通知需要该服务的service
 	r.notify(patch{
 		Added: []patchEntry{
@@ -59,13 +109,13 @@ func (r registry) notify(fullPatch patch) {
 				}
 				sendUpdate := false
 				for _, added := range fullPatch.Added {
-					if added.Name == requireServiceName {
+					if added.Name == requireServiceName && added.URL != reg.ServiceURL {
 						p.Added = append(p.Added, added)
 						sendUpdate = true
 					}
 				}
 				for _, removed := range fullPatch.Removed {
-					if removed.Name == requireServiceName {
+					if removed.Name == requireServiceName && removed.URL != reg.ServiceURL {
 						p.Removed = append(p.Removed, removed)
 						sendUpdate = true
 					}
@@ -83,9 +133,16 @@ func (r registry) notify(fullPatch patch) {
 }
 
 func (r *registry) sendRequiredServices(reg Registration) error {
-	var p patch
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	// 注册或重新注册时下发完整的列表，替换服务之前已知的提供方
+	p := patch{Full: true}
 	// 查找是否有当前服务需要的服务
 	for _, existService := range r.registrations {
+		// 未就绪的服务不参与路由，服务也不会依赖自身
+		if r.unready[existService.ServiceURL] || existService.ServiceURL == reg.ServiceURL {
+			continue
+		}
 		for _, needService := range reg.RequiredServices {
 			if existService.ServiceName == needService {
 				// 匹配到后，将其加入保存需要添加服务的结构体中
@@ -104,38 +161,121 @@ func (r *registry) sendRequiredServices(reg Registration) error {
 }
 
 func (r *registry) sendPatch(p patch, url string) error {
+	p.SentAt = time.Now()
 	jsonData, err := json.Marshal(p)
 	if err != nil {
 		return err
 	}
-	_, err = http.Post(url, "application/json", bytes.NewBuffer(jsonData))
+	res, err := http.Post(url, "application/json", bytes.NewBuffer(jsonData))
 	if err != nil {
+		patchesSent.With("failure").Inc()
 		return err
 	}
+	patchesSent.With("success").Inc()
+	_ = res.Body.Close()
 	return nil
 }
 
+// 判断服务是否仍处于注册状态
+func (r *registry) contains(url string) bool {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	for _, registration := range r.registrations {
+		if registration.ServiceURL == url {
+			return true
+		}
+	}
+	return false
+}
+
 // 取消服务
 func (r *registry) remove(url string) error {
+	r.mutex.Lock()
 	for index, registration := range r.registrations {
 		if registration.ServiceURL == url {
-			r.mutex.Lock()
 			r.registrations = append(r.registrations[:index], r.registrations[index+1:]...)
+			wasReady := !r.unready[url]
+			delete(r.unready, url)
 			r.mutex.Unlock()
+			// 未就绪的服务已经从依赖方移除，无需再次通知
+			if !wasReady {
+				return nil
+			}
 			r.notify(patch{
 				Removed: []patchEntry{
 					{
 						Name: registration.ServiceName,
-						URL:  registration.ServiceUpdateURL,
+						URL:  registration.ServiceURL,
 					},
 				},
 			})
 			return nil
 		}
 	}
+	r.mutex.Unlock()
 	return fmt.Errorf("Service at URL %s not found", url)
 }
 
+/**
+ * probeReadiness
+ * @Description: 检查存活服务是否就绪，就绪状态变化时通知依赖方，未就绪的服务不再参与路由
+ * @receiver r
+ * @param reg
+ */
+func (r *registry) probeReadiness(reg Registration) {
+	if reg.ReadinessURL == "" {
+		return
+	}
+	ready := false
+	res, err := http.Get(reg.ReadinessURL)
+	if err != nil {
+		log.Println(err)
+	} else {
+		ready = res.StatusCode == http.StatusOK
+		_ = res.Body.Close()
+	}
+	if ready {
+		readinessChecks.With(string(reg.ServiceName), "ready").Inc()
+	} else {
+		readinessChecks.With(string(reg.ServiceName), "not_ready").Inc()
+	}
+
+	r.mutex.Lock()
+	// 检查期间服务已经被移除
+	registered := false
+	for _, registration := range r.registrations {
+		registered = registered || registration.ServiceURL == reg.ServiceURL
+	}
+	if !registered {
+		r.mutex.Unlock()
+		return
+	}
+	wasReady := !r.unready[reg.ServiceURL]
+	if ready {
+		delete(r.unready, reg.ServiceURL)
+	} else {
+		r.unready[reg.ServiceURL] = true
+	}
+	r.mutex.Unlock()
+	if wasReady == ready {
+		return
+	}
+
+	entry := []patchEntry{
+		{
+			Name: reg.ServiceName,
+			URL:  reg.ServiceURL,
+		},
+	}
+	if ready {
+		log.Printf("Service %v at %v is ready\n", reg.ServiceName, reg.ServiceURL)
+		r.notify(patch{Added: entry})
+	} else {
+		log.Printf("Service %v at %v is not ready\n", reg.ServiceName, reg.ServiceURL)
+		r.notify(patch{Removed: entry})
+	}
+}
+
 /**
  * HeartBeat
  * @Description: 心跳检测机制
@@ -145,7 +285,11 @@ func (r *registry) remove(url string) error {
 func (r *registry) HeartBeat(freq time.Duration) {
 	for {
 		var wg sync.WaitGroup
-		for _, registration := range r.registrations {
+		r.mutex.RLock()
+		registrations := make([]Registration, len(r.registrations))
+		copy(registrations, r.registrations)
+		r.mutex.RUnlock()
+		for _, registration := range registrations {
 			wg.Add(1)
 			go func(reg Registration) {
 				defer wg.Done()
@@ -156,12 +300,19 @@ func (r *registry) HeartBeat(freq time.Duration) {
 					if err != nil {
 						log.Println(err)
 					} else if res.StatusCode == http.StatusOK {
+						_ = res.Body.Close()
+						heartbeatChecks.With(string(reg.ServiceName), "success").Inc()
 						log.Printf("Heartbeat check passed for %v\n", reg.ServiceName)
 						if !success {
 							_ = r.add(reg)
 						}
+						r.probeReadiness(reg)
 						break
 					}
+					if err == nil {
+						_ = res.Body.Close()
+					}
+					heartbeatChecks.With(string(reg.ServiceName), "failure").Inc()
 					log.Printf("Heartbeat check failed for %v\n", reg.ServiceName)
 					if success {
 						success = false
@@ -188,6 +339,7 @@ type RegistryService struct{}
 
 func (rs RegistryService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	log.Println("Request received")
+	w.Header().Set(EpochHeader, epoch)
 	switch r.Method {
 	// post 注册
 	case http.MethodPost:
@@ -207,6 +359,8 @@ func (rs RegistryService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
+		// 不等待下一轮心跳，尽快让新服务参与路由
+		go reg.probeReadiness(register)
 	//	delete 取消服务
 	case http.MethodDelete:
 		payload, err := io.ReadAll(r.Body)
@@ -224,6 +378,18 @@ func (rs RegistryService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
+	//	put 续约，注册中心不存在该服务时返回 404，服务需要重新注册
+	case http.MethodPut:
+		payload, err := io.ReadAll(r.Body)
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if !reg.contains(string(payload)) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
 	default:
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
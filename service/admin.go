@@ -0,0 +1,233 @@
+package service
+
+import (
+	"Distribute/registry"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"runtime/pprof"
+	rtrace "runtime/trace"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 管理端口监听地址，为空时不启动，通过 EnableAdmin 开启
+var adminAddr string
+
+// EnableAdmin 在单独的端口上开启运行时诊断接口，需要在 Start 之前调用
+// 诊断接口包含 pprof 与配置信息，只应监听在内网或本机地址上
+func EnableAdmin(addr string) {
+	adminAddr = addr
+}
+
+// 配置项名称包含这些词时，展示配置时隐藏其值
+var secretWords = []string{"secret", "password", "token", "key", "credential"}
+
+/**
+ * startAdmin
+ * @Description: 启动管理端口，与业务端口使用不同的 ServeMux，避免诊断接口暴露在业务路由上
+ * @param ctx 取消时关闭管理端口
+ */
+func startAdmin(ctx context.Context) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprofIndex)
+	mux.HandleFunc("/debug/pprof/cmdline", pprofCmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprofCPU)
+	mux.HandleFunc("/debug/pprof/trace", pprofTrace)
+	mux.HandleFunc("/debug/goroutines", goroutines)
+	mux.HandleFunc("/debug/buildinfo", buildInfo)
+	mux.HandleFunc("/debug/runtime", runtimeStats)
+	mux.HandleFunc("/debug/config", config)
+	mux.HandleFunc("/debug/providers", providers)
+
+	srv := http.Server{Addr: adminAddr, Handler: mux}
+	go func() {
+		log.Printf("Admin listener started at %s\n", adminAddr)
+		err := srv.ListenAndServe()
+		if err != http.ErrServerClosed {
+			log.Println(err)
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		_ = srv.Shutdown(context.Background())
+	}()
+}
+
+var pprofIndexTemplate = template.Must(template.New("pprof").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head><meta charset="UTF-8"><title>/debug/pprof/</title></head>
+<body>
+<h1>/debug/pprof/</h1>
+<table>
+    <tr><th>Count</th><th>Profile</th></tr>
+    {{range .}}
+    <tr><td>{{.Count}}</td><td><a href="/debug/pprof/{{.Name}}?debug=1">{{.Name}}</a></td></tr>
+    {{end}}
+</table>
+<ul>
+    <li><a href="/debug/pprof/profile?seconds=30">CPU profile (30s)</a></li>
+    <li><a href="/debug/pprof/trace?seconds=5">Execution trace (5s)</a></li>
+    <li><a href="/debug/pprof/cmdline">cmdline</a></li>
+    <li><a href="/debug/goroutines">goroutine dump</a></li>
+    <li><a href="/debug/buildinfo">build info</a></li>
+    <li><a href="/debug/runtime">runtime stats</a></li>
+    <li><a href="/debug/config">configuration</a></li>
+    <li><a href="/debug/providers">providers</a></li>
+</ul>
+</body>
+</html>`))
+
+// GET /debug/pprof/ 列出所有 profile，GET /debug/pprof/{name}?debug=N 输出对应 profile
+func pprofIndex(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/debug/pprof/")
+	if name == "" {
+		type entry struct {
+			Name  string
+			Count int
+		}
+		var entries []entry
+		for _, p := range pprof.Profiles() {
+			entries = append(entries, entry{Name: p.Name(), Count: p.Count()})
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_ = pprofIndexTemplate.Execute(w, entries)
+		return
+	}
+	profile := pprof.Lookup(name)
+	if profile == nil {
+		http.Error(w, fmt.Sprintf("Unknown profile %s", name), http.StatusNotFound)
+		return
+	}
+	debugLevel, _ := strconv.Atoi(r.URL.Query().Get("debug"))
+	if debugLevel > 0 {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	} else {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	}
+	if name == "heap" && r.URL.Query().Get("gc") != "" {
+		runtime.GC()
+	}
+	_ = profile.WriteTo(w, debugLevel)
+}
+
+func pprofCmdline(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, _ = fmt.Fprint(w, strings.Join(os.Args, "\x00"))
+}
+
+// 采样时长，默认 30 秒，最长不超过 5 分钟
+func seconds(r *http.Request, def int) time.Duration {
+	sec, err := strconv.Atoi(r.URL.Query().Get("seconds"))
+	if err != nil || sec <= 0 {
+		sec = def
+	}
+	if sec > 300 {
+		sec = 300
+	}
+	return time.Duration(sec) * time.Second
+}
+
+func pprofCPU(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="profile"`)
+	if err := pprof.StartCPUProfile(w); err != nil {
+		http.Error(w, fmt.Sprintf("Could not enable CPU profiling: %s", err), http.StatusInternalServerError)
+		return
+	}
+	sleep(r, seconds(r, 30))
+	pprof.StopCPUProfile()
+}
+
+func pprofTrace(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="trace"`)
+	if err := rtrace.Start(w); err != nil {
+		http.Error(w, fmt.Sprintf("Could not enable tracing: %s", err), http.StatusInternalServerError)
+		return
+	}
+	sleep(r, seconds(r, 1))
+	rtrace.Stop()
+}
+
+// 客户端断开时提前结束采样
+func sleep(r *http.Request, d time.Duration) {
+	select {
+	case <-time.After(d):
+	case <-r.Context().Done():
+	}
+}
+
+// GET /debug/goroutines 输出所有 goroutine 的调用栈
+func goroutines(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_ = pprof.Lookup("goroutine").WriteTo(w, 2)
+}
+
+func buildInfo(w http.ResponseWriter, r *http.Request) {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		http.Error(w, "Build info not available", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, info)
+}
+
+func runtimeStats(w http.ResponseWriter, r *http.Request) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	writeJSON(w, map[string]interface{}{
+		"GoVersion":    runtime.Version(),
+		"NumGoroutine": runtime.NumGoroutine(),
+		"NumCPU":       runtime.NumCPU(),
+		"GOMAXPROCS":   runtime.GOMAXPROCS(0),
+		"HeapAlloc":    mem.HeapAlloc,
+		"HeapObjects":  mem.HeapObjects,
+		"Sys":          mem.Sys,
+		"NumGC":        mem.NumGC,
+		"PauseTotalNs": mem.PauseTotalNs,
+	})
+}
+
+// GET /debug/config 当前进程的命令行配置，敏感配置项的值会被隐藏
+func config(w http.ResponseWriter, r *http.Request) {
+	values := make(map[string]string)
+	flag.VisitAll(func(f *flag.Flag) {
+		values[f.Name] = redact(f.Name, f.Value.String())
+	})
+	writeJSON(w, values)
+}
+
+func redact(name, value string) string {
+	if value == "" {
+		return value
+	}
+	lower := strings.ToLower(name)
+	for _, word := range secretWords {
+		if strings.Contains(lower, word) {
+			return "[REDACTED]"
+		}
+	}
+	return value
+}
+
+// GET /debug/providers 当前进程已知的服务提供方
+func providers(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, registry.Providers())
+}
+
+func writeJSON(w http.ResponseWriter, obj interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(obj)
+}
@@ -0,0 +1,87 @@
+package service
+
+import (
+	"Distribute/registry"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// Check 就绪检查，返回错误说明当前服务还不能正常处理请求
+type Check func() error
+
+var (
+	readinessChecks = make(map[string]Check)
+	checksMutex     = new(sync.RWMutex)
+)
+
+// AddReadinessCheck 添加就绪检查，同名检查会被替换，需要在 Start 之前调用
+func AddReadinessCheck(name string, check Check) {
+	checksMutex.Lock()
+	defer checksMutex.Unlock()
+	readinessChecks[name] = check
+}
+
+// ProviderCheck 检查是否已经获得所需服务的提供方
+func ProviderCheck(name registry.ServiceName) Check {
+	return func() error {
+		_, err := registry.GetProvider(name)
+		return err
+	}
+}
+
+// 就绪检查的结果，Checks 中每一项为 "ok" 或错误信息
+type readiness struct {
+	Ready  bool
+	Checks map[string]string
+}
+
+func checkReadiness() readiness {
+	checksMutex.RLock()
+	names := make([]string, 0, len(readinessChecks))
+	for name := range readinessChecks {
+		names = append(names, name)
+	}
+	checksMutex.RUnlock()
+	sort.Strings(names)
+
+	result := readiness{Ready: true, Checks: make(map[string]string, len(names))}
+	for _, name := range names {
+		checksMutex.RLock()
+		check := readinessChecks[name]
+		checksMutex.RUnlock()
+		if err := check(); err != nil {
+			result.Ready = false
+			result.Checks[name] = err.Error()
+			continue
+		}
+		result.Checks[name] = "ok"
+	}
+	return result
+}
+
+// GET /healthz 存活检查，进程能够处理请求即返回 200
+// GET /readyz  就绪检查，所有检查通过返回 200，否则返回 503 及失败原因
+func registerHealthHandlers() {
+	http.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = w.Write([]byte("ok\n"))
+	})
+	http.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		result := checkReadiness()
+		w.Header().Set("Content-Type", "application/json")
+		if !result.Ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		_ = json.NewEncoder(w).Encode(result)
+	})
+}
@@ -1,7 +1,9 @@
 package service
 
 import (
+	"Distribute/metrics"
 	"Distribute/registry"
+	"Distribute/trace"
 	"context"
 	"fmt"
 	"log"
@@ -10,7 +12,13 @@ import (
 
 func Start(ctx context.Context, host, port string, reg registry.Registration, registerHandlers func()) (context.Context, error) {
 	registerHandlers()
+	// 所有服务统一暴露 Prometheus 格式的指标
+	http.Handle("/metrics", metrics.Handler())
+	registerHealthHandlers()
 	ctx = StartService(ctx, reg.ServiceName, host, port)
+	if adminAddr != "" {
+		startAdmin(ctx)
+	}
 	err := registry.RegisterService(reg)
 	if err != nil {
 		return ctx, err
@@ -24,6 +32,9 @@ func StartService(ctx context.Context, serviceName registry.ServiceName, host, p
 	var srv http.Server
 	// 本地运行，只需指定端口号
 	srv.Addr = ":" + port
+	// 统计每个路由的请求数与耗时，并延续上游服务传来的调用链
+	srv.Handler = trace.Middleware(metrics.InstrumentHandler(http.DefaultServeMux))
+	trace.SetService(string(serviceName))
 
 	go func() {
 		// 协程 监听服务端口，出现错误时打印错误并发出取消信号
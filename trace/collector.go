@@ -0,0 +1,235 @@
+package trace
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Collector 进程内的 span 收集器，同时提供按 trace id 查看 span 的页面
+type Collector struct {
+	// 最多保留的调用链数量，超出后丢弃最早的调用链
+	maxTraces int
+	traces    map[string][]Span
+	order     []string
+	mutex     *sync.RWMutex
+}
+
+func NewCollector(maxTraces int) *Collector {
+	return &Collector{
+		maxTraces: maxTraces,
+		traces:    make(map[string][]Span),
+		order:     make([]string, 0),
+		mutex:     new(sync.RWMutex),
+	}
+}
+
+// DefaultCollector 由 RegisterHandlers 挂载到 /traces
+var DefaultCollector = NewCollector(1000)
+
+// Export 使 Collector 可以直接作为当前进程的导出器
+func (c *Collector) Export(spans []Span) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, s := range spans {
+		if _, ok := c.traces[s.TraceID]; !ok {
+			c.order = append(c.order, s.TraceID)
+		}
+		c.traces[s.TraceID] = append(c.traces[s.TraceID], s)
+	}
+	for len(c.order) > c.maxTraces {
+		delete(c.traces, c.order[0])
+		c.order = c.order[1:]
+	}
+	return nil
+}
+
+// TraceSummary 调用链列表页展示的摘要
+type TraceSummary struct {
+	TraceID  string
+	Root     string
+	Services []string
+	Start    time.Time
+	Duration time.Duration
+	Spans    int
+	Errors   int
+}
+
+// Traces 按开始时间倒序返回所有调用链的摘要
+func (c *Collector) Traces() []TraceSummary {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	summaries := make([]TraceSummary, 0, len(c.traces))
+	for id, spans := range c.traces {
+		summary := TraceSummary{TraceID: id, Spans: len(spans)}
+		services := make(map[string]bool)
+		var end time.Time
+		for _, s := range spans {
+			if summary.Start.IsZero() || s.StartTime.Before(summary.Start) {
+				summary.Start = s.StartTime
+			}
+			if s.EndTime.After(end) {
+				end = s.EndTime
+			}
+			if s.ParentID == "" || summary.Root == "" {
+				summary.Root = s.Name
+			}
+			if s.Error != "" {
+				summary.Errors++
+			}
+			if !services[s.Service] {
+				services[s.Service] = true
+				summary.Services = append(summary.Services, s.Service)
+			}
+		}
+		summary.Duration = end.Sub(summary.Start)
+		sort.Strings(summary.Services)
+		summaries = append(summaries, summary)
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		return summaries[i].Start.After(summaries[j].Start)
+	})
+	return summaries
+}
+
+// SpanView span 详情页中的一行，Depth 用于缩进展示父子关系
+type SpanView struct {
+	Span
+	Depth  int
+	Offset time.Duration
+}
+
+// Trace 返回某个调用链的所有 span，父 span 在前，子 span 按开始时间排列在其后
+func (c *Collector) Trace(traceID string) []SpanView {
+	c.mutex.RLock()
+	spans := append([]Span(nil), c.traces[traceID]...)
+	c.mutex.RUnlock()
+	if len(spans) == 0 {
+		return nil
+	}
+	sort.Slice(spans, func(i, j int) bool { return spans[i].StartTime.Before(spans[j].StartTime) })
+	known := make(map[string]bool, len(spans))
+	children := make(map[string][]Span)
+	for _, s := range spans {
+		known[s.SpanID] = true
+	}
+	var roots []Span
+	for _, s := range spans {
+		// 父 span 尚未收集到时也作为根展示
+		if s.ParentID == "" || !known[s.ParentID] {
+			roots = append(roots, s)
+			continue
+		}
+		children[s.ParentID] = append(children[s.ParentID], s)
+	}
+	start := spans[0].StartTime
+	views := make([]SpanView, 0, len(spans))
+	var walk func(s Span, depth int)
+	walk = func(s Span, depth int) {
+		views = append(views, SpanView{Span: s, Depth: depth, Offset: s.StartTime.Sub(start)})
+		for _, child := range children[s.SpanID] {
+			walk(child, depth+1)
+		}
+	}
+	for _, root := range roots {
+		walk(root, 0)
+	}
+	return views
+}
+
+// POST /traces          接收 JSON 数组形式的 span
+// GET  /traces          调用链列表
+// GET  /traces/{id}     调用链详情，?format=json 时返回 JSON
+func (c *Collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	traceID := strings.Trim(strings.TrimPrefix(r.URL.Path, "/traces"), "/")
+	switch {
+	case r.Method == http.MethodPost && traceID == "":
+		var spans []Span
+		if err := json.NewDecoder(r.Body).Decode(&spans); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		_ = c.Export(spans)
+		w.WriteHeader(http.StatusAccepted)
+	case r.Method == http.MethodGet && traceID == "":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_ = viewTemplate.ExecuteTemplate(w, "traces", c.Traces())
+	case r.Method == http.MethodGet:
+		views := c.Trace(traceID)
+		if views == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.URL.Query().Get("format") == "json" {
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(views)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_ = viewTemplate.ExecuteTemplate(w, "trace", struct {
+			TraceID string
+			Spans   []SpanView
+		}{traceID, views})
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// RegisterHandlers 将默认收集器挂载到 /traces
+func RegisterHandlers() {
+	http.Handle("/traces", DefaultCollector)
+	http.Handle("/traces/", DefaultCollector)
+}
+
+var viewTemplate = template.Must(template.New("view").Funcs(template.FuncMap{
+	"join": strings.Join,
+}).Parse(`
+{{define "traces"}}<!DOCTYPE html>
+<html lang="en">
+<head><meta charset="UTF-8"><title>Traces</title></head>
+<body>
+<h1>Traces</h1>
+{{if .}}
+<table>
+    <tr><th>Trace ID</th><th>Root</th><th>Services</th><th>Start</th><th>Duration</th><th>Spans</th><th>Errors</th></tr>
+    {{range .}}
+    <tr>
+        <td><a href="/traces/{{.TraceID}}">{{.TraceID}}</a></td>
+        <td>{{.Root}}</td>
+        <td>{{join .Services ", "}}</td>
+        <td>{{.Start.Format "2006-01-02 15:04:05.000"}}</td>
+        <td>{{.Duration}}</td>
+        <td>{{.Spans}}</td>
+        <td>{{.Errors}}</td>
+    </tr>
+    {{end}}
+</table>
+{{else}}
+<em>No traces collected</em>
+{{end}}
+</body>
+</html>{{end}}
+{{define "trace"}}<!DOCTYPE html>
+<html lang="en">
+<head><meta charset="UTF-8"><title>Trace {{.TraceID}}</title></head>
+<body>
+<h1><a href="/traces">Traces</a> - {{.TraceID}}</h1>
+<table>
+    <tr><th>Span</th><th>Service</th><th>Offset</th><th>Duration</th><th>Error</th><th>Attributes</th></tr>
+    {{range .Spans}}
+    <tr>
+        <td style="padding-left: {{.Depth}}em">{{.Name}}</td>
+        <td>{{.Service}}</td>
+        <td>{{.Offset}}</td>
+        <td>{{.Duration}}</td>
+        <td>{{.Error}}</td>
+        <td>{{range $k, $v := .Attributes}}{{$k}}={{$v}} {{end}}</td>
+    </tr>
+    {{end}}
+</table>
+</body>
+</html>{{end}}`))
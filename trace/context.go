@@ -0,0 +1,117 @@
+package trace
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// W3C Trace Context 使用的请求头
+const TraceparentHeader = "traceparent"
+
+// SpanContext 在服务之间传递的调用链信息
+type SpanContext struct {
+	TraceID string
+	SpanID  string
+	Sampled bool
+}
+
+// trace id 与 span id 必须是小写十六进制且不能全为 0
+func (sc SpanContext) IsValid() bool {
+	return isHex(sc.TraceID, 32) && !allZero(sc.TraceID) &&
+		isHex(sc.SpanID, 16) && !allZero(sc.SpanID)
+}
+
+// Traceparent 按 W3C 格式编码：version-traceid-spanid-flags
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", sc.TraceID, sc.SpanID, flags)
+}
+
+/**
+ * ParseTraceparent
+ * @Description: 解析 traceparent 请求头，格式不合法时返回错误
+ * @param header
+ * @return SpanContext
+ * @return error
+ */
+func ParseTraceparent(header string) (SpanContext, error) {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 {
+		return SpanContext{}, fmt.Errorf("invalid traceparent %q", header)
+	}
+	version, traceID, spanID, flags := parts[0], parts[1], parts[2], parts[3]
+	// 版本 00 必须恰好四段，ff 为保留的非法版本
+	if !isHex(version, 2) || version == "ff" || (version == "00" && len(parts) != 4) {
+		return SpanContext{}, fmt.Errorf("unsupported traceparent version %q", version)
+	}
+	if !isHex(flags, 2) {
+		return SpanContext{}, fmt.Errorf("invalid traceparent flags %q", flags)
+	}
+	flagBits, _ := hex.DecodeString(flags)
+	sc := SpanContext{
+		TraceID: traceID,
+		SpanID:  spanID,
+		Sampled: flagBits[0]&1 == 1,
+	}
+	if !sc.IsValid() {
+		return SpanContext{}, fmt.Errorf("invalid trace or span id in traceparent %q", header)
+	}
+	return sc, nil
+}
+
+// 长度正确且全部为小写十六进制
+func isHex(s string, length int) bool {
+	if len(s) != length {
+		return false
+	}
+	for _, c := range s {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func allZero(s string) bool {
+	return strings.Trim(s, "0") == ""
+}
+
+func newID(bytes int) string {
+	b := make([]byte, bytes)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func newTraceID() string { return newID(16) }
+func newSpanID() string  { return newID(8) }
+
+type contextKey struct{}
+
+// ContextWith 将调用链信息放入 ctx
+func ContextWith(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, contextKey{}, sc)
+}
+
+// FromContext 取出 ctx 中的调用链信息
+func FromContext(ctx context.Context) (SpanContext, bool) {
+	if ctx == nil {
+		return SpanContext{}, false
+	}
+	sc, ok := ctx.Value(contextKey{}).(SpanContext)
+	return sc, ok && sc.IsValid()
+}
+
+// TraceID 返回 ctx 所属调用链的 id，不在调用链中时返回空字符串
+func TraceID(ctx context.Context) string {
+	sc, ok := FromContext(ctx)
+	if !ok {
+		return ""
+	}
+	return sc.TraceID
+}
@@ -0,0 +1,99 @@
+package trace
+
+import (
+	"Distribute/internal/httputil"
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+/**
+ * Middleware
+ * @Description: 请求携带 traceparent 时继续该调用链并记录服务端 span，不携带时不做处理
+ * @param next
+ * @return http.Handler
+ */
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parent, err := ParseTraceparent(r.Header.Get(TraceparentHeader))
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		serve(next, w, r.WithContext(ContextWith(r.Context(), parent)))
+	})
+}
+
+// Handler 为每个请求记录服务端 span，没有上游调用链时在这里开始新的调用链
+func Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := FromContext(r.Context()); !ok {
+			if parent, err := ParseTraceparent(r.Header.Get(TraceparentHeader)); err == nil {
+				r = r.WithContext(ContextWith(r.Context(), parent))
+			}
+		}
+		serve(next, w, r)
+	})
+}
+
+func serve(next http.Handler, w http.ResponseWriter, r *http.Request) {
+	// 外层已经为该请求记录了服务端 span
+	if r.Context().Value(serverSpanKey{}) != nil {
+		next.ServeHTTP(w, r)
+		return
+	}
+	ctx, span := StartSpan(r.Context(), r.Method+" "+r.URL.Path)
+	ctx = contextWithServerSpan(ctx)
+	defer span.End()
+	span.SetAttribute("http.method", r.Method)
+	span.SetAttribute("http.target", r.URL.RequestURI())
+	rec := httputil.NewStatusRecorder(w)
+	w.Header().Set("Trace-Id", span.TraceID)
+	next.ServeHTTP(rec, r.WithContext(ctx))
+	span.SetAttribute("http.status_code", strconv.Itoa(rec.Status))
+	if rec.Status >= http.StatusInternalServerError {
+		span.SetError(fmt.Errorf("responded with %d %s", rec.Status, http.StatusText(rec.Status)))
+	}
+}
+
+// Transport 为出站请求记录客户端 span，并通过 traceparent 把调用链传给下游服务
+type Transport struct {
+	Base http.RoundTripper
+}
+
+func (t Transport) RoundTrip(r *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	if _, ok := FromContext(r.Context()); !ok {
+		return base.RoundTrip(r)
+	}
+	_, span := StartSpan(r.Context(), r.Method+" "+r.URL.Host+r.URL.Path)
+	defer span.End()
+	span.SetAttribute("http.method", r.Method)
+	span.SetAttribute("http.url", r.URL.String())
+	// RoundTripper 不应修改传入的请求
+	out := r.Clone(r.Context())
+	out.Header.Set(TraceparentHeader, span.Context().Traceparent())
+	res, err := base.RoundTrip(out)
+	if err != nil {
+		span.SetError(err)
+		return nil, err
+	}
+	span.SetAttribute("http.status_code", strconv.Itoa(res.StatusCode))
+	if res.StatusCode >= http.StatusInternalServerError {
+		span.SetError(fmt.Errorf("responded with %d %s", res.StatusCode, http.StatusText(res.StatusCode)))
+	}
+	return res, nil
+}
+
+// Client 服务之间调用使用的 http 客户端，请求需要通过 NewRequestWithContext 带上 ctx
+var Client = &http.Client{Transport: Transport{}}
+
+type serverSpanKey struct{}
+
+func contextWithServerSpan(ctx context.Context) context.Context {
+	return context.WithValue(ctx, serverSpanKey{}, true)
+}
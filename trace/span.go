@@ -0,0 +1,228 @@
+package trace
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Span 调用链中的一次操作
+type Span struct {
+	TraceID    string
+	SpanID     string
+	ParentID   string `json:",omitempty"`
+	Name       string
+	Service    string
+	StartTime  time.Time
+	EndTime    time.Time
+	Error      string            `json:",omitempty"`
+	Attributes map[string]string `json:",omitempty"`
+
+	ended bool
+	mutex *sync.Mutex
+}
+
+func (s *Span) Context() SpanContext {
+	return SpanContext{TraceID: s.TraceID, SpanID: s.SpanID, Sampled: true}
+}
+
+func (s *Span) Duration() time.Duration {
+	return s.EndTime.Sub(s.StartTime)
+}
+
+func (s *Span) SetAttribute(key, value string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.Attributes == nil {
+		s.Attributes = make(map[string]string)
+	}
+	s.Attributes[key] = value
+}
+
+func (s *Span) SetError(err error) {
+	if err == nil {
+		return
+	}
+	s.mutex.Lock()
+	s.Error = err.Error()
+	s.mutex.Unlock()
+}
+
+// End 结束当前 span 并交给导出器，重复调用无效
+func (s *Span) End() {
+	s.mutex.Lock()
+	if s.ended {
+		s.mutex.Unlock()
+		return
+	}
+	s.ended = true
+	s.EndTime = time.Now()
+	finished := *s
+	finished.Attributes = make(map[string]string, len(s.Attributes))
+	for k, v := range s.Attributes {
+		finished.Attributes[k] = v
+	}
+	s.mutex.Unlock()
+	pipe.enqueue(finished)
+}
+
+/**
+ * StartSpan
+ * @Description: 创建新的 span，ctx 中已有调用链时作为其子 span，否则开始新的调用链
+ * @param ctx
+ * @param name
+ * @return context.Context 携带新 span 的 ctx
+ * @return *Span
+ */
+func StartSpan(ctx context.Context, name string) (context.Context, *Span) {
+	span := &Span{
+		SpanID:    newSpanID(),
+		Name:      name,
+		Service:   serviceName(),
+		StartTime: time.Now(),
+		mutex:     new(sync.Mutex),
+	}
+	if parent, ok := FromContext(ctx); ok {
+		span.TraceID = parent.TraceID
+		span.ParentID = parent.SpanID
+	} else {
+		span.TraceID = newTraceID()
+	}
+	return ContextWith(ctx, span.Context()), span
+}
+
+var (
+	service      string
+	serviceMutex = new(sync.RWMutex)
+)
+
+// SetService 设置当前进程产生的 span 所属的服务名
+func SetService(name string) {
+	serviceMutex.Lock()
+	service = name
+	serviceMutex.Unlock()
+}
+
+func serviceName() string {
+	serviceMutex.RLock()
+	defer serviceMutex.RUnlock()
+	return service
+}
+
+// Exporter 接收已经结束的 span
+type Exporter interface {
+	Export(spans []Span) error
+}
+
+// 异步导出，避免请求路径上等待导出器
+type pipeline struct {
+	queue     chan Span
+	exporters []Exporter
+	mutex     *sync.RWMutex
+	once      sync.Once
+}
+
+var pipe = pipeline{
+	queue: make(chan Span, 1024),
+	mutex: new(sync.RWMutex),
+}
+
+// SetExporter 替换当前进程使用的导出器，未设置时 span 会被丢弃
+func SetExporter(exporters ...Exporter) {
+	pipe.mutex.Lock()
+	pipe.exporters = exporters
+	pipe.mutex.Unlock()
+	pipe.once.Do(func() { go pipe.run() })
+}
+
+func (p *pipeline) enqueue(s Span) {
+	select {
+	case p.queue <- s:
+	default:
+		// 队列已满时直接丢弃，不阻塞业务
+	}
+}
+
+func (p *pipeline) run() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	batch := make([]Span, 0, 64)
+	for {
+		select {
+		case s := <-p.queue:
+			batch = append(batch, s)
+			if len(batch) < cap(batch) {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		p.mutex.RLock()
+		exporters := p.exporters
+		p.mutex.RUnlock()
+		for _, e := range exporters {
+			if err := e.Export(batch); err != nil {
+				log.Println("Failed to export spans: ", err)
+			}
+		}
+		batch = make([]Span, 0, 64)
+	}
+}
+
+// FileExporter 以 JSON Lines 格式将 span 追加到本地文件
+type FileExporter string
+
+func (fe FileExporter) Export(spans []Span) error {
+	f, err := os.OpenFile(string(fe), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+	enc := json.NewEncoder(f)
+	for _, s := range spans {
+		if err := enc.Encode(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// HTTPExporter 将 span 发送到收集器的 /traces 接口
+type HTTPExporter string
+
+func (he HTTPExporter) Export(spans []Span) error {
+	data, err := json.Marshal(spans)
+	if err != nil {
+		return err
+	}
+	// 使用默认客户端，导出请求本身不再产生 span
+	res, err := http.Post(string(he), "application/json", bytes.NewBuffer(data))
+	if err != nil {
+		return err
+	}
+	_ = res.Body.Close()
+	if res.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("Collector responded with code %v", res.StatusCode)
+	}
+	return nil
+}
+
+// LookupExporter 每次导出时查找收集器的 /traces 接口地址，收集器可以在进程启动之后再出现
+// 查找失败时丢弃这一批 span
+type LookupExporter func() (string, error)
+
+func (le LookupExporter) Export(spans []Span) error {
+	url, err := le()
+	if err != nil {
+		return nil
+	}
+	return HTTPExporter(url).Export(spans)
+}